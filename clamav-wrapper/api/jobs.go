@@ -0,0 +1,90 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Job states reported by GET /scan/{id}.
+const (
+	JobPending = "pending" // Waiting for a free scan slot
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is an asynchronous scan of a stored object.
+type Job struct {
+	ID         string        `json:"id"`
+	Status     string        `json:"status"`
+	Bucket     string        `json:"bucket"`
+	Key        string        `json:"key"`
+	VersionID  string        `json:"versionId,omitempty"`
+	Result     *ScanResponse `json:"result,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	FinishedAt *time.Time    `json:"finishedAt,omitempty"`
+}
+
+// jobStore keeps jobs in memory. Finished jobs are dropped once they are
+// older than ttl, so clients must fetch the outcome within that time.
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+	ttl  time.Duration
+}
+
+func newJobStore(ttl time.Duration) *jobStore {
+	return &jobStore{jobs: make(map[string]*Job), ttl: ttl}
+}
+
+// create registers a new pending job and returns a copy of it, like get.
+func (s *jobStore) create(bucket, key, versionID string) Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	job := &Job{ID: newJobID(), Status: JobPending, Bucket: bucket, Key: key, VersionID: versionID, CreatedAt: time.Now().UTC()}
+	s.jobs[job.ID] = job
+	return *job
+}
+
+// get returns a copy of the job, so it can be encoded while the job runs.
+func (s *jobStore) get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// update applies fn to the job under the store's lock.
+func (s *jobStore) update(id string, fn func(*Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+func (s *jobStore) expireLocked() {
+	cutoff := time.Now().Add(-s.ttl)
+	for id, job := range s.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
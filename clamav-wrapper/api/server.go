@@ -0,0 +1,329 @@
+// Package api serves synchronous and asynchronous virus scans over HTTP, next
+// to (or instead of) the queue-driven pipeline.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"clamav-wrapper/clamav"
+	"clamav-wrapper/config"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/storage"
+)
+
+// ScanResponse is the outcome of a scan as returned by the API.
+type ScanResponse struct {
+	Verdict    string `json:"verdict"`
+	Signature  string `json:"signature,omitempty"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Engine     string `json:"engine,omitempty"`
+	Database   string `json:"database,omitempty"`
+}
+
+func newScanResponse(result *clamav.ScanResult) *ScanResponse {
+	resp := &ScanResponse{
+		Verdict:    string(result.Verdict),
+		Signature:  result.Signature,
+		Size:       result.BytesScanned,
+		SHA256:     result.SHA256,
+		DurationMs: result.Duration.Milliseconds(),
+	}
+	if result.Version != nil {
+		resp.Engine = result.Version.Engine
+		resp.Database = result.Version.Database
+	}
+	return resp
+}
+
+// objectRequest is the body of POST /scan/object.
+type objectRequest struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`       // Plain (not URL-encoded) object key
+	VersionID string `json:"versionId"` // Optional, the latest version if empty
+	Async     bool   `json:"async"`
+}
+
+// Server is the HTTP scanning API.
+type Server struct {
+	cfg   config.APIConfig
+	store storage.Storage
+	jobs  *jobStore
+	slots chan struct{} // Bounds the number of concurrent scans
+	http  *http.Server
+
+	ctx    context.Context // Cancelled on Shutdown to abort asynchronous jobs
+	cancel context.CancelFunc
+}
+
+// NewServer creates the API server. Objects requested through /scan/object
+// are read from store.
+func NewServer(cfg config.APIConfig, store storage.Storage) (*Server, error) {
+	if cfg.MaxConcurrentScans <= 0 {
+		return nil, fmt.Errorf("API concurrent scans must be positive, got %d", cfg.MaxConcurrentScans)
+	}
+
+	s := &Server{
+		cfg:   cfg,
+		store: store,
+		jobs:  newJobStore(cfg.JobTTL),
+		slots: make(chan struct{}, cfg.MaxConcurrentScans),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /scan", s.handleScan)
+	mux.HandleFunc("POST /scan/object", s.handleScanObject)
+	mux.HandleFunc("GET /scan/{id}", s.handleGetJob)
+
+	s.http = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           correlate(s.authenticate(mux)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+// Start listens on the configured address and serves requests in the background.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.Addr, err)
+	}
+	slog.Info("Scan API listening", "addr", ln.Addr().String())
+
+	go func() {
+		if err := s.http.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Scan API server error", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops accepting requests, waits for running requests until ctx
+// expires, and aborts asynchronous jobs that have not started scanning yet.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+	return s.http.Shutdown(ctx)
+}
+
+// correlate gives every request a correlation ID, taken from the X-Request-ID
+// header when the client sent one, and echoes it in the response. A W3C
+// traceparent header makes the request's spans part of the caller's trace.
+func correlate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = logging.NewID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		next.ServeHTTP(w, r.WithContext(logging.WithCorrelationID(ctx, id)))
+	})
+}
+
+// authenticate requires "Authorization: Bearer <token>" when a token is configured.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if s.cfg.AuthToken == "" {
+		return next
+	}
+	want := []byte("Bearer " + s.cfg.AuthToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire waits for a free scan slot; the returned function releases it.
+func (s *Server) acquire(ctx context.Context) (func(), error) {
+	select {
+	case s.slots <- struct{}{}:
+		return func() { <-s.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// handleScan scans the request body, streaming it to clamd as it arrives.
+// The file is either the whole body, or the first file part of a
+// multipart/form-data body.
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	maxBytes := int64(config.ClamAVMaxFileSizeMB) * 1024 * 1024
+	body := http.MaxBytesReader(w, r.Body, maxBytes)
+
+	var file io.Reader = body
+	size := r.ContentLength
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		r.Body = body
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		part, err := nextFilePart(mr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer part.Close()
+		file, size = part, -1 // Part sizes are not known up front
+	}
+
+	release, err := s.acquire(r.Context())
+	if err != nil {
+		return // Client went away while waiting
+	}
+	defer release()
+
+	result, err := clamav.Scan(r.Context(), file, size)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("file larger than %d bytes", maxBytes))
+			return
+		}
+		writeScanError(r.Context(), w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newScanResponse(result))
+}
+
+// nextFilePart returns the first part of a multipart body that is a file.
+func nextFilePart(mr *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("multipart body contains no file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// handleScanObject scans an object of the configured storage without moving
+// it. With "async": true it answers 202 with a job to poll on GET /scan/{id}.
+func (s *Server) handleScanObject(w http.ResponseWriter, r *http.Request) {
+	var req objectRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Bucket == "" || req.Key == "" {
+		writeError(w, http.StatusBadRequest, "bucket and key are required")
+		return
+	}
+
+	if req.Async {
+		job := s.jobs.create(req.Bucket, req.Key, req.VersionID)
+		// The job outlives the request: keep its correlation ID, but not its cancellation.
+		go s.runJob(logging.WithCorrelationID(s.ctx, logging.CorrelationID(r.Context())), job.ID, req.Bucket, req.Key, req.VersionID)
+		w.Header().Set("Location", "/scan/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	release, err := s.acquire(r.Context())
+	if err != nil {
+		return
+	}
+	defer release()
+
+	result, err := s.scanObject(r.Context(), req.Bucket, req.Key, req.VersionID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeScanError(r.Context(), w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newScanResponse(result))
+}
+
+func (s *Server) scanObject(ctx context.Context, bucket, key, versionID string) (*clamav.ScanResult, error) {
+	file, info, err := s.store.GetFileStreamWithSize(ctx, bucket, key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return clamav.Scan(ctx, file, info.Size)
+}
+
+// runJob performs an asynchronous /scan/object request. ctx is cancelled on Shutdown.
+func (s *Server) runJob(ctx context.Context, id, bucket, key, versionID string) {
+	finish := func(result *clamav.ScanResult, err error) {
+		now := time.Now().UTC()
+		s.jobs.update(id, func(j *Job) {
+			j.FinishedAt = &now
+			if err != nil {
+				j.Status, j.Error = JobFailed, err.Error()
+				return
+			}
+			j.Status, j.Result = JobDone, newScanResponse(result)
+		})
+	}
+
+	release, err := s.acquire(ctx)
+	if err != nil {
+		finish(nil, fmt.Errorf("server shutting down: %w", err))
+		return
+	}
+	defer release()
+
+	s.jobs.update(id, func(j *Job) { j.Status = JobRunning })
+	finish(s.scanObject(ctx, bucket, key, versionID))
+}
+
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobs.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown or expired job")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// writeScanError maps scanning errors to HTTP statuses: oversized files are
+// the client's problem, everything else is an upstream (clamd or storage) failure.
+func writeScanError(ctx context.Context, w http.ResponseWriter, err error) {
+	if errors.Is(err, clamav.ErrFileTooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	slog.ErrorContext(ctx, "Scan API request failed", "error", err)
+	writeError(w, http.StatusBadGateway, err.Error())
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
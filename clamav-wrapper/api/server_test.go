@@ -0,0 +1,327 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"clamav-wrapper/clamav"
+	"clamav-wrapper/clamav/clamavtest"
+	"clamav-wrapper/config"
+	"clamav-wrapper/storage"
+)
+
+// startAPI serves the API of cfg on a test server, scanning with a fake clamd
+// and reading objects from an in-memory store.
+func startAPI(t *testing.T, cfg config.APIConfig) (*httptest.Server, *clamavtest.Clamd, *storage.MemoryStorage) {
+	t.Helper()
+	clamd := clamavtest.Start(t)
+	t.Setenv("CLAMAV_ENDPOINTS", clamd.Endpoint())
+	t.Setenv("CLAMAV_HEALTH_CHECK_SECONDS", "0")
+	t.Setenv("CLAMAV_MAX_FILE_SIZE_MB", "1")
+	config.Init()
+	clamav.Init()
+	t.Cleanup(func() { clamav.Close() })
+	if clamav.RefreshVersion() == nil {
+		t.Fatal("fake clamd reported no version")
+	}
+
+	if cfg.MaxConcurrentScans == 0 {
+		cfg.MaxConcurrentScans = 4
+	}
+	if cfg.JobTTL == 0 {
+		cfg.JobTTL = time.Hour
+	}
+	store := storage.NewMemoryStorage()
+	s, err := NewServer(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(func() {
+		ts.Close()
+		s.cancel()
+	})
+	return ts, clamd, store
+}
+
+// call sends a request to the API and decodes its JSON response into v, if not nil.
+func call(t *testing.T, ts *httptest.Server, method, path, contentType string, body io.Reader, v any) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: invalid response: %v", method, path, err)
+		}
+	}
+	return resp
+}
+
+// multipartBody returns a multipart/form-data body with the given form fields
+// and, if fileName is not "", a file part.
+func multipartBody(t *testing.T, fields map[string]string, fileName, data string) (string, io.Reader) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	if fileName != "" {
+		w, err := mw.CreateFormFile("file", fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, data)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return mw.FormDataContentType(), &buf
+}
+
+func TestAuthenticate(t *testing.T) {
+	ts, _, _ := startAPI(t, config.APIConfig{AuthToken: "secret"})
+
+	for _, tt := range []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/scan", strings.NewReader("hello"))
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("Authorization %q: status %d, want %d", tt.header, resp.StatusCode, tt.want)
+		}
+		if resp.Header.Get("X-Request-ID") == "" {
+			t.Errorf("Authorization %q: no X-Request-ID", tt.header)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	ts, clamd, _ := startAPI(t, config.APIConfig{})
+	oversized := strings.Repeat("x", 1024*1024+1)
+	multipartOf := func(fields map[string]string, fileName, data string) (string, io.Reader) {
+		return multipartBody(t, fields, fileName, data)
+	}
+	raw := func(contentType, data string) (string, io.Reader) {
+		return contentType, strings.NewReader(data)
+	}
+
+	tests := []struct {
+		name    string
+		body    func() (string, io.Reader)
+		want    int
+		verdict string
+		scanned bool // Whether clamd saw the file
+	}{
+		{name: "raw clean", body: func() (string, io.Reader) { return raw("", "hello") }, want: http.StatusOK, verdict: "clean", scanned: true},
+		{name: "raw infected", body: func() (string, io.Reader) { return raw("application/octet-stream", clamavtest.EICAR) }, want: http.StatusOK, verdict: "infected", scanned: true},
+		// With a Content-Length over CLAMAV_MAX_FILE_SIZE_MB clamd is not even asked.
+		{name: "raw oversized", body: func() (string, io.Reader) { return raw("", oversized) }, want: http.StatusRequestEntityTooLarge},
+		// Without one the limit is only noticed while streaming.
+		{name: "raw oversized chunked", body: func() (string, io.Reader) { return "", io.MultiReader(strings.NewReader(oversized)) }, want: http.StatusRequestEntityTooLarge},
+		{name: "multipart clean", body: func() (string, io.Reader) { return multipartOf(nil, "a.txt", "hello") }, want: http.StatusOK, verdict: "clean", scanned: true},
+		{
+			name: "multipart file after a field",
+			body: func() (string, io.Reader) {
+				return multipartOf(map[string]string{"comment": "harmless"}, "eicar.com", clamavtest.EICAR)
+			},
+			want:    http.StatusOK,
+			verdict: "infected",
+			scanned: true,
+		},
+		{name: "multipart without file", body: func() (string, io.Reader) { return multipartOf(map[string]string{"comment": clamavtest.EICAR}, "", "") }, want: http.StatusBadRequest},
+		{name: "multipart without boundary", body: func() (string, io.Reader) { return raw("multipart/form-data", "hello") }, want: http.StatusBadRequest},
+		{name: "multipart oversized", body: func() (string, io.Reader) { return multipartOf(nil, "big.bin", oversized) }, want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scans := clamd.Scans.Load()
+			contentType, body := tt.body()
+			var got map[string]any
+			resp := call(t, ts, http.MethodPost, "/scan", contentType, body, &got)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d: %v", resp.StatusCode, tt.want, got)
+			}
+			if tt.verdict != "" && got["verdict"] != tt.verdict {
+				t.Errorf("verdict %v, want %s", got["verdict"], tt.verdict)
+			}
+			if tt.want == http.StatusOK && got["database"] != "27000" {
+				t.Errorf("database %v, want 27000", got["database"])
+			}
+			if scanned := clamd.Scans.Load() > scans; scanned != tt.scanned {
+				t.Errorf("file scanned: %v, want %v", scanned, tt.scanned)
+			}
+		})
+	}
+}
+
+func TestScanObject(t *testing.T) {
+	ts, _, store := startAPI(t, config.APIConfig{})
+	store.Put("uploads", "dir/eicar file.com", []byte(clamavtest.EICAR))
+
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		verdict string
+	}{
+		{name: "infected", body: `{"bucket":"uploads","key":"dir/eicar file.com"}`, want: http.StatusOK, verdict: "infected"},
+		{name: "not found", body: `{"bucket":"uploads","key":"missing.txt"}`, want: http.StatusNotFound},
+		{name: "no key", body: `{"bucket":"uploads"}`, want: http.StatusBadRequest},
+		{name: "invalid JSON", body: `{"bucket":`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]any
+			resp := call(t, ts, http.MethodPost, "/scan/object", "application/json", strings.NewReader(tt.body), &got)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d: %v", resp.StatusCode, tt.want, got)
+			}
+			if tt.verdict != "" && got["verdict"] != tt.verdict {
+				t.Errorf("verdict %v, want %s", got["verdict"], tt.verdict)
+			}
+		})
+	}
+}
+
+// pollJob fetches job id until its status is want.
+func pollJob(t *testing.T, ts *httptest.Server, id, want string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var job Job
+		if resp := call(t, ts, http.MethodGet, "/scan/"+id, "", nil, &job); resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /scan/%s: status %d", id, resp.StatusCode)
+		}
+		if job.Status == want {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s, want %s", job.Status, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Finished jobs can be fetched for JobTTL, then they are gone.
+func TestAsyncJob(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	ts, _, store := startAPI(t, config.APIConfig{JobTTL: ttl})
+	store.Put("uploads", "a.txt", []byte("hello"))
+
+	var job Job
+	resp := call(t, ts, http.MethodPost, "/scan/object", "application/json", strings.NewReader(`{"bucket":"uploads","key":"a.txt","async":true}`), &job)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/scan/"+job.ID {
+		t.Errorf("Location %q, want /scan/%s", loc, job.ID)
+	}
+
+	done := pollJob(t, ts, job.ID, JobDone)
+	if done.Result == nil || done.Result.Verdict != "clean" || done.FinishedAt == nil {
+		t.Errorf("finished job %+v", done)
+	}
+
+	var missing Job
+	resp = call(t, ts, http.MethodPost, "/scan/object", "application/json", strings.NewReader(`{"bucket":"uploads","key":"missing.txt","async":true}`), &missing)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	if failed := pollJob(t, ts, missing.ID, JobFailed); failed.Error == "" {
+		t.Errorf("failed job without error: %+v", failed)
+	}
+
+	time.Sleep(ttl + 50*time.Millisecond)
+	for _, id := range []string{job.ID, missing.ID} {
+		if resp := call(t, ts, http.MethodGet, "/scan/"+id, "", nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("job fetched after its TTL: status %d", resp.StatusCode)
+		}
+	}
+	if resp := call(t, ts, http.MethodGet, "/scan/unknown", "", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown job: status %d", resp.StatusCode)
+	}
+}
+
+// Scans beyond MaxConcurrentScans, synchronous or not, wait for a free slot.
+func TestConcurrentScans(t *testing.T) {
+	ts, clamd, store := startAPI(t, config.APIConfig{MaxConcurrentScans: 1})
+	store.Put("uploads", "a.txt", []byte("hello"))
+
+	blocked, unblock := make(chan struct{}), make(chan struct{})
+	clamd.OnScan.Store(func() {
+		select {
+		case blocked <- struct{}{}:
+			<-unblock
+		default:
+		}
+	})
+
+	scan := func(data string) chan int {
+		status := make(chan int, 1)
+		go func() {
+			resp, err := ts.Client().Post(ts.URL+"/scan", "", strings.NewReader(data))
+			if err != nil {
+				status <- 0
+				return
+			}
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		return status
+	}
+	first := scan("first")
+	<-blocked // The only slot is taken
+	second := scan("second")
+	var job Job
+	call(t, ts, http.MethodPost, "/scan/object", "application/json", strings.NewReader(`{"bucket":"uploads","key":"a.txt","async":true}`), &job)
+
+	time.Sleep(100 * time.Millisecond)
+	if n := clamd.Scans.Load(); n != 1 {
+		t.Errorf("%d scans running, want 1", n)
+	}
+	if got := pollJob(t, ts, job.ID, JobPending); got.Status != JobPending {
+		t.Errorf("job %s while no slot is free", got.Status)
+	}
+
+	close(unblock)
+	for _, result := range []chan int{first, second} {
+		if status := <-result; status != http.StatusOK {
+			t.Errorf("status %d, want %d", status, http.StatusOK)
+		}
+	}
+	pollJob(t, ts, job.ID, JobDone)
+	if n := clamd.Scans.Load(); n != 3 {
+		t.Errorf("%d scans, want 3", n)
+	}
+}
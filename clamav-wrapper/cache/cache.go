@@ -0,0 +1,198 @@
+// Package cache remembers the verdicts of scanned content, so a file uploaded
+// again under another key is not streamed to clamd a second time. Verdicts are
+// keyed by the SHA-256 of the content and the signature database version they
+// were obtained with: once clamd loads new signatures, earlier verdicts no
+// longer apply and every file is scanned again.
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"clamav-wrapper/clamav"
+	"clamav-wrapper/config"
+	"clamav-wrapper/metrics"
+	"clamav-wrapper/policy"
+	"clamav-wrapper/storage"
+)
+
+// Backend stores string values under string keys.
+type Backend interface {
+	// Get returns the value of key, and false if there is none.
+	Get(ctx context.Context, key string) (string, bool, error)
+
+	// Set stores value under key.
+	Set(ctx context.Context, key, value string) error
+
+	// Purge drops every entry. Backends whose entries expire on their own may do nothing.
+	Purge(ctx context.Context) error
+
+	// Close releases the connection to the backend.
+	Close() error
+}
+
+// Entry is a cached verdict.
+type Entry struct {
+	Verdict   clamav.Verdict `json:"verdict"`
+	Signature string         `json:"signature,omitempty"`
+	Engine    string         `json:"engine,omitempty"`
+	Database  string         `json:"database"`
+	ScannedAt time.Time      `json:"scannedAt"`
+
+	// Content is what inspecting the file found, when the content policy was
+	// enabled while scanning it and the file was clean.
+	Content *policy.Content `json:"content,omitempty"`
+}
+
+// Result turns the entry into the scan result of an object of the given
+// content hash and size, marked as cached.
+func (e *Entry) Result(sha256 string, size int64) *clamav.ScanResult {
+	return &clamav.ScanResult{
+		Verdict:      e.Verdict,
+		Signature:    e.Signature,
+		BytesScanned: size,
+		SHA256:       sha256,
+		Version:      &clamav.VersionInfo{Engine: e.Engine, Database: e.Database},
+		Cached:       true,
+	}
+}
+
+// Cache looks verdicts up by content hash. Objects whose hash is not known
+// without reading them can be recognised by their ETag and size instead,
+// which the cache maps to the hash of the content they had when scanned.
+type Cache struct {
+	backend   Backend
+	trustETag bool
+
+	mu       sync.Mutex
+	database string // Signature database version of the last lookup
+}
+
+// New creates the cache selected by cfg.Type. It returns nil, nil when caching is disabled.
+func New(cfg config.ScanCacheConfig) (*Cache, error) {
+	var backend Backend
+	var err error
+	switch cfg.Type {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		backend, err = NewMemoryBackend(cfg.Size, cfg.TTL)
+	case "redis":
+		backend, err = NewRedisBackend(config.RedisCfg, cfg.RedisPrefix, cfg.TTL)
+	default:
+		return nil, fmt.Errorf("unsupported scan cache type: %s", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{backend: backend, trustETag: cfg.TrustETag}, nil
+}
+
+func verdictKey(database, sha256 string) string {
+	return "verdict:" + database + ":" + sha256
+}
+
+func etagKey(obj storage.ObjectInfo) string {
+	return fmt.Sprintf("etag:%s:%d", obj.ETag, obj.Size)
+}
+
+// Lookup returns the verdict for obj under the given signature database
+// version, and the content hash it was found by. Errors of the backend are
+// logged and reported as a miss: the object is then simply scanned.
+func (c *Cache) Lookup(ctx context.Context, obj storage.ObjectInfo, database string) (*Entry, string, bool) {
+	c.invalidate(ctx, database)
+
+	entry, sha256, err := c.lookup(ctx, obj, database)
+	if err != nil {
+		slog.WarnContext(ctx, "Scan cache lookup failed", "error", err)
+	}
+	if entry == nil {
+		metrics.CacheLookups.WithLabelValues("miss").Inc()
+		return nil, "", false
+	}
+	metrics.CacheLookups.WithLabelValues("hit").Inc()
+	return entry, sha256, true
+}
+
+func (c *Cache) lookup(ctx context.Context, obj storage.ObjectInfo, database string) (*Entry, string, error) {
+	sha256 := obj.SHA256
+	if sha256 == "" && c.trustETag && obj.ETag != "" {
+		var err error
+		if sha256, _, err = c.backend.Get(ctx, etagKey(obj)); err != nil {
+			return nil, "", err
+		}
+	}
+	if sha256 == "" {
+		return nil, "", nil
+	}
+
+	value, ok, err := c.backend.Get(ctx, verdictKey(database, sha256))
+	if err != nil || !ok {
+		return nil, "", err
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		return nil, "", fmt.Errorf("invalid cache entry for %s: %w", sha256, err)
+	}
+	return &entry, sha256, nil
+}
+
+// Store caches the verdict of a completed scan of obj, along with what
+// inspecting it found, if it was inspected. Errors (clamd error replies) are
+// not cached, and neither are results without a content hash or signature
+// database version.
+func (c *Cache) Store(ctx context.Context, obj storage.ObjectInfo, result *clamav.ScanResult, content *policy.Content, scannedAt time.Time) {
+	if result.Cached || result.Verdict == clamav.VerdictError || result.SHA256 == "" || result.Version == nil || result.Version.Database == "" {
+		return
+	}
+
+	value, err := json.Marshal(Entry{
+		Verdict:   result.Verdict,
+		Signature: result.Signature,
+		Engine:    result.Version.Engine,
+		Database:  result.Version.Database,
+		ScannedAt: scannedAt,
+		Content:   content,
+	})
+	if err != nil {
+		return
+	}
+	if err := c.backend.Set(ctx, verdictKey(result.Version.Database, result.SHA256), string(value)); err != nil {
+		slog.WarnContext(ctx, "Failed to cache scan verdict", "error", err)
+		return
+	}
+	// The object may have been replaced between stat and download; only map an
+	// ETag to the hash when the sizes at least agree.
+	if obj.ETag != "" && obj.SHA256 == "" && obj.Size == result.BytesScanned {
+		if err := c.backend.Set(ctx, etagKey(obj), result.SHA256); err != nil {
+			slog.WarnContext(ctx, "Failed to cache object ETag", "error", err)
+		}
+	}
+}
+
+// invalidate drops every entry when the signature database version changed.
+// Entries are keyed by version anyway; purging just frees the space they take.
+func (c *Cache) invalidate(ctx context.Context, database string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.database == database {
+		return
+	}
+	if c.database != "" {
+		slog.InfoContext(ctx, "Signature database changed, invalidating scan cache", "previous", c.database, "database", database)
+		if err := c.backend.Purge(ctx); err != nil {
+			slog.WarnContext(ctx, "Failed to purge scan cache", "error", err)
+		}
+	}
+	c.database = database
+}
+
+// Close releases the backend.
+func (c *Cache) Close() error {
+	return c.backend.Close()
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"clamav-wrapper/clamav"
+	"clamav-wrapper/config"
+	"clamav-wrapper/policy"
+	"clamav-wrapper/storage"
+)
+
+const testSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func newMemoryCache(t *testing.T, trustETag bool) *Cache {
+	t.Helper()
+	c, err := New(config.ScanCacheConfig{Type: "memory", Size: 100, TTL: time.Hour, TrustETag: trustETag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// scanned returns the result of scanning obj, whose content hashes to
+// testSHA256, with the given signature database.
+func scanned(obj storage.ObjectInfo, verdict clamav.Verdict, database string) *clamav.ScanResult {
+	result := &clamav.ScanResult{
+		Verdict:      verdict,
+		BytesScanned: obj.Size,
+		SHA256:       testSHA256,
+		Version:      &clamav.VersionInfo{Engine: "1.0.0", Database: database},
+	}
+	if verdict == clamav.VerdictInfected {
+		result.Signature = "Eicar-Test-Signature"
+	}
+	return result
+}
+
+func TestLookup(t *testing.T) {
+	ctx := context.Background()
+	c := newMemoryCache(t, false)
+	obj := storage.ObjectInfo{Key: "a.txt", Size: 5, SHA256: testSHA256}
+
+	if _, _, ok := c.Lookup(ctx, obj, "27000"); ok {
+		t.Fatal("hit in an empty cache")
+	}
+	scannedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	content := &policy.Content{MIME: "text/plain"}
+	c.Store(ctx, obj, scanned(obj, clamav.VerdictInfected, "27000"), content, scannedAt)
+
+	// Any object with the same content hits, whatever its key.
+	entry, sha256, ok := c.Lookup(ctx, storage.ObjectInfo{Key: "b.txt", Size: 5, SHA256: testSHA256}, "27000")
+	if !ok {
+		t.Fatal("miss after Store")
+	}
+	if sha256 != testSHA256 || entry.Verdict != clamav.VerdictInfected || entry.Signature != "Eicar-Test-Signature" ||
+		entry.Database != "27000" || !entry.ScannedAt.Equal(scannedAt) || entry.Content == nil || *entry.Content != *content {
+		t.Errorf("Lookup() = %+v, %s", entry, sha256)
+	}
+	result := entry.Result(sha256, obj.Size)
+	if !result.Cached || result.Verdict != clamav.VerdictInfected || result.Version.Database != "27000" || result.BytesScanned != obj.Size {
+		t.Errorf("Result() = %+v", result)
+	}
+
+	if _, _, ok := c.Lookup(ctx, storage.ObjectInfo{Key: "c.txt", Size: 5, SHA256: "other"}, "27000"); ok {
+		t.Error("hit for other content")
+	}
+}
+
+// Verdicts obtained with other signatures no longer apply.
+func TestLookupDatabaseChanged(t *testing.T) {
+	ctx := context.Background()
+	c := newMemoryCache(t, false)
+	obj := storage.ObjectInfo{Key: "a.txt", Size: 5, SHA256: testSHA256}
+
+	c.Lookup(ctx, obj, "27000")
+	c.Store(ctx, obj, scanned(obj, clamav.VerdictClean, "27000"), nil, time.Now())
+	if _, _, ok := c.Lookup(ctx, obj, "27001"); ok {
+		t.Error("hit after the database version changed")
+	}
+	// The entries of the previous version were purged on the change.
+	if _, _, ok := c.Lookup(ctx, obj, "27000"); ok {
+		t.Error("hit for the previous database version")
+	}
+}
+
+// Objects without a stored SHA-256 are only recognised by their ETag and size
+// when TrustETag is set.
+func TestLookupETag(t *testing.T) {
+	ctx := context.Background()
+	obj := storage.ObjectInfo{Key: "a.txt", Size: 5, ETag: "5d41402abc4b2a76b9719d911017c592"}
+
+	tests := []struct {
+		name      string
+		trustETag bool
+		lookup    storage.ObjectInfo
+		want      bool
+	}{
+		{name: "trusted", trustETag: true, lookup: obj, want: true},
+		{name: "not trusted", trustETag: false, lookup: obj},
+		{name: "same ETag, other size", trustETag: true, lookup: storage.ObjectInfo{Key: "a.txt", Size: 6, ETag: obj.ETag}},
+		{name: "other ETag", trustETag: true, lookup: storage.ObjectInfo{Key: "a.txt", Size: 5, ETag: "other"}},
+		{name: "no ETag", trustETag: true, lookup: storage.ObjectInfo{Key: "a.txt", Size: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMemoryCache(t, tt.trustETag)
+			c.Store(ctx, obj, scanned(obj, clamav.VerdictClean, "27000"), nil, time.Now())
+			_, sha256, ok := c.Lookup(ctx, tt.lookup, "27000")
+			if ok != tt.want {
+				t.Fatalf("hit: %v, want %v", ok, tt.want)
+			}
+			if ok && sha256 != testSHA256 {
+				t.Errorf("found by %s, want %s", sha256, testSHA256)
+			}
+		})
+	}
+
+	// An object replaced between stat and download has the ETag of one content
+	// and the hash of another: the ETag is not mapped.
+	c := newMemoryCache(t, true)
+	result := scanned(obj, clamav.VerdictClean, "27000")
+	result.BytesScanned = 7
+	c.Store(ctx, obj, result, nil, time.Now())
+	if _, _, ok := c.Lookup(ctx, obj, "27000"); ok {
+		t.Error("ETag mapped although the scanned content had another size")
+	}
+}
+
+func TestStoreSkips(t *testing.T) {
+	ctx := context.Background()
+	obj := storage.ObjectInfo{Key: "a.txt", Size: 5, SHA256: testSHA256}
+
+	for name, modify := range map[string]func(*clamav.ScanResult){
+		"error":       func(r *clamav.ScanResult) { r.Verdict = clamav.VerdictError },
+		"cached":      func(r *clamav.ScanResult) { r.Cached = true },
+		"no hash":     func(r *clamav.ScanResult) { r.SHA256 = "" },
+		"no version":  func(r *clamav.ScanResult) { r.Version = nil },
+		"no database": func(r *clamav.ScanResult) { r.Version.Database = "" },
+	} {
+		c := newMemoryCache(t, false)
+		result := scanned(obj, clamav.VerdictClean, "27000")
+		modify(result)
+		c.Store(ctx, obj, result, nil, time.Now())
+		if _, _, ok := c.Lookup(ctx, obj, "27000"); ok {
+			t.Errorf("%s: result cached", name)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// MemoryBackend keeps entries in a size-bounded LRU local to the process.
+type MemoryBackend struct {
+	lru *expirable.LRU[string, string]
+}
+
+// NewMemoryBackend creates an LRU of at most size entries, each expiring ttl
+// after it was stored (never if ttl is 0).
+func NewMemoryBackend(size int, ttl time.Duration) (*MemoryBackend, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("scan cache size must be positive, got %d", size)
+	}
+	return &MemoryBackend{lru: expirable.NewLRU[string, string](size, nil, ttl)}, nil
+}
+
+func (b *MemoryBackend) Get(ctx context.Context, key string) (string, bool, error) {
+	value, ok := b.lru.Get(key)
+	return value, ok, nil
+}
+
+func (b *MemoryBackend) Set(ctx context.Context, key, value string) error {
+	b.lru.Add(key, value)
+	return nil
+}
+
+func (b *MemoryBackend) Purge(ctx context.Context) error {
+	b.lru.Purge()
+	return nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/messaging"
+)
+
+// RedisBackend shares entries between instances through Redis. Keys are
+// prefixed and expire after the configured TTL.
+type RedisBackend struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedisBackend creates a backend on the server of cfg.
+func NewRedisBackend(cfg config.RedisConfig, prefix string, ttl time.Duration) (*RedisBackend, error) {
+	client, err := messaging.NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisBackend{client: client, prefix: prefix, ttl: ttl}, nil
+}
+
+func (b *RedisBackend) Get(ctx context.Context, key string) (string, bool, error) {
+	value, err := b.client.Get(ctx, b.prefix+key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (b *RedisBackend) Set(ctx context.Context, key, value string) error {
+	return b.client.Set(ctx, b.prefix+key, value, b.ttl).Err()
+}
+
+// Purge does nothing: verdict keys include the database version, so entries of
+// an older version are never read again and expire with their TTL. Other
+// instances may still be on the older version during a rolling update.
+func (b *RedisBackend) Purge(ctx context.Context) error {
+	return nil
+}
+
+func (b *RedisBackend) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,133 @@
+// Package clamavtest provides a fake clamd for testing the packages that scan
+// through the clamav package.
+package clamavtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// EICAR is the standard antivirus test file, which Clamd reports infected.
+const EICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// Clamd answers the clamd commands the clamav package sends, on a local TCP
+// port. Streams containing "EICAR", or the pattern set, are reported
+// infected, all others clean.
+type Clamd struct {
+	ln        net.Listener
+	Database  atomic.Value // Signature database version reported by VERSION
+	Scans     atomic.Int32 // INSTREAM commands received
+	StreamMax atomic.Int64 // Longer streams get the size limit reply, like clamd's StreamMaxLength; 0 for no limit
+	OnScan    atomic.Value // func() called before a stream is answered, if set
+	Pattern   atomic.Value // Further content reported infected, like a signature update, if set
+}
+
+// Start runs a fake clamd until the end of the test.
+func Start(t *testing.T) *Clamd {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Clamd{ln: ln}
+	f.Database.Store("27000")
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+// Addr returns the host:port the fake clamd listens on.
+func (f *Clamd) Addr() string {
+	return f.ln.Addr().String()
+}
+
+// Endpoint returns the CLAMAV_ENDPOINTS entry of the fake clamd.
+func (f *Clamd) Endpoint() string {
+	return "tcp://" + f.Addr()
+}
+
+func (f *Clamd) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	session, id := false, 0
+	for {
+		cmd, err := r.ReadString(0)
+		if err != nil {
+			return
+		}
+		cmd = strings.TrimSuffix(strings.TrimPrefix(cmd, "z"), "\x00")
+
+		var reply string
+		switch cmd {
+		case "IDSESSION":
+			session = true
+			continue
+		case "END":
+			return
+		case "PING":
+			reply = "PONG"
+		case "VERSION":
+			reply = fmt.Sprintf("ClamAV 1.0.0/%s/Mon Jan  1 00:00:00 2024", f.Database.Load())
+		case "INSTREAM":
+			data, err := readStream(r)
+			if err != nil {
+				return
+			}
+			f.Scans.Add(1)
+			if fn, ok := f.OnScan.Load().(func()); ok {
+				fn()
+			}
+			reply = "stream: OK"
+			if pattern, _ := f.Pattern.Load().(string); bytes.Contains(data, []byte("EICAR")) || pattern != "" && bytes.Contains(data, []byte(pattern)) {
+				reply = "stream: Eicar-Test-Signature FOUND"
+			}
+			if max := f.StreamMax.Load(); max > 0 && int64(len(data)) > max {
+				reply = "INSTREAM size limit exceeded. ERROR"
+			}
+		default:
+			reply = "UNKNOWN COMMAND"
+		}
+
+		if session {
+			id++
+			reply = fmt.Sprintf("%d: %s", id, reply)
+		}
+		if _, err := io.WriteString(conn, reply+"\x00"); err != nil || !session {
+			return
+		}
+	}
+}
+
+// readStream reads the length-prefixed chunks of an INSTREAM body.
+func readStream(r io.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
@@ -0,0 +1,181 @@
+package clamav
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Client talks to a single clamd daemon over TCP or a unix socket.
+// Every call outside of a Session opens its own connection, which clamd closes
+// once it has replied.
+type Client struct {
+	Network     string // "tcp" or "unix"
+	Address     string // host:port for tcp, socket path for unix
+	DialTimeout time.Duration
+	ChunkSize   int // Size in bytes of each INSTREAM chunk
+}
+
+// NewClient creates a Client for the clamd daemon listening on network/address.
+func NewClient(network, address string, dialTimeout time.Duration, chunkSize int) *Client {
+	if chunkSize <= 0 {
+		chunkSize = 32 * 1024
+	}
+	return &Client{
+		Network:     network,
+		Address:     address,
+		DialTimeout: dialTimeout,
+		ChunkSize:   chunkSize,
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ClamAV at %s://%s: %w", c.Network, c.Address, err)
+	}
+	return conn, nil
+}
+
+// command sends a single command on a fresh connection and returns the reply.
+func (c *Client) command(cmd string) (string, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err := writeCommand(conn, cmd); err != nil {
+		return "", fmt.Errorf("failed to send %s command: %w", cmd, err)
+	}
+	return readReply(bufio.NewReader(conn))
+}
+
+// Ping checks that clamd is alive and answering commands.
+func (c *Client) Ping() error {
+	reply, err := c.command("PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected PING response: %q", reply)
+	}
+	return nil
+}
+
+// Version returns the engine and signature database version reported by clamd.
+func (c *Client) Version() (*VersionInfo, error) {
+	reply, err := c.command("VERSION")
+	if err != nil {
+		return nil, err
+	}
+	return parseVersion(reply)
+}
+
+// Stats returns the raw output of the STATS command (thread pool and queue state).
+func (c *Client) Stats() (string, error) {
+	return c.command("STATS")
+}
+
+// Reload asks clamd to reload its signature databases.
+func (c *Client) Reload() error {
+	reply, err := c.command("RELOAD")
+	if err != nil {
+		return err
+	}
+	if reply != "RELOADING" {
+		return fmt.Errorf("unexpected RELOAD response: %q", reply)
+	}
+	return nil
+}
+
+// Scan streams r to clamd with INSTREAM and returns the parsed verdict.
+// An error is returned alongside a VerdictError result when clamd replies
+// with ERROR or something unrecognised.
+func (c *Client) Scan(r io.Reader) (*ScanResult, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := writeCommand(conn, "INSTREAM"); err != nil {
+		return nil, fmt.Errorf("failed to send INSTREAM command: %w", err)
+	}
+
+	n, err := writeStream(conn, r, c.ChunkSize)
+	if err != nil {
+		var werr *connWriteError
+		if !errors.As(err, &werr) {
+			return nil, err
+		}
+		// clamd may have explained why it closed the connection (StreamMaxLength).
+		conn.SetReadDeadline(time.Now().Add(replyGrace))
+		reply, rerr := readReply(bufio.NewReader(conn))
+		if rerr != nil {
+			return nil, err
+		}
+		return newScanResult(reply, n, time.Since(start))
+	}
+
+	reply, err := readReply(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	return newScanResult(reply, n, time.Since(start))
+}
+
+// NewSession opens a connection and starts an IDSESSION on it, so several
+// commands can be sent without reconnecting.
+func (c *Client) NewSession() (*Session, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSession(conn, c.ChunkSize)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newScanResult(reply string, n int64, d time.Duration) (*ScanResult, error) {
+	verdict, sig, err := parseScanReply(reply)
+	return &ScanResult{
+		Verdict:      verdict,
+		Signature:    sig,
+		Raw:          reply,
+		BytesScanned: n,
+		Duration:     d,
+	}, err
+}
+
+// VersionInfo is the parsed reply of the VERSION command, which looks like
+// "ClamAV 1.0.1/26800/Mon Jan  1 08:00:00 2024".
+type VersionInfo struct {
+	Raw          string
+	Engine       string // e.g. "ClamAV 1.0.1"
+	Database     string // Signature database version, e.g. "26800"
+	DatabaseDate string // Build date of the signature database
+}
+
+func parseVersion(reply string) (*VersionInfo, error) {
+	parts := strings.SplitN(reply, "/", 3)
+	if len(parts) == 0 || !strings.HasPrefix(parts[0], "ClamAV ") {
+		return nil, fmt.Errorf("unexpected VERSION response: %q", reply)
+	}
+	info := &VersionInfo{Raw: reply, Engine: parts[0]}
+	if len(parts) > 1 {
+		info.Database = parts[1]
+	}
+	if len(parts) > 2 {
+		info.DatabaseDate = parts[2]
+	}
+	return info, nil
+}
@@ -0,0 +1,53 @@
+package clamav
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    VersionInfo
+		wantErr bool
+	}{
+		{
+			reply: "ClamAV 1.0.1/26800/Mon Jan  1 08:00:00 2024",
+			want:  VersionInfo{Engine: "ClamAV 1.0.1", Database: "26800", DatabaseDate: "Mon Jan  1 08:00:00 2024"},
+		},
+		{
+			// Without signatures loaded, clamd only reports the engine.
+			reply: "ClamAV 0.103.8",
+			want:  VersionInfo{Engine: "ClamAV 0.103.8"},
+		},
+		{
+			reply: "ClamAV 1.2.0/27100",
+			want:  VersionInfo{Engine: "ClamAV 1.2.0", Database: "27100"},
+		},
+		{
+			// The date is not split any further.
+			reply: "ClamAV 1.0.1/26800/Mon Jan  1 08:00:00 2024/extra",
+			want:  VersionInfo{Engine: "ClamAV 1.0.1", Database: "26800", DatabaseDate: "Mon Jan  1 08:00:00 2024/extra"},
+		},
+		{reply: "", wantErr: true},
+		{reply: "ClamAV", wantErr: true},
+		{reply: "clamav 1.0.1/26800", wantErr: true},
+		{reply: "UNKNOWN COMMAND", wantErr: true},
+		{reply: "1: ClamAV 1.0.1/26800", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reply, func(t *testing.T) {
+			got, err := parseVersion(tt.reply)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Raw = tt.reply
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
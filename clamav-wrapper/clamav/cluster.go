@@ -0,0 +1,399 @@
+package clamav
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects which clamd backend receives the next scan.
+type Strategy string
+
+const (
+	// StrategyRoundRobin cycles through healthy backends in order.
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyLeastOutstanding picks the healthy backend with the fewest scans in progress.
+	StrategyLeastOutstanding Strategy = "least-outstanding"
+)
+
+// Endpoint is the address of a single clamd daemon.
+type Endpoint struct {
+	Network string // "tcp" or "unix"
+	Address string
+}
+
+func (e Endpoint) String() string {
+	return e.Network + "://" + e.Address
+}
+
+// ParseEndpoint accepts "tcp://host:port", "unix:///path/to/clamd.sock",
+// a bare "host:port" (tcp) or a bare absolute socket path (unix).
+func ParseEndpoint(s string) (Endpoint, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "tcp://"):
+		s = strings.TrimPrefix(s, "tcp://")
+	case strings.HasPrefix(s, "unix://"):
+		return Endpoint{Network: "unix", Address: strings.TrimPrefix(s, "unix://")}, nil
+	case strings.HasPrefix(s, "/"):
+		return Endpoint{Network: "unix", Address: s}, nil
+	}
+
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return Endpoint{}, fmt.Errorf("invalid clamd endpoint %q: %w", s, err)
+	}
+	return Endpoint{Network: "tcp", Address: s}, nil
+}
+
+// ClusterConfig describes a set of clamd daemons and how to use them.
+type ClusterConfig struct {
+	Endpoints           []Endpoint
+	Strategy            Strategy
+	DialTimeout         time.Duration
+	ChunkSize           int
+	Pool                PoolConfig    // Applied to each backend
+	HealthCheckInterval time.Duration // How often every backend is PINGed on a fresh connection
+}
+
+type backend struct {
+	endpoint    Endpoint
+	client      *Client
+	pool        *Pool
+	healthy     atomic.Bool
+	outstanding atomic.Int64
+	version     atomic.Pointer[VersionInfo] // last VERSION reply, refreshed by the health checker
+	fetching    atomic.Bool                 // a VERSION command is under way
+}
+
+// Cluster spreads scans across several clamd daemons. Backends that fail a
+// connection or a periodic PING are marked unhealthy and skipped until they
+// answer again, and a scan that fails on one backend is retried on the next.
+type Cluster struct {
+	backends []*backend
+	strategy Strategy
+	next     atomic.Uint64
+	latest   atomic.Pointer[VersionInfo] // newest signature database any backend reported
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewCluster creates a pooled backend for every endpoint and starts the
+// background health checker.
+func NewCluster(cfg ClusterConfig) (*Cluster, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("at least one clamd endpoint is required")
+	}
+	switch cfg.Strategy {
+	case "":
+		cfg.Strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyLeastOutstanding:
+	default:
+		return nil, fmt.Errorf("unsupported clamd balancing strategy: %s", cfg.Strategy)
+	}
+
+	c := &Cluster{strategy: cfg.Strategy, stop: make(chan struct{})}
+	for _, ep := range cfg.Endpoints {
+		client := NewClient(ep.Network, ep.Address, cfg.DialTimeout, cfg.ChunkSize)
+		b := &backend{endpoint: ep, client: client, pool: NewPool(client, cfg.Pool)}
+		b.healthy.Store(true)
+		c.backends = append(c.backends, b)
+		c.fetchVersion(b)
+	}
+
+	if cfg.HealthCheckInterval > 0 {
+		c.wg.Add(1)
+		go c.healthLoop(cfg.HealthCheckInterval)
+	}
+	return c, nil
+}
+
+// candidates returns the backends to try, in order: healthy ones as chosen by
+// the strategy first, then unhealthy ones as a last resort.
+func (c *Cluster) candidates() []*backend {
+	n := len(c.backends)
+	start := int(c.next.Add(1)-1) % n
+
+	var healthy, unhealthy []*backend
+	for i := 0; i < n; i++ {
+		b := c.backends[(start+i)%n]
+		if b.healthy.Load() {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+
+	if c.strategy == StrategyLeastOutstanding && len(healthy) > 1 {
+		best := 0
+		for i, b := range healthy {
+			if b.outstanding.Load() < healthy[best].outstanding.Load() {
+				best = i
+			}
+		}
+		healthy[0], healthy[best] = healthy[best], healthy[0]
+	}
+	return append(healthy, unhealthy...)
+}
+
+// Scan streams r to one of the backends. When a backend cannot be reached or
+// drops the connection, the scan fails over to the next backend as long as
+// the stream can be replayed: either nothing has been read from r yet or r
+// implements io.Seeker.
+func (c *Cluster) Scan(r io.Reader) (*ScanResult, error) {
+	cr := &countingReader{r: r, hash: sha256.New()}
+	var lastErr error
+
+	for _, b := range c.candidates() {
+		if cr.n > 0 {
+			seeker, ok := r.(io.Seeker)
+			if !ok {
+				break
+			}
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("failed to rewind stream for failover: %w (after %v)", err, lastErr)
+			}
+			cr.n = 0
+			cr.hash.Reset()
+			cr.eof = false
+		}
+
+		b.outstanding.Add(1)
+		result, err := b.pool.Scan(cr)
+		b.outstanding.Add(-1)
+
+		if result != nil {
+			// clamd answered, even if with an error reply: no failover.
+			result.Endpoint = b.endpoint.String()
+			result.Version = c.versionInfo(b)
+			if cr.eof {
+				result.SHA256 = hex.EncodeToString(cr.hash.Sum(nil))
+			}
+			return result, err
+		}
+
+		if cr.err != nil {
+			// Reading the stream failed (e.g. the client uploading it went away):
+			// not the backend's fault, and nothing to fail over with.
+			return nil, err
+		}
+		lastErr = fmt.Errorf("%s: %w", b.endpoint, err)
+		if b.healthy.Swap(false) {
+			slog.Warn("Marking clamd backend unhealthy", "endpoint", b.endpoint.String(), "error", err)
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no clamd backend available")
+	}
+	return nil, lastErr
+}
+
+// Ping succeeds when at least one backend answers PING.
+func (c *Cluster) Ping() error {
+	var errs []error
+	for _, b := range c.candidates() {
+		err := b.client.Ping()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", b.endpoint, err))
+	}
+	return errors.Join(errs...)
+}
+
+// Version returns the VERSION reply of the first backend that answers.
+func (c *Cluster) Version() (*VersionInfo, error) {
+	var errs []error
+	for _, b := range c.candidates() {
+		v, err := b.pool.Version()
+		if err == nil {
+			return v, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", b.endpoint, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// versionInfo returns the backend's last known engine and database version
+// without waiting for clamd: if none is known yet, it is fetched in the
+// background and nil is returned.
+func (c *Cluster) versionInfo(b *backend) *VersionInfo {
+	v := b.version.Load()
+	if v == nil {
+		c.fetchVersion(b)
+	}
+	return v
+}
+
+// fetchVersion refreshes the version of b in the background, unless that is
+// under way already.
+func (c *Cluster) fetchVersion(b *backend) {
+	if !b.fetching.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer b.fetching.Store(false)
+		c.refreshVersion(b)
+	}()
+}
+
+// refreshVersion asks b for its version with the VERSION command, and raises
+// the newest version of the cluster if its database is newer. It returns the
+// last version known of b if clamd did not answer.
+func (c *Cluster) refreshVersion(b *backend) *VersionInfo {
+	v, err := b.client.Version()
+	if err != nil {
+		return b.version.Load()
+	}
+	b.version.Store(v)
+	for {
+		latest := c.latest.Load()
+		if latest != nil && !newerDatabase(v.Database, latest.Database) {
+			return v
+		}
+		if c.latest.CompareAndSwap(latest, v) {
+			return v
+		}
+	}
+}
+
+// LatestVersion returns the version with the newest signature database any
+// backend reported, or nil if none did yet. It does not go back when that
+// backend becomes unhealthy: its signatures are still the newest known, and
+// verdicts cached or files rescanned with them remain valid.
+func (c *Cluster) LatestVersion() *VersionInfo {
+	return c.latest.Load()
+}
+
+// RefreshVersion asks every healthy backend for its version with the VERSION
+// command, rather than waiting for the health checks, and returns the newest
+// as LatestVersion does.
+func (c *Cluster) RefreshVersion() *VersionInfo {
+	for _, b := range c.backends {
+		if b.healthy.Load() {
+			c.refreshVersion(b)
+		}
+	}
+	return c.LatestVersion()
+}
+
+// newerDatabase reports whether signature database version a is newer than b.
+// Versions are numbers; anything else is compared as a string.
+func newerDatabase(a, b string) bool {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	if errA != nil || errB != nil {
+		return a > b
+	}
+	return na > nb
+}
+
+// Stats returns the STATS output of every backend, keyed by endpoint.
+func (c *Cluster) Stats() (map[string]string, error) {
+	stats := make(map[string]string, len(c.backends))
+	var errs []error
+	for _, b := range c.backends {
+		s, err := b.pool.Stats()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.endpoint, err))
+			continue
+		}
+		stats[b.endpoint.String()] = s
+	}
+	return stats, errors.Join(errs...)
+}
+
+// Reload asks every backend to reload its signature databases.
+func (c *Cluster) Reload() error {
+	var errs []error
+	for _, b := range c.backends {
+		if err := b.pool.Reload(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.endpoint, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Cluster) healthLoop(interval time.Duration) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.checkBackends()
+		}
+	}
+}
+
+// checkBackends PINGs every backend on a fresh connection, so a daemon that
+// restarted is noticed even when all its pooled sessions are busy, and
+// refreshes the version of healthy ones to pick up signature updates.
+func (c *Cluster) checkBackends() {
+	for _, b := range c.backends {
+		err := b.client.Ping()
+		if err == nil {
+			c.refreshVersion(b)
+		}
+		switch {
+		case err != nil && b.healthy.Swap(false):
+			slog.Warn("Marking clamd backend unhealthy", "endpoint", b.endpoint.String(), "error", err)
+		case err == nil && !b.healthy.Swap(true):
+			slog.Info("clamd backend is healthy again", "endpoint", b.endpoint.String())
+		}
+	}
+}
+
+// Close stops the health checker and closes every backend pool.
+func (c *Cluster) Close() error {
+	var errs []error
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		c.wg.Wait()
+		for _, b := range c.backends {
+			if err := b.pool.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", b.endpoint, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// countingReader records how many bytes have been read, so Scan knows whether
+// a failed attempt consumed part of the stream, and hashes them so the file's
+// SHA-256 is known without reading it twice.
+type countingReader struct {
+	r    io.Reader
+	n    int64
+	hash hash.Hash
+	eof  bool  // the whole stream was read, so hash covers the entire file
+	err  error // error returned by r other than io.EOF
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	cr.hash.Write(p[:n])
+	if err == io.EOF {
+		cr.eof = true
+	} else if err != nil {
+		cr.err = err
+	}
+	return n, err
+}
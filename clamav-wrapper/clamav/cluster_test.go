@@ -0,0 +1,180 @@
+package clamav
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// versionServer answers PING and VERSION like clamd, reporting database, and
+// holds VERSION replies while hold is set.
+type versionServer struct {
+	ln       net.Listener
+	database atomic.Value
+	hold     atomic.Bool
+}
+
+func startVersionServer(t *testing.T, database string) *versionServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &versionServer{ln: ln}
+	s.database.Store(database)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *versionServer) serve(conn net.Conn) {
+	defer conn.Close()
+	cmd, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return
+	}
+	switch strings.TrimSuffix(strings.TrimPrefix(cmd, "z"), "\x00") {
+	case "PING":
+		conn.Write([]byte("PONG\x00"))
+	case "VERSION":
+		for s.hold.Load() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn.Write([]byte("ClamAV 1.4.1/" + s.database.Load().(string) + "/Thu Oct 16 08:00:00 2026\x00"))
+	}
+}
+
+func (s *versionServer) endpoint() Endpoint {
+	return Endpoint{Network: "tcp", Address: s.ln.Addr().String()}
+}
+
+func newTestCluster(t *testing.T, servers ...*versionServer) *Cluster {
+	t.Helper()
+	cfg := ClusterConfig{DialTimeout: time.Second, ChunkSize: 1024}
+	for _, s := range servers {
+		cfg.Endpoints = append(cfg.Endpoints, s.endpoint())
+	}
+	c, err := NewCluster(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Endpoint
+		wantErr bool
+	}{
+		{in: "tcp://clamd:3310", want: Endpoint{Network: "tcp", Address: "clamd:3310"}},
+		{in: "clamd:3310", want: Endpoint{Network: "tcp", Address: "clamd:3310"}},
+		{in: "  10.0.0.1:3310 ", want: Endpoint{Network: "tcp", Address: "10.0.0.1:3310"}},
+		{in: "tcp://[::1]:3310", want: Endpoint{Network: "tcp", Address: "[::1]:3310"}},
+		{in: "unix:///run/clamav/clamd.sock", want: Endpoint{Network: "unix", Address: "/run/clamav/clamd.sock"}},
+		{in: "/run/clamav/clamd.sock", want: Endpoint{Network: "unix", Address: "/run/clamav/clamd.sock"}},
+		{in: "clamd", wantErr: true},
+		{in: "tcp://clamd", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseEndpoint(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The newest database seen is kept when the backend that reported it becomes
+// unhealthy.
+func TestClusterLatestVersion(t *testing.T) {
+	older, newer := startVersionServer(t, "26800"), startVersionServer(t, "26801")
+	c := newTestCluster(t, older, newer)
+
+	if v := c.RefreshVersion(); v == nil || v.Database != "26801" {
+		t.Fatalf("RefreshVersion() = %v, want database 26801", v)
+	}
+	newer.ln.Close()
+	c.checkBackends()
+	if c.backends[1].healthy.Load() {
+		t.Fatal("stopped backend still healthy")
+	}
+	if v := c.LatestVersion(); v == nil || v.Database != "26801" {
+		t.Errorf("LatestVersion() = %v after the newest backend stopped, want database 26801", v)
+	}
+
+	older.database.Store("26802")
+	c.checkBackends()
+	if v := c.LatestVersion(); v == nil || v.Database != "26802" {
+		t.Errorf("LatestVersion() = %v after a signature update, want database 26802", v)
+	}
+}
+
+// Looking up the version of a backend for a scan result never waits for clamd.
+func TestClusterVersionInfoAsync(t *testing.T) {
+	s := startVersionServer(t, "26800")
+	s.hold.Store(true)
+	c := newTestCluster(t, s)
+	b := c.backends[0]
+
+	start := time.Now()
+	if v := c.versionInfo(b); v != nil {
+		t.Errorf("versionInfo() = %v before clamd answered, want nil", v)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("versionInfo() waited %v for clamd", elapsed)
+	}
+
+	s.hold.Store(false)
+	deadline := time.Now().Add(time.Second)
+	for c.versionInfo(b) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("version not fetched in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := c.LatestVersion(); v == nil || v.Database != "26800" {
+		t.Errorf("LatestVersion() = %v, want database 26800", v)
+	}
+}
+
+func TestNewerDatabase(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"26801", "26800", true},
+		{"26800", "26801", false},
+		{"26800", "26800", false},
+		{"100000", "99999", true}, // Compared as numbers, not strings
+		{"b", "a", true},
+	}
+	for _, tt := range tests {
+		if got := newerDatabase(tt.a, tt.b); got != tt.want {
+			t.Errorf("newerDatabase(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
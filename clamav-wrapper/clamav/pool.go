@@ -0,0 +1,270 @@
+package clamav
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// PoolConfig controls how many IDSESSION connections a Pool keeps open.
+type PoolConfig struct {
+	Size                int           // Maximum number of open sessions
+	MaxInFlight         int           // Commands multiplexed on one session before another is opened
+	IdleTimeout         time.Duration // Sessions unused for longer are ended; keep below clamd's IdleTimeout
+	HealthCheckInterval time.Duration // How often idle sessions are PINGed
+}
+
+// Pool keeps IDSESSION connections to a single clamd open and reuses them
+// across scans. Idle sessions are health-checked with PING in the background
+// and sessions that fail a check or a command are evicted.
+type Pool struct {
+	client *Client
+	cfg    PoolConfig
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	sessions []*Session
+	reserved map[*Session]int // callers currently using each session
+	dialing  int              // sessions being opened, counted against Size
+	closed   bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPool creates a pool of sessions opened with client and starts its
+// background health checker.
+func NewPool(client *Client, cfg PoolConfig) *Pool {
+	if cfg.Size <= 0 {
+		cfg.Size = 1
+	}
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = 1
+	}
+	p := &Pool{
+		client:   client,
+		cfg:      cfg,
+		reserved: make(map[*Session]int),
+		stop:     make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	if cfg.HealthCheckInterval > 0 {
+		p.wg.Add(1)
+		go p.healthLoop()
+	}
+	return p
+}
+
+// acquire returns the least busy session that still has capacity, opening a
+// new one when all are at MaxInFlight and the pool is not full. It blocks
+// when the pool is saturated.
+func (p *Pool) acquire() (*Session, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errors.New("clamd connection pool is closed")
+		}
+
+		var best *Session
+		bestLoad := p.cfg.MaxInFlight
+		for _, s := range append([]*Session(nil), p.sessions...) {
+			if s.Err() != nil {
+				// Broken while idle, e.g. clamd restarted or timed the session out.
+				if p.reserved[s] == 0 {
+					p.removeLocked(s)
+				}
+				continue
+			}
+			if load := p.reserved[s]; load < bestLoad {
+				best, bestLoad = s, load
+			}
+		}
+
+		if best != nil && (bestLoad == 0 || len(p.sessions)+p.dialing >= p.cfg.Size) {
+			p.reserved[best]++
+			p.mu.Unlock()
+			return best, nil
+		}
+
+		if len(p.sessions)+p.dialing < p.cfg.Size {
+			p.dialing++
+			p.mu.Unlock()
+
+			s, err := p.client.NewSession()
+
+			p.mu.Lock()
+			p.dialing--
+			if err != nil {
+				p.cond.Signal()
+				p.mu.Unlock()
+				return nil, err
+			}
+			p.sessions = append(p.sessions, s)
+			p.reserved[s] = 1
+			p.mu.Unlock()
+			return s, nil
+		}
+
+		p.cond.Wait()
+	}
+}
+
+// release returns a reservation taken by acquire, evicts s if it broke and
+// wakes up callers waiting for capacity.
+func (p *Pool) release(s *Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.reserved[s]--; p.reserved[s] <= 0 {
+		delete(p.reserved, s)
+	}
+	if s.Err() != nil {
+		p.removeLocked(s)
+	}
+	p.cond.Broadcast()
+}
+
+func (p *Pool) removeLocked(s *Session) {
+	for i, cur := range p.sessions {
+		if cur == s {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Scan streams r to clamd over a pooled session.
+func (p *Pool) Scan(r io.Reader) (*ScanResult, error) {
+	s, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(s)
+	return s.Scan(r)
+}
+
+// Ping checks clamd over a pooled session.
+func (p *Pool) Ping() error {
+	s, err := p.acquire()
+	if err != nil {
+		return err
+	}
+	defer p.release(s)
+	return s.Ping()
+}
+
+// Version returns the engine and database version over a pooled session.
+func (p *Pool) Version() (*VersionInfo, error) {
+	s, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(s)
+	return s.Version()
+}
+
+// Stats returns the raw STATS output over a pooled session.
+func (p *Pool) Stats() (string, error) {
+	s, err := p.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer p.release(s)
+	return s.Stats()
+}
+
+// Reload asks clamd to reload its databases. RELOAD is not allowed inside an
+// IDSESSION, so it uses a dedicated connection.
+func (p *Pool) Reload() error {
+	return p.client.Reload()
+}
+
+// healthLoop periodically PINGs idle sessions and ends those that have been
+// idle for longer than IdleTimeout.
+func (p *Pool) healthLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkIdle()
+		}
+	}
+}
+
+func (p *Pool) checkIdle() {
+	var expired, idle []*Session
+
+	p.mu.Lock()
+	for _, s := range p.sessions {
+		if p.reserved[s] > 0 {
+			continue
+		}
+		if p.cfg.IdleTimeout > 0 && time.Since(s.idleSince()) > p.cfg.IdleTimeout {
+			expired = append(expired, s)
+		} else {
+			idle = append(idle, s)
+		}
+	}
+	for _, s := range expired {
+		p.removeLocked(s)
+	}
+	p.mu.Unlock()
+
+	for _, s := range expired {
+		s.End()
+	}
+
+	var broken bool
+	for _, s := range idle {
+		if err := s.Ping(); err != nil {
+			slog.Warn("Evicting clamd session after failed PING", "address", p.client.Address, "error", err)
+			broken = true
+		}
+	}
+
+	if broken {
+		p.mu.Lock()
+		for _, s := range idle {
+			if s.Err() != nil {
+				p.removeLocked(s)
+			}
+		}
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+// Close ends every pooled session and stops the health checker.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	sessions := p.sessions
+	p.sessions = nil
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	close(p.stop)
+	p.wg.Wait()
+
+	var errs []error
+	for _, s := range sessions {
+		if err := s.End(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
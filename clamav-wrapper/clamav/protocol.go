@@ -0,0 +1,68 @@
+package clamav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// writeCommand sends a NUL-terminated ("z" prefixed) clamd command.
+func writeCommand(w io.Writer, cmd string) error {
+	_, err := fmt.Fprintf(w, "z%s\x00", cmd)
+	return err
+}
+
+// connWriteError is returned by writeStream when writing to the connection
+// failed, as opposed to reading the stream being scanned. clamd may have sent a
+// reply before closing its end, typically the StreamMaxLength error.
+type connWriteError struct {
+	err error
+}
+
+func (e *connWriteError) Error() string { return e.err.Error() }
+func (e *connWriteError) Unwrap() error { return e.err }
+
+// writeStream sends the body of an INSTREAM command: a sequence of chunks, each
+// prefixed with its length as a 4 byte big-endian integer, followed by a
+// zero-length chunk that marks the end of the stream.
+func writeStream(w io.Writer, r io.Reader, chunkSize int) (int64, error) {
+	buf := make([]byte, 4+chunkSize)
+	var total int64
+
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return total, &connWriteError{fmt.Errorf("failed to write chunk: %w", werr)}
+			}
+			total += int64(n)
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return total, fmt.Errorf("error while reading file: %w", err)
+		}
+	}
+
+	if _, err := w.Write([]byte{0, 0, 0, 0}); err != nil {
+		return total, &connWriteError{fmt.Errorf("failed to send EOF marker: %w", err)}
+	}
+	return total, nil
+}
+
+// readReply reads a single NUL-terminated reply. A connection closed by clamd
+// right after the reply (the behaviour outside of IDSESSION) is not an error.
+func readReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString(0)
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read ClamAV response: %w", err)
+	}
+	return trimReply(line), nil
+}
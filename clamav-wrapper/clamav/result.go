@@ -0,0 +1,95 @@
+package clamav
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Verdict is the outcome of a single clamd scan.
+type Verdict string
+
+const (
+	// VerdictClean means clamd replied "OK" for the stream.
+	VerdictClean Verdict = "clean"
+	// VerdictInfected means clamd replied "<signature> FOUND" for the stream.
+	VerdictInfected Verdict = "infected"
+	// VerdictError means clamd replied with an "ERROR" line or something we could not parse.
+	VerdictError Verdict = "error"
+	// VerdictUnscanned is never returned by clamd: it marks files the pipeline
+	// let through without a scan, such as files above the size limit.
+	VerdictUnscanned Verdict = "unscanned"
+	// VerdictBlocked is not returned by clamd either: it marks files clamd found
+	// clean but the content policy rejects.
+	VerdictBlocked Verdict = "blocked"
+)
+
+// streamPrefix is the pseudo file name clamd uses when reporting on INSTREAM data.
+const streamPrefix = "stream: "
+
+// ScanResult is the structured outcome of an INSTREAM scan.
+type ScanResult struct {
+	Verdict      Verdict
+	Signature    string // Name of the matched signature, only set when Verdict is VerdictInfected
+	Raw          string // Reply exactly as received from clamd, without the terminating NUL
+	BytesScanned int64
+	Duration     time.Duration
+	Endpoint     string       // clamd backend that produced the result, set by Cluster
+	SHA256       string       // Hex digest of the scanned stream, set by Cluster when it was read to the end
+	Version      *VersionInfo // Engine and signature database of the backend, set by Cluster if known
+	Cached       bool         // Verdict taken from the verdict cache instead of scanning
+}
+
+// IsClean reports whether clamd found nothing in the scanned stream.
+func (r *ScanResult) IsClean() bool {
+	return r != nil && r.Verdict == VerdictClean
+}
+
+// ReplyError is returned when clamd answers a command with an "ERROR" reply,
+// e.g. "INSTREAM size limit exceeded. ERROR".
+type ReplyError struct {
+	Message string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("clamd error: %s", e.Message)
+}
+
+// sizeLimitReply starts the reply clamd sends before closing the connection
+// when a stream exceeds its StreamMaxLength setting.
+const sizeLimitReply = "INSTREAM size limit exceeded"
+
+// Is makes clamd's size limit reply match ErrFileTooLarge.
+func (e *ReplyError) Is(target error) bool {
+	return target == ErrFileTooLarge && strings.HasPrefix(e.Message, sizeLimitReply)
+}
+
+// parseScanReply turns an INSTREAM reply into a verdict and signature name.
+// The reply must already be stripped of its NUL terminator and of any IDSESSION
+// request prefix. Only exact "stream: OK" and "stream: <sig> FOUND" replies are
+// accepted, so a signature name that happens to contain "OK" cannot be mistaken
+// for a clean result.
+func parseScanReply(reply string) (Verdict, string, error) {
+	if msg, ok := strings.CutSuffix(reply, " ERROR"); ok {
+		return VerdictError, "", &ReplyError{Message: strings.TrimSpace(msg)}
+	}
+
+	body, ok := strings.CutPrefix(reply, streamPrefix)
+	if !ok {
+		return VerdictError, "", fmt.Errorf("unexpected ClamAV response: %q", reply)
+	}
+
+	if body == "OK" {
+		return VerdictClean, "", nil
+	}
+	if sig, ok := strings.CutSuffix(body, " FOUND"); ok && sig != "" {
+		return VerdictInfected, sig, nil
+	}
+
+	return VerdictError, "", fmt.Errorf("unexpected ClamAV response: %q", reply)
+}
+
+// trimReply removes the NUL/newline terminator clamd appends to every reply.
+func trimReply(reply string) string {
+	return strings.TrimRight(reply, "\x00\n")
+}
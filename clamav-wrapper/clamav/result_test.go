@@ -0,0 +1,77 @@
+package clamav
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseScanReply(t *testing.T) {
+	tests := []struct {
+		reply     string
+		verdict   Verdict
+		signature string
+		wantErr   error // nil: no error; errAny: any error
+	}{
+		{reply: "stream: OK", verdict: VerdictClean},
+		{reply: "stream: Eicar-Test-Signature FOUND", verdict: VerdictInfected, signature: "Eicar-Test-Signature"},
+		// Signature names containing "OK" or "FOUND" must not confuse the parser.
+		{reply: "stream: Win.Test.OK-1 FOUND", verdict: VerdictInfected, signature: "Win.Test.OK-1"},
+		{reply: "stream: OK FOUND", verdict: VerdictInfected, signature: "OK"},
+		{reply: "stream: Doc.FOUND.Macro FOUND", verdict: VerdictInfected, signature: "Doc.FOUND.Macro"},
+		{reply: "stream: Heuristics.Encrypted.Zip FOUND", verdict: VerdictInfected, signature: "Heuristics.Encrypted.Zip"},
+		// Errors, among them the size limit reply.
+		{reply: "INSTREAM size limit exceeded. ERROR", verdict: VerdictError, wantErr: ErrFileTooLarge},
+		{reply: "stream: Can't allocate memory ERROR", verdict: VerdictError, wantErr: errAny},
+		{reply: "stream: OK ERROR", verdict: VerdictError, wantErr: errAny},
+		// Replies that are neither.
+		{reply: "stream: FOUND", verdict: VerdictError, wantErr: errAny},
+		{reply: "stream: OKAY", verdict: VerdictError, wantErr: errAny},
+		{reply: "stream: ok", verdict: VerdictError, wantErr: errAny},
+		{reply: "OK", verdict: VerdictError, wantErr: errAny},
+		{reply: "file: OK", verdict: VerdictError, wantErr: errAny},
+		{reply: "UNKNOWN COMMAND", verdict: VerdictError, wantErr: errAny},
+		{reply: "", verdict: VerdictError, wantErr: errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reply, func(t *testing.T) {
+			verdict, signature, err := parseScanReply(tt.reply)
+			if verdict != tt.verdict || signature != tt.signature {
+				t.Errorf("got %s %q, want %s %q", verdict, signature, tt.verdict, tt.signature)
+			}
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != nil && err == nil:
+				t.Error("expected an error")
+			case tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Errorf("error %v is not %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// errAny stands for any error in test tables.
+var errAny = errors.New("any error")
+
+func TestSizeLimitReplyError(t *testing.T) {
+	if !errors.Is(&ReplyError{Message: "INSTREAM size limit exceeded."}, ErrFileTooLarge) {
+		t.Error("size limit reply does not match ErrFileTooLarge")
+	}
+	if errors.Is(&ReplyError{Message: "Can't allocate memory"}, ErrFileTooLarge) {
+		t.Error("other error reply matches ErrFileTooLarge")
+	}
+}
+
+func TestTrimReply(t *testing.T) {
+	for reply, want := range map[string]string{
+		"stream: OK\x00": "stream: OK",
+		"stream: OK\n":   "stream: OK",
+		"PONG\n\x00":     "PONG",
+		"1: stream: OK":  "1: stream: OK",
+		"":               "",
+	} {
+		if got := trimReply(reply); got != want {
+			t.Errorf("trimReply(%q) = %q, want %q", reply, got, want)
+		}
+	}
+}
@@ -1,111 +1,137 @@
 package clamav
 
 import (
-	"bufio"
 	"clamav-wrapper/config"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/metrics"
+	"clamav-wrapper/tracing"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net"
-	"strings"
+	"log/slog"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func Scan(reader io.Reader, fileSize int64) (bool, error) {
-	maxBytes := int64(config.ClamAVMaxFileSizeMB) * 1024 * 1024
-	if fileSize > maxBytes {
-		return false, fmt.Errorf("file too large to scan (%d bytes > max %d bytes)", fileSize, maxBytes)
-	}
+var defaultCluster *Cluster
 
-	address := fmt.Sprintf("%s:%d", config.ClamAVHost, config.ClamAVPort)
-	fmt.Printf("Connecting to ClamAV at %s...\n", address)
+// ErrFileTooLarge is returned by Scan for files above CLAMAV_MAX_FILE_SIZE_MB,
+// and matches clamd's reply to streams above its StreamMaxLength.
+var ErrFileTooLarge = errors.New("file too large to scan")
 
-	conn, err := net.DialTimeout("tcp", address, time.Duration(config.ClamAVDialTimeoutSeconds)*time.Second)
-	if err != nil {
-		fmt.Printf("Failed to connect to ClamAV: %v\n", err)
-		return false, err
+// Init connects to the clamd daemons listed in config.ClamAVEndpoints.
+func Init() {
+	var endpoints []Endpoint
+	for _, s := range config.ClamAVEndpoints {
+		ep, err := ParseEndpoint(s)
+		if err != nil {
+			logging.Fatal("ClamAV init failed", "error", err)
+		}
+		endpoints = append(endpoints, ep)
 	}
-	defer conn.Close()
 
-	fmt.Println("Connected. Sending INSTREAM command...")
-	_, err = fmt.Fprintf(conn, "zINSTREAM\000")
+	var err error
+	defaultCluster, err = NewCluster(ClusterConfig{
+		Endpoints:   endpoints,
+		Strategy:    Strategy(config.ClamAVBalanceStrategy),
+		DialTimeout: time.Duration(config.ClamAVDialTimeoutSeconds) * time.Second,
+		ChunkSize:   config.ClamAVChunkSizeKB * 1024,
+		Pool: PoolConfig{
+			Size:                config.ClamAVPoolSize,
+			MaxInFlight:         config.ClamAVPoolMaxInFlight,
+			IdleTimeout:         time.Duration(config.ClamAVPoolIdleTimeoutSeconds) * time.Second,
+			HealthCheckInterval: time.Duration(config.ClamAVPoolHealthCheckSeconds) * time.Second,
+		},
+		HealthCheckInterval: time.Duration(config.ClamAVHealthCheckSeconds) * time.Second,
+	})
 	if err != nil {
-		fmt.Printf("Failed to send INSTREAM command: %v\n", err)
-		return false, err
+		logging.Fatal("ClamAV init failed", "error", err)
 	}
+}
 
-	buf := make([]byte, config.ClamAVChunkSizeKB*1024)
-	totalBytes := 0
-	chunkCount := 0
-
-	for {
-		n, err := reader.Read(buf)
-		if n > 0 {
-			chunk := []byte{
-				byte(n >> 24),
-				byte(n >> 16),
-				byte(n >> 8),
-				byte(n),
-			}
-			_, err = conn.Write(chunk)
-			if err != nil {
-				fmt.Printf("Failed to write chunk header: %v\n", err)
-				return false, err
-			}
-			_, err = conn.Write(buf[:n])
-			if err != nil {
-				fmt.Printf("Failed to write chunk data: %v\n", err)
-				return false, err
-			}
-			totalBytes += n
-			chunkCount++
-		}
-
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			fmt.Printf("Error while reading file: %v\n", err)
-			return false, err
-		}
+// Close ends all pooled clamd sessions.
+func Close() error {
+	if defaultCluster == nil {
+		return nil
 	}
+	return defaultCluster.Close()
+}
 
-	fmt.Printf("Sent %d chunks (%d bytes total)\n", chunkCount, totalBytes)
+// Ping succeeds when at least one of the configured clamd daemons answers PING.
+func Ping() error {
+	if defaultCluster == nil {
+		return fmt.Errorf("clamav is not initialised, call clamav.Init first")
+	}
+	return defaultCluster.Ping()
+}
 
-	_, err = conn.Write([]byte{0, 0, 0, 0}) // EOF marker
-	if err != nil {
-		fmt.Printf("Failed to send EOF marker: %v\n", err)
-		return false, err
+// LatestVersion returns the engine and the newest signature database version
+// the clamd daemons reported, or nil if none is known yet.
+func LatestVersion() *VersionInfo {
+	if defaultCluster == nil {
+		return nil
 	}
-	fmt.Println("Sent EOF marker. Awaiting ClamAV response...")
+	return defaultCluster.LatestVersion()
+}
 
-	respBuf := bufio.NewReader(conn)
-	var response []byte
-	for {
-		line, err := respBuf.ReadBytes('\n')
-		response = append(response, line...)
+// RefreshVersion asks the healthy clamd daemons for their version and returns
+// the newest, or nil if none answered.
+func RefreshVersion() *VersionInfo {
+	if defaultCluster == nil {
+		return nil
+	}
+	return defaultCluster.RefreshVersion()
+}
 
-		if err == io.EOF {
-			break // EOF is expected after response is sent
-		}
-		if err != nil {
-			fmt.Printf("Failed to read ClamAV response: %v\n", err)
-			return false, err
+// Scan streams reader to one of the configured clamd daemons and returns the
+// structured scan result. Files larger than CLAMAV_MAX_FILE_SIZE_MB are rejected
+// without contacting clamd. ctx is only used for logging and tracing: a scan
+// cannot be aborted once it started.
+func Scan(ctx context.Context, reader io.Reader, fileSize int64) (result *ScanResult, err error) {
+	ctx, span := tracing.Start(ctx, "scan", attribute.Int64("file.size", fileSize))
+	defer func() {
+		if result != nil {
+			span.SetAttributes(
+				attribute.String("clamav.endpoint", result.Endpoint),
+				attribute.String("clamav.verdict", string(result.Verdict)),
+				attribute.String("clamav.signature", result.Signature),
+			)
 		}
+		tracing.End(span, err)
+	}()
+
+	maxBytes := int64(config.ClamAVMaxFileSizeMB) * 1024 * 1024
+	if fileSize > maxBytes {
+		metrics.ObserveScan("oversized", 0, 0)
+		return nil, fmt.Errorf("%w (%d bytes > max %d bytes)", ErrFileTooLarge, fileSize, maxBytes)
+	}
+	if defaultCluster == nil {
+		return nil, fmt.Errorf("clamav is not initialised, call clamav.Init first")
 	}
 
-	status := string(response)
-	fmt.Printf("ClamAV response: %s\n", status)
+	slog.DebugContext(ctx, "Scanning file with ClamAV", "size", fileSize)
 
-	if strings.Contains(status, "OK") {
-		fmt.Println("File is clean.")
-		return true, nil
+	result, err = defaultCluster.Scan(reader)
+	if errors.Is(err, ErrFileTooLarge) {
+		// clamd's StreamMaxLength is below CLAMAV_MAX_FILE_SIZE_MB.
+		metrics.ObserveScan("oversized", 0, 0)
+		slog.WarnContext(ctx, "File exceeds clamd StreamMaxLength", "size", fileSize, "error", err)
+		return result, err
 	}
-	if strings.Contains(status, "FOUND") {
-		fmt.Println("File is infected!")
-		return false, nil
+	if err != nil {
+		metrics.ObserveScan("error", 0, 0)
+		slog.ErrorContext(ctx, "ClamAV scan failed", "error", err)
+		return result, err
 	}
+	metrics.ObserveScan(string(result.Verdict), result.Duration, result.BytesScanned)
 
-	// Unknown response
-	fmt.Println("Unexpected ClamAV response. Treating as infected.")
-	return false, fmt.Errorf("unexpected ClamAV response: %s", status)
+	slog.InfoContext(ctx, "ClamAV scan finished",
+		"endpoint", result.Endpoint,
+		"response", result.Raw,
+		"bytes", result.BytesScanned,
+		"duration_ms", result.Duration.Milliseconds(),
+	)
+	return result, nil
 }
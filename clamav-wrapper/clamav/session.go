@@ -0,0 +1,244 @@
+package clamav
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errSessionClosed is returned for commands issued on a session that was ended
+// or broken by an earlier I/O error.
+var errSessionClosed = errors.New("clamd session is closed")
+
+// replyGrace is how long to wait for clamd's reply after a write to it failed.
+const replyGrace = time.Second
+
+// Session is a clamd IDSESSION: one long-lived connection on which several
+// commands can be issued. clamd numbers the commands of a session starting
+// at 1, may process them concurrently and prefixes every reply with "<id>: ".
+//
+// Session multiplexes callers over the connection: commands (including the
+// INSTREAM body) are written one at a time, while a background reader routes
+// each reply back to the caller that issued it. This lets a scan be uploaded
+// while clamd is still working on the previous one.
+type Session struct {
+	conn      net.Conn
+	chunkSize int
+
+	writeMu sync.Mutex // serialises commands on the wire
+
+	mu       sync.Mutex // guards the fields below
+	nextID   int
+	pending  map[int]chan sessionReply
+	err      error     // non-nil once the session is unusable
+	lastUsed time.Time // completion of the last command other than PING
+}
+
+type sessionReply struct {
+	msg string
+	err error
+}
+
+func newSession(conn net.Conn, chunkSize int) (*Session, error) {
+	if err := writeCommand(conn, "IDSESSION"); err != nil {
+		return nil, fmt.Errorf("failed to send IDSESSION command: %w", err)
+	}
+	s := &Session{
+		conn:      conn,
+		chunkSize: chunkSize,
+		nextID:    1,
+		pending:   make(map[int]chan sessionReply),
+		lastUsed:  time.Now(),
+	}
+	go s.readLoop(bufio.NewReader(conn))
+	return s, nil
+}
+
+// readLoop delivers replies to the callers waiting on them until the
+// connection fails or is closed.
+func (s *Session) readLoop(r *bufio.Reader) {
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		id, msg, err := splitSessionReply(reply)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		s.mu.Lock()
+		ch, ok := s.pending[id]
+		delete(s.pending, id)
+		s.mu.Unlock()
+
+		if !ok {
+			s.fail(fmt.Errorf("clamd reply for unknown request %d: %q", id, msg))
+			return
+		}
+		ch <- sessionReply{msg: msg}
+	}
+}
+
+// fail marks the session as broken, closes the connection and releases every
+// caller still waiting for a reply.
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	s.conn.Close()
+	for id, ch := range s.pending {
+		ch <- sessionReply{err: err}
+		delete(s.pending, id)
+	}
+}
+
+// do sends cmd, optionally followed by an INSTREAM body, and waits for the
+// matching reply stripped of its request ID. An I/O error breaks the session.
+func (s *Session) do(cmd string, body io.Reader) (string, int64, error) {
+	s.writeMu.Lock()
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		s.writeMu.Unlock()
+		return "", 0, errSessionClosed
+	}
+	id := s.nextID
+	s.nextID++
+	ch := make(chan sessionReply, 1)
+	s.pending[id] = ch
+	s.mu.Unlock()
+
+	var n int64
+	err := writeCommand(s.conn, cmd)
+	if err != nil {
+		err = fmt.Errorf("failed to send %s command: %w", cmd, err)
+	} else if body != nil {
+		n, err = writeStream(s.conn, body, s.chunkSize)
+	}
+	s.writeMu.Unlock()
+
+	var werr *connWriteError
+	if errors.As(err, &werr) {
+		// clamd closes the connection when a stream exceeds StreamMaxLength, which
+		// makes the write fail, but it sends the reason first: give it a chance to arrive.
+		select {
+		case reply := <-ch:
+			s.fail(err)
+			if reply.err == nil {
+				return reply.msg, n, nil
+			}
+			return "", n, err
+		case <-time.After(replyGrace):
+			s.fail(err)
+		}
+	} else if err != nil {
+		s.fail(err)
+	}
+
+	reply := <-ch
+	if reply.err != nil {
+		return "", n, reply.err
+	}
+
+	// Health-check PINGs keep the connection alive but do not count as use,
+	// otherwise the pool could never shrink back after a burst.
+	if cmd != "PING" {
+		s.mu.Lock()
+		s.lastUsed = time.Now()
+		s.mu.Unlock()
+	}
+	return reply.msg, n, nil
+}
+
+// Ping checks that the session is still usable.
+func (s *Session) Ping() error {
+	reply, _, err := s.do("PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected PING response: %q", reply)
+	}
+	return nil
+}
+
+// Version returns the engine and signature database version reported by clamd.
+func (s *Session) Version() (*VersionInfo, error) {
+	reply, _, err := s.do("VERSION", nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseVersion(reply)
+}
+
+// Stats returns the raw output of the STATS command.
+func (s *Session) Stats() (string, error) {
+	reply, _, err := s.do("STATS", nil)
+	return reply, err
+}
+
+// Scan streams r to clamd with INSTREAM within the session.
+func (s *Session) Scan(r io.Reader) (*ScanResult, error) {
+	start := time.Now()
+	reply, n, err := s.do("INSTREAM", r)
+	if err != nil {
+		return nil, err
+	}
+	return newScanResult(reply, n, time.Since(start))
+}
+
+// End terminates the IDSESSION and closes the underlying connection.
+// Callers still waiting for a reply receive an error.
+func (s *Session) End() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.Err() != nil {
+		return nil
+	}
+	err := writeCommand(s.conn, "END")
+	s.fail(errSessionClosed)
+	return err
+}
+
+// Err returns the error that broke the session, or nil while it is usable.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// idleSince returns when the session last completed a command other than PING.
+func (s *Session) idleSince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastUsed
+}
+
+// splitSessionReply separates "<id>: <reply>" into its parts.
+func splitSessionReply(reply string) (int, string, error) {
+	idStr, msg, ok := strings.Cut(reply, ": ")
+	if !ok {
+		return 0, "", fmt.Errorf("unexpected IDSESSION response: %q", reply)
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, "", fmt.Errorf("unexpected IDSESSION response: %q", reply)
+	}
+	return id, msg, nil
+}
@@ -0,0 +1,40 @@
+package clamav
+
+import "testing"
+
+func TestSplitSessionReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		id      int
+		msg     string
+		wantErr bool
+	}{
+		{reply: "1: PONG", id: 1, msg: "PONG"},
+		{reply: "12: stream: OK", id: 12, msg: "stream: OK"},
+		{reply: "3: stream: Win.Test.OK-1 FOUND", id: 3, msg: "stream: Win.Test.OK-1 FOUND"},
+		{reply: "4: INSTREAM size limit exceeded. ERROR", id: 4, msg: "INSTREAM size limit exceeded. ERROR"},
+		{reply: "5: ", id: 5, msg: ""},
+		{reply: "PONG", wantErr: true},
+		{reply: "stream: OK", wantErr: true},
+		{reply: "x: PONG", wantErr: true},
+		{reply: "1:PONG", wantErr: true},
+		{reply: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reply, func(t *testing.T) {
+			id, msg, err := splitSessionReply(tt.reply)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %d %q", id, msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.id || msg != tt.msg {
+				t.Errorf("got %d %q, want %d %q", id, msg, tt.id, tt.msg)
+			}
+		})
+	}
+}
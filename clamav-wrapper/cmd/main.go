@@ -1,88 +1,721 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
+	"clamav-wrapper/api"
+	"clamav-wrapper/cache"
 	"clamav-wrapper/clamav"
 	"clamav-wrapper/config"
 	"clamav-wrapper/consumer"
-	"clamav-wrapper/minio"
+	"clamav-wrapper/deadletter"
+	"clamav-wrapper/health"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/metrics"
+	"clamav-wrapper/models"
+	"clamav-wrapper/policy"
+	"clamav-wrapper/reconcile"
+	"clamav-wrapper/results"
+	"clamav-wrapper/retry"
+	"clamav-wrapper/routing"
+	"clamav-wrapper/storage"
+	"clamav-wrapper/tracing"
+	"clamav-wrapper/worker"
 )
 
-// processFileEvent handles the processing of a single file event.
-func processFileEvent(bucketName string, objectKeyEncoded string) error {
+// objectStore holds the staging, clean and quarantine buckets, selected by STORAGE_TYPE.
+var objectStore storage.Storage
+
+// verdictCache answers repeat content without scanning it, nil when SCAN_CACHE_TYPE=none.
+var verdictCache *cache.Cache
+
+// router picks the bucket and key each processed object is moved to.
+var router *routing.Router
+
+// contentPolicy inspects files clamd found clean, nil when CONTENT_POLICY_ENABLED is false.
+var contentPolicy *policy.Policy
+
+// resultPublisher is told about every processed object, nil when RESULT_PUBLISHER_TYPE is unset.
+var resultPublisher results.Publisher
+
+// processFileEvent handles the processing of a single file event. Every line
+// it logs carries the bucket, the key and the correlation ID of the event.
+//
+// The version of the object that was scanned is the one tagged, copied and
+// deleted: versionID if the event names one, else the version downloaded. On
+// buckets without versioning, the ETag of the object is checked against the
+// one scanned before it is tagged, copied or deleted.
+func processFileEvent(ctx context.Context, bucketName string, objectKeyEncoded string, versionID string) error {
 	objectKey, err := url.QueryUnescape(objectKeyEncoded)
 	if err != nil {
-		log.Printf("Invalid object key: %v", err)
+		slog.ErrorContext(ctx, "Invalid object key", "bucket", bucketName, "key", objectKeyEncoded, "error", err)
 		return err
 	}
+	logger := slog.With("bucket", bucketName, "key", objectKey)
+	objectAttrs := []attribute.KeyValue{attribute.String("bucket", bucketName), attribute.String("key", objectKey)}
+	if versionID != "" {
+		logger = logger.With("version_id", versionID)
+		objectAttrs = append(objectAttrs, attribute.String("version_id", versionID))
+	}
 
-	log.Printf("Processing file: %s from bucket: %s", objectKey, bucketName)
+	logger.InfoContext(ctx, "Processing file")
 
-	file, size, err := minio.GetFileStreamWithSize(bucketName, objectKey)
-	if err != nil {
-		log.Printf("Failed to get file from MinIO: %v", err)
+	var reason string // Why the file was not scanned or was blocked
+	result, content, obj, err := scanObject(ctx, logger, bucketName, objectKey, versionID, objectAttrs)
+	if errors.Is(err, clamav.ErrFileTooLarge) && config.OversizePolicy != "fail" {
+		logger.WarnContext(ctx, "File too large to scan, applying oversize policy", "size", obj.Size, "policy", config.OversizePolicy, "error", err)
+		result = &clamav.ScanResult{Verdict: clamav.VerdictUnscanned}
+		reason = "file-too-large"
+	} else if errors.Is(err, storage.ErrNotFound) {
+		// Typically an event redelivered after the file was moved.
+		findProcessed(ctx, logger, bucketName, objectKey)
+		return nil
+	} else if err != nil {
 		return err
 	}
-	defer file.Close()
+	if versionID == "" && obj.VersionID != "" {
+		versionID = obj.VersionID
+		logger = logger.With("version_id", versionID)
+	}
+	if contentPolicy != nil && result.IsClean() && content != nil {
+		if reason = contentPolicy.Check(bucketName, content); reason != "" {
+			metrics.PolicyViolations.WithLabelValues(reason).Inc()
+			result.Verdict = clamav.VerdictBlocked
+		}
+	}
+
+	scannedAt := time.Now().UTC()
+	info := storage.ScanInfo{
+		Verdict:   string(result.Verdict),
+		Signature: result.Signature,
+		ScannedAt: scannedAt,
+		Instance:  config.ScannerInstanceID,
+		Reason:    reason,
+	}
+	if result.Version != nil {
+		info.Engine = result.Version.Engine
+		info.Database = result.Version.Database
+	}
+	logger = logger.With("verdict", result.Verdict)
+
+	if config.ScanAction == "tag-in-place" {
+		logger.InfoContext(ctx, "File scanned, tagging it in place", "signature", result.Signature)
+		err := traced(ctx, "tag", objectAttrs, func(ctx context.Context) error {
+			if _, err := statScanned(ctx, bucketName, objectKey, obj); err != nil {
+				return err
+			}
+			return objectStore.TagObject(ctx, bucketName, objectKey, versionID, info)
+		})
+		if errors.Is(err, errObjectChanged) {
+			// The new content has an event of its own, or is rescanned on retry.
+			logger.WarnContext(ctx, "File changed while it was scanned, not tagging it", "error", err)
+			return err
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to tag file", "error", err)
+			return err
+		}
+		if err := publishResult(ctx, resultEvent(bucketName, objectKey, obj, result, reason, bucketName, objectKey, scannedAt)); err != nil {
+			return err
+		}
+		logger.InfoContext(ctx, "File processed and tagged successfully")
+		return nil
+	}
 
-	isClean, err := clamav.Scan(file, size)
+	target := routing.Clean
+	switch {
+	case result.Verdict == clamav.VerdictUnscanned:
+		target = unscannedTarget()
+		logger.WarnContext(ctx, "File was not scanned, moving it as OVERSIZE_POLICY says", "reason", reason, "policy", config.OversizePolicy)
+	case result.Verdict == clamav.VerdictBlocked:
+		target = routing.Quarantine
+		logger.WarnContext(ctx, "File violates the content policy, moving it to quarantine", "reason", reason, "mime", content.MIME)
+	case !result.IsClean():
+		target = routing.Quarantine
+		logger.WarnContext(ctx, "File is infected, moving it to quarantine", "signature", result.Signature)
+	default:
+		logger.InfoContext(ctx, "File is clean, moving it to the clean bucket")
+	}
+	targetBucket, targetKey, err := router.Resolve(target, routing.Object{
+		Bucket:  bucketName,
+		Key:     objectKey,
+		Verdict: string(result.Verdict),
+		SHA256:  result.SHA256,
+		Time:    scannedAt,
+	})
 	if err != nil {
-		log.Printf("ClamAV scan error: %v", err)
+		logger.ErrorContext(ctx, "Failed to route file", "error", err)
 		return err
 	}
+	logger = logger.With("target_bucket", targetBucket, "target_key", targetKey)
 
-	targetBucket := config.CleanBucket
-	if !isClean {
-		targetBucket = config.QuarantineBucket
-		log.Printf("File %s in bucket %s is infected. Moving to quarantine.", objectKey, bucketName)
-	} else {
-		log.Printf("File %s in bucket %s is clean. Moving to clean bucket.", objectKey, bucketName)
+	// Files that were not scanned or were blocked are always annotated with the
+	// reason, so that one let through to the clean bucket can be told apart from
+	// a scanned one.
+	var annotation *storage.ScanInfo
+	if config.ScanAnnotate || reason != "" {
+		annotation = &info
+	}
+	copyAttrs := append(objectAttrs, attribute.String("target_bucket", targetBucket), attribute.String("target_key", targetKey))
+	err = traced(ctx, "copy", copyAttrs, func(ctx context.Context) error {
+		return copyObject(ctx, logger, bucketName, objectKey, obj, targetBucket, targetKey, annotation)
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		// Another delivery of the event moved it in the meantime.
+		findProcessed(ctx, logger, bucketName, objectKey)
+		return nil
+	}
+	if errors.Is(err, errObjectChanged) {
+		// Retrying scans the new content, unless its own event got to it first.
+		logger.WarnContext(ctx, "File changed while it was scanned, not moving it", "error", err)
+		return err
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to move file", "error", err)
+		return err
 	}
 
-	if err := minio.CopyObject(bucketName, targetBucket, objectKey); err != nil {
-		log.Printf("Failed to move file to %s bucket: %v", targetBucket, err)
+	// Published before the original is deleted: if publishing fails, the event is
+	// retried from the start and the result is not lost.
+	if err := publishResult(ctx, resultEvent(bucketName, objectKey, obj, result, reason, targetBucket, targetKey, scannedAt)); err != nil {
 		return err
 	}
 
-	if err := minio.DeleteObject(bucketName, objectKey); err != nil {
-		log.Printf("Failed to delete original file %s from bucket %s: %v", objectKey, bucketName, err)
+	err = traced(ctx, "delete", objectAttrs, func(ctx context.Context) error {
+		if versionID == "" {
+			// Without versions, deleting would also remove content uploaded since.
+			if _, err := statScanned(ctx, bucketName, objectKey, obj); err != nil {
+				return err
+			}
+		}
+		return objectStore.DeleteObject(ctx, bucketName, objectKey, versionID)
+	})
+	if errors.Is(err, errObjectChanged) {
+		logger.WarnContext(ctx, "File was overwritten after it was copied, leaving the new content to its own event", "error", err)
+		return nil
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		logger.InfoContext(ctx, "File was already deleted")
+		return nil
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to delete original file", "error", err)
 		return err
 	}
 
-	log.Printf("File %s processed and moved to %s bucket successfully.", objectKey, targetBucket)
+	logger.InfoContext(ctx, "File processed and moved successfully")
+	return nil
+}
+
+// scanObject downloads and scans an object, and inspects it for the content
+// policy if one is enabled and clamd found it clean. With a verdict cache, an
+// object whose content was already scanned with the current signature database
+// is neither downloaded nor scanned, provided its hash is known up front: from
+// a SHA-256 checksum stored with it, or from its ETag and size when an object
+// with the same ones was scanned before. It returns the size, ETag and version
+// of the content scanned, also when the scan failed.
+func scanObject(ctx context.Context, logger *slog.Logger, bucketName, objectKey, versionID string, objectAttrs []attribute.KeyValue) (*clamav.ScanResult, *policy.Content, storage.ObjectInfo, error) {
+	var obj storage.ObjectInfo
+	if verdictCache != nil {
+		var err error
+		if obj, err = objectStore.StatObject(ctx, bucketName, objectKey, versionID); err != nil {
+			if !errors.Is(err, storage.ErrNotFound) {
+				logger.ErrorContext(ctx, "Failed to stat file in storage", "error", err)
+			}
+			return nil, nil, obj, err
+		}
+		if versionID == "" {
+			versionID = obj.VersionID // Download what was looked up
+		}
+		if version := clamav.LatestVersion(); version != nil {
+			entry, sha256, ok := verdictCache.Lookup(ctx, obj, version.Database)
+			// A clean verdict cached while the content policy was disabled says
+			// nothing about the content: the file must be inspected.
+			if ok && (contentPolicy == nil || entry.Content != nil || entry.Verdict != clamav.VerdictClean) {
+				logger.InfoContext(ctx, "Content scanned before, using cached verdict", "sha256", sha256, "database", entry.Database)
+				// What an instance with the policy enabled found in the content is of no use without it.
+				content := entry.Content
+				if contentPolicy == nil {
+					content = nil
+				}
+				return entry.Result(sha256, obj.Size), content, obj, nil
+			}
+		}
+	}
+
+	// The download span covers opening the object; its body is streamed to clamd
+	// during the scan span, unless the content policy needs it spooled to disk.
+	downloadCtx, span := tracing.Start(ctx, "download", objectAttrs...)
+	file, got, err := objectStore.GetFileStreamWithSize(downloadCtx, bucketName, objectKey, versionID)
+	if err == nil && (obj.Key == "" || got.Size != obj.Size || got.ETag != obj.ETag) {
+		obj = got // Not stat'ed, or changed since
+	}
+	size := obj.Size
+	var spooled *spoolFile
+	if err == nil && contentPolicy != nil && size <= int64(config.ClamAVMaxFileSizeMB)*1024*1024 {
+		spooled, err = spool(file)
+		file = spooled
+	}
+	tracing.End(span, err)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			logger.ErrorContext(ctx, "Failed to get file from storage", "error", err)
+		}
+		return nil, nil, obj, err
+	}
+	defer file.Close()
+
+	result, err := clamav.Scan(ctx, file, size)
+	if err != nil {
+		logger.ErrorContext(ctx, "ClamAV scan error", "error", err)
+		return nil, nil, obj, err
+	}
+
+	var content *policy.Content
+	if spooled != nil && result.IsClean() {
+		err := traced(ctx, "inspect", objectAttrs, func(ctx context.Context) error {
+			var err error
+			content, err = policy.Inspect(spooled.File, size, contentPolicy.MaxDepth())
+			return err
+		})
+		if errors.Is(err, policy.ErrCorrupt) {
+			// Blocked by the policy, as what the archive holds is unknown.
+			logger.WarnContext(ctx, "File is a damaged archive", "error", err)
+			err = nil
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to inspect file content", "error", err)
+			return nil, nil, obj, err
+		}
+		logger.DebugContext(ctx, "File content inspected", "mime", content.MIME, "encrypted", content.Encrypted, "macros", content.Macros, "depth", content.Depth)
+	}
+
+	if verdictCache != nil {
+		verdictCache.Store(ctx, obj, result, content, time.Now().UTC())
+	}
+	return result, content, obj, nil
+}
+
+// spoolFile is a temporary copy of an object, removed when closed.
+type spoolFile struct {
+	*os.File
+}
+
+// spool copies body to a file in CONTENT_POLICY_TEMP_DIR and closes it. The
+// copy is positioned at its start, so it can be scanned and then inspected.
+func spool(body io.ReadCloser) (*spoolFile, error) {
+	defer body.Close()
+	f, err := os.CreateTemp(config.ContentPolicyCfg.TempDir, "clamav-wrapper-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	sf := &spoolFile{f}
+	if _, err := io.Copy(f, body); err != nil {
+		sf.Close()
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		sf.Close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+func (f *spoolFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// unscannedTarget is where OVERSIZE_POLICY sends files too large to scan.
+func unscannedTarget() routing.Target {
+	switch config.OversizePolicy {
+	case "unscanned":
+		return routing.Unscanned
+	case "pass-through":
+		return routing.Clean
+	default:
+		return routing.Quarantine
+	}
+}
+
+// traced runs fn in a span named name.
+func traced(ctx context.Context, name string, attrs []attribute.KeyValue, fn func(ctx context.Context) error) error {
+	ctx, span := tracing.Start(ctx, name, attrs...)
+	err := fn(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+// resultEvent describes the scan result of an object. obj describes the content
+// scanned, reason why the object was not scanned, if it was not.
+func resultEvent(bucketName, objectKey string, obj storage.ObjectInfo, result *clamav.ScanResult, reason, targetBucket, targetKey string, scannedAt time.Time) models.ScanResultEvent {
+	return models.ScanResultEvent{
+		Bucket:       bucketName,
+		Key:          objectKey,
+		VersionID:    obj.VersionID,
+		ETag:         obj.ETag,
+		Verdict:      string(result.Verdict),
+		Signature:    result.Signature,
+		Reason:       reason,
+		Size:         obj.Size,
+		SHA256:       result.SHA256,
+		DurationMs:   result.Duration.Milliseconds(),
+		Cached:       result.Cached,
+		TargetBucket: targetBucket,
+		TargetKey:    targetKey,
+		ScannedAt:    scannedAt,
+	}
+}
+
+// publishResult sends a scan result to resultPublisher, if configured.
+func publishResult(ctx context.Context, event models.ScanResultEvent) error {
+	if resultPublisher == nil {
+		return nil
+	}
+	if err := resultPublisher.Publish(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish scan result", "bucket", event.Bucket, "key", event.Key, "error", err)
+		return err
+	}
 	return nil
 }
 
+// reconcileStaging processes again the files left in the staging bucket by
+// lost events or interrupted moves, next to the events being consumed.
+func reconcileStaging(ctx context.Context, pool *worker.Pool) {
+	n, err := reconcile.Run(ctx, objectStore, config.StagingBucket, config.ReconcileMinAge, func(ctx context.Context, bucket, key string) error {
+		ctx = logging.WithCorrelationID(ctx, "reconcile-"+logging.NewID())
+		// Keys are URL-encoded, like in S3 notifications.
+		return pool.Submit(ctx, bucket, url.QueryEscape(key), "", nil)
+	})
+	if err != nil && ctx.Err() == nil && !errors.Is(err, worker.ErrClosed) {
+		slog.Error("Reconciling the staging bucket failed", "bucket", config.StagingBucket, "submitted", n, "error", err)
+		return
+	}
+	slog.Info("Reconciled the staging bucket", "bucket", config.StagingBucket, "submitted", n)
+}
+
+// replayDeadLetters implements the "replay-dlq" command, which moves dead-lettered
+// events back into the main queue so they are scanned again.
+//
+// The fs and minio consumers read no queue events could be put back into, so
+// with them the command processes the events itself, one after another, with
+// retries but without dead-lettering: an event that fails again stops the
+// replay and stays in the dead-letter queue.
+func replayDeadLetters(args []string) {
+	fs := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	limit := fs.Int("limit", 0, "maximum number of events to replay (0 replays all)")
+	fs.Parse(args)
+
+	var enqueue deadletter.EnqueueFunc
+	if config.MessageBrokerType == "fs" || config.MessageBrokerType == "minio" {
+		initPipeline()
+		clamav.Init()
+		defer clamav.Close()
+		closeOutputs, err := openOutputs()
+		if err != nil {
+			logging.Fatal("Replay failed", "error", err)
+		}
+		defer closeOutputs()
+		enqueue = processDeadLetter
+	}
+
+	n, err := deadletter.Replay(context.Background(), config.DeadLetterCfg, *limit, enqueue)
+	if err != nil {
+		logging.Fatal("Replay failed", "replayed", n, "error", err)
+	}
+	slog.Info("Replayed dead-lettered events", "count", n, "broker", config.MessageBrokerType)
+}
+
+// processDeadLetter runs processFileEvent with retries for a dead-lettered
+// event, with a correlation ID of its own.
+func processDeadLetter(ctx context.Context, event models.DeadLetterEvent) error {
+	ctx = logging.WithCorrelationID(ctx, "replay-"+logging.NewID())
+	return retry.Wrap(config.RetryCfg, nil, processFileEvent)(ctx, event.Bucket, event.Key, event.VersionID)
+}
+
+// initPipeline checks the scan settings and connects to the object store and
+// loads the routing rules processFileEvent uses, exiting on failure.
+func initPipeline() {
+	switch config.ScanAction {
+	case "move", "tag-in-place":
+	default:
+		logging.Fatal("Unsupported SCAN_ACTION", "scan_action", config.ScanAction)
+	}
+	switch config.OversizePolicy {
+	case "quarantine", "unscanned", "pass-through", "fail":
+	default:
+		logging.Fatal("Unsupported OVERSIZE_POLICY", "oversize_policy", config.OversizePolicy)
+	}
+
+	var err error
+	objectStore, err = storage.New()
+	if err != nil {
+		logging.Fatal("Storage init failed", "error", err)
+	}
+	router, err = routing.New(config.RoutingRulesFile)
+	if err != nil {
+		logging.Fatal("Routing init failed", "error", err)
+	}
+
+	// Without extended attributes, every file that is annotated would fail to
+	// move or be tagged: better not to start.
+	if fsStore, ok := objectStore.(*storage.FSStorage); ok && annotates() {
+		buckets := []string{config.StagingBucket}
+		if config.ScanAction == "move" {
+			buckets = router.Buckets(routing.Clean)
+			buckets = append(buckets, router.Buckets(routing.Quarantine)...)
+			if config.OversizePolicy == "unscanned" {
+				buckets = append(buckets, router.Buckets(routing.Unscanned)...)
+			}
+		}
+		for _, bucket := range buckets {
+			if err := fsStore.CheckAttributes(bucket); err != nil {
+				logging.Fatal("The file system does not support the extended attributes scan results are stored in", "bucket", bucket, "error", err)
+			}
+		}
+	}
+}
+
+// annotates reports whether scan results may be stored with files: always in
+// tag-in-place mode, and otherwise on copies when SCAN_ANNOTATE is set or a
+// reason is recorded, for files not scanned, blocked by the content policy,
+// or found infected by a rescan.
+func annotates() bool {
+	return config.ScanAction == "tag-in-place" || config.ScanAnnotate || config.OversizePolicy != "fail" ||
+		config.ContentPolicyCfg.Enabled || config.RescanCfg.OnUpdate
+}
+
+// openOutputs sets up the result publisher, scan cache and content policy
+// processFileEvent uses, as configured. The returned function closes them.
+func openOutputs() (func(), error) {
+	var closers []func()
+	closeOutputs := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	// Scan results are published to downstream services, if configured.
+	var err error
+	resultPublisher, err = results.NewPublisher(config.ResultPublisherCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create result publisher: %w", err)
+	}
+	if resultPublisher != nil {
+		closers = append(closers, func() { resultPublisher.Close() })
+	}
+
+	// Verdicts of scanned content are cached so repeat uploads skip clamd, unless disabled.
+	verdictCache, err = cache.New(config.ScanCacheCfg)
+	if err != nil {
+		closeOutputs()
+		return nil, fmt.Errorf("failed to create scan cache: %w", err)
+	}
+	if verdictCache != nil {
+		closers = append(closers, func() { verdictCache.Close() })
+	}
+
+	contentPolicy, err = policy.New(config.ContentPolicyCfg)
+	if err != nil {
+		closeOutputs()
+		return nil, fmt.Errorf("failed to create content policy: %w", err)
+	}
+	return closeOutputs, nil
+}
+
 func main() {
 	config.Init()
-	minio.Init() // MinIO client needs to be initialized
+	if err := logging.Init(); err != nil {
+		logging.Fatal("Logging init failed", "error", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "replay-dlq" {
+		replayDeadLetters(os.Args[2:])
+		return
+	}
+
+	initPipeline()
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		logging.Fatal("Tracing init failed", "error", err)
+	}
+	clamav.Init()
+
+	err = run()
+	clamav.Close()
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	cancel()
+	if err != nil {
+		logging.Fatal("Consumer error", "error", err)
+	}
+}
+
+// run consumes file events until SIGINT or SIGTERM is received, then stops
+// fetching new messages, waits up to SHUTDOWN_TIMEOUT_SECONDS for in-flight
+// events to be scanned and moved, and closes the consumer so that their
+// offsets/acknowledgements are flushed.
+func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Initializing consumer", "broker", config.MessageBrokerType)
+
+	// Events that keep failing after all retries are sent to the dead-letter queue, if configured.
+	dlq, err := deadletter.NewPublisher(config.DeadLetterCfg)
+	if err != nil {
+		return fmt.Errorf("failed to create dead-letter publisher: %w", err)
+	}
+	if dlq != nil {
+		defer dlq.Close()
+	} else if config.MessageBrokerType == "kafka" {
+		slog.Warn("No dead-letter queue configured: an event failing all retries holds back the Kafka commits of its partition until the next restart")
+	}
+
+	closeOutputs, err := openOutputs()
+	if err != nil {
+		return err
+	}
+	defer closeOutputs()
+
+	// Events are processed by a bounded pool of workers running processFileEvent,
+	// failed ones going back to the pool to be retried after their backoff.
+	pool, err := worker.NewPool(config.WorkerCfg, retry.Schedule(config.RetryCfg, dlq, processFileEvent))
+	if err != nil {
+		return fmt.Errorf("failed to create worker pool: %w", err)
+	}
+	metrics.RegisterInFlight(pool.InFlight)
+
+	// Health, readiness and metrics endpoints, if enabled. They are served from
+	// before the consumer connects until everything else has shut down.
+	var opsServer *health.Server
+	if config.OpsEnabled {
+		opsServer = health.NewServer(config.OpsAddr)
+		opsServer.AddCheck("clamd", func(ctx context.Context) error { return clamav.Ping() })
+		buckets := []string{config.StagingBucket}
+		if config.ScanAction == "move" {
+			buckets = append(buckets, router.Buckets(routing.Clean)...)
+			buckets = append(buckets, router.Buckets(routing.Quarantine)...)
+			if config.OversizePolicy == "unscanned" {
+				buckets = append(buckets, router.Buckets(routing.Unscanned)...)
+			}
+		}
+		for _, bucket := range buckets {
+			bucket := bucket
+			opsServer.AddCheck("bucket:"+bucket, func(ctx context.Context) error { return objectStore.CheckBucket(ctx, bucket) })
+		}
+		if err := opsServer.Start(); err != nil {
+			pool.Close()
+			return fmt.Errorf("failed to start health server: %w", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			opsServer.Shutdown(ctx)
+		}()
+	}
 
-	log.Printf("Initializing consumer for broker type: %s", config.MessageBrokerType)
+	// The scanning API serves synchronous verdicts next to the queue-driven pipeline, if enabled.
+	var apiServer *api.Server
+	if config.APICfg.Enabled {
+		apiServer, err = api.NewServer(config.APICfg, objectStore)
+		if err == nil {
+			err = apiServer.Start()
+		}
+		if err != nil {
+			pool.Close()
+			return fmt.Errorf("failed to start scan API: %w", err)
+		}
+	}
 
 	// Create an instance of the consumer factory
 	consumerFactory := consumer.NewDefaultConsumerFactory()
 
 	// Create the consumer using the factory
-	// The handler (processFileEvent) is now passed at creation time.
-	consumer, err := consumerFactory.CreateConsumer(config.MessageBrokerType, processFileEvent)
+	// The worker pool is passed at creation time; the consumer submits every event to it.
+	messageConsumer, err := consumerFactory.CreateConsumer(config.MessageBrokerType, pool)
 	if err != nil {
-		log.Fatalf("Failed to create message consumer: %v", err)
+		pool.Close()
+		return fmt.Errorf("failed to create message consumer: %w", err)
 	}
 
-	// Defer the closing of the consumer right after it's successfully created and validated.
-	defer func() {
-		log.Println("Closing consumer...")
-		if err := consumer.Close(); err != nil {
-			log.Printf("Error closing consumer: %v", err)
+	if opsServer != nil {
+		opsServer.AddCheck("broker:"+config.MessageBrokerType, messageConsumer.Ping)
+	}
+	if lr, ok := messageConsumer.(consumer.LagReporter); ok {
+		metrics.RegisterConsumerLag(lr.Lag)
+	}
+
+	slog.Info("Starting consumer")
+	if opsServer != nil {
+		opsServer.SetReady(true)
+	}
+	// Rescans of the clean buckets run next to the consumer, and are waited for at shutdown.
+	signaturesWatched := make(chan struct{})
+	if config.RescanCfg.CheckInterval > 0 {
+		go func() {
+			defer close(signaturesWatched)
+			watchSignatures(ctx)
+		}()
+	} else {
+		close(signaturesWatched)
+	}
+	// The fs and minio consumers process the files they find at startup
+	// themselves, and without a consumer files are not moved at all.
+	sweeps := config.MessageBrokerType == "fs" || (config.MessageBrokerType == "minio" && config.MinioListenCfg.SweepInterval > 0)
+	if config.ReconcileOnStartup && config.ScanAction == "move" && !sweeps && config.MessageBrokerType != "none" {
+		go reconcileStaging(ctx, pool)
+	}
+	// Start the consumer. The worker pool is already configured.
+	// This blocks and continuously submits messages to the workers until ctx is cancelled.
+	consumeErr := messageConsumer.StartConsumer(ctx)
+	if consumeErr != nil {
+		slog.Error("Consumer stopped with error", "error", consumeErr)
+	} else {
+		slog.Info("Shutdown signal received, no longer fetching new messages")
+	}
+	stop() // A second signal now terminates the process immediately
+	if opsServer != nil {
+		opsServer.SetReady(false)
+	}
+
+	// Let in-flight scans and moves finish before offsets are committed and connections closed.
+	slog.Info("Waiting for in-flight events to finish", "timeout", config.ShutdownTimeout.String(), "in_flight", pool.InFlight())
+	drainCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if apiServer != nil {
+		if err := apiServer.Shutdown(drainCtx); err != nil {
+			slog.Warn("Scan API requests did not finish in time", "error", err)
 		}
-	}()
+	}
+	if err := pool.Shutdown(drainCtx); err != nil {
+		slog.Warn("In-flight events did not finish in time and were interrupted", "error", err)
+	}
+	select {
+	case <-signaturesWatched:
+	case <-drainCtx.Done():
+		slog.Warn("Rescan of the clean buckets did not finish in time and was interrupted")
+	}
 
-	log.Println("Starting consumer...")
-	// Start the consumer. The handler is already configured.
-	// This will block and continuously process messages.
-	if err := consumer.StartConsumer(); err != nil {
-		log.Fatalf("Consumer error: %v", err)
+	slog.Info("Closing consumer")
+	if err := messageConsumer.Close(); err != nil {
+		slog.Error("Error closing consumer", "error", err)
 	}
+
+	return consumeErr
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"clamav-wrapper/cache"
+	"clamav-wrapper/clamav"
+	"clamav-wrapper/clamav/clamavtest"
+	"clamav-wrapper/config"
+	"clamav-wrapper/deadletter"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/models"
+	"clamav-wrapper/policy"
+	"clamav-wrapper/routing"
+	"clamav-wrapper/storage"
+)
+
+// setupPipeline points the pipeline at a fake clamd and an in-memory store,
+// moving files from "staging" to "clean" and "quarantine", without cache,
+// content policy or result publisher.
+func setupPipeline(t *testing.T) (*storage.MemoryStorage, *clamavtest.Clamd) {
+	t.Helper()
+	clamd := clamavtest.Start(t)
+	t.Setenv("CLAMAV_ENDPOINTS", clamd.Endpoint())
+	t.Setenv("CLAMAV_HEALTH_CHECK_SECONDS", "0")
+	t.Setenv("STORAGE_TYPE", "memory")
+	t.Setenv("SCAN_ACTION", "move")
+	t.Setenv("SCAN_CACHE_TYPE", "none")
+	config.Init()
+
+	clamav.Init()
+	t.Cleanup(func() { clamav.Close() })
+
+	store := storage.NewMemoryStorage()
+	objectStore = store
+	var err error
+	if router, err = routing.New(""); err != nil {
+		t.Fatal(err)
+	}
+	verdictCache, contentPolicy, resultPublisher = nil, nil, nil
+	t.Cleanup(func() { verdictCache, contentPolicy, resultPublisher = nil, nil, nil })
+	return store, clamd
+}
+
+// process runs processFileEvent for key of the staging bucket, as a notification would.
+func process(t *testing.T, key string) error {
+	t.Helper()
+	return processFileEvent(context.Background(), config.StagingBucket, url.QueryEscape(key), "")
+}
+
+// How a cached clean verdict is used depends on the content policy: with the
+// policy enabled it needs the content inspected along with it, while with the
+// policy disabled any content it carries is ignored.
+func TestCachedVerdictAndContentPolicy(t *testing.T) {
+	macros := &policy.Content{MIME: "application/pdf", Macros: true}
+	tests := []struct {
+		name    string
+		policy  bool
+		content *policy.Content // Cached along with the verdict
+		scans   int32
+		bucket  string
+	}{
+		{name: "policy disabled", bucket: "clean"},
+		{name: "policy disabled, content cached", content: macros, bucket: "clean"},
+		{name: "policy enabled", policy: true, scans: 1, bucket: "clean"},
+		{name: "policy enabled, content cached", policy: true, content: macros, bucket: "quarantine"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, clamd := setupPipeline(t)
+			var err error
+			if verdictCache, err = cache.New(config.ScanCacheConfig{Type: "memory", Size: 10, TTL: time.Hour}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.policy {
+				if contentPolicy, err = policy.New(config.ContentPolicyConfig{Enabled: true, BlockMacros: true, TempDir: t.TempDir()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			store.Put(config.StagingBucket, "doc.pdf", []byte("%PDF-1.7 harmless"))
+			obj, err := store.StatObject(context.Background(), config.StagingBucket, "doc.pdf", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			version := clamav.RefreshVersion()
+			if version == nil {
+				t.Fatal("fake clamd reported no version")
+			}
+			verdictCache.Store(context.Background(), obj, &clamav.ScanResult{
+				Verdict:      clamav.VerdictClean,
+				SHA256:       obj.SHA256,
+				BytesScanned: obj.Size,
+				Version:      version,
+			}, tt.content, time.Now())
+
+			if err := process(t, "doc.pdf"); err != nil {
+				t.Fatal(err)
+			}
+			if n := clamd.Scans.Load(); n != tt.scans {
+				t.Errorf("file scanned %d times, want %d", n, tt.scans)
+			}
+			if _, ok := store.Get(tt.bucket, "doc.pdf"); !ok {
+				t.Errorf("file was not moved to the %s bucket", tt.bucket)
+			}
+		})
+	}
+}
+
+func TestProcessFileEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		data      string
+		bucket    string // Bucket the file must end up in
+		verdict   string
+		signature string
+	}{
+		{name: "clean", key: "report.txt", data: "quarterly figures", bucket: "clean", verdict: "clean"},
+		{name: "infected", key: "eicar.com", data: clamavtest.EICAR, bucket: "quarantine", verdict: "infected", signature: "Eicar-Test-Signature"},
+		{name: "encoded key", key: "in box/résumé #1.txt", data: "hello", bucket: "clean", verdict: "clean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, clamd := setupPipeline(t)
+			store.Put(config.StagingBucket, tt.key, []byte(tt.data))
+
+			if err := process(t, tt.key); err != nil {
+				t.Fatal(err)
+			}
+			if clamd.Scans.Load() != 1 {
+				t.Errorf("file scanned %d times, want once", clamd.Scans.Load())
+			}
+			if _, ok := store.Get(config.StagingBucket, tt.key); ok {
+				t.Error("file still in the staging bucket")
+			}
+			data, ok := store.Get(tt.bucket, tt.key)
+			if !ok || string(data) != tt.data {
+				t.Fatalf("file not moved to the %s bucket", tt.bucket)
+			}
+			tags := store.Tags(tt.bucket, tt.key)
+			if tags[storage.TagVerdict] != tt.verdict || tags[storage.TagSignature] != tt.signature {
+				t.Errorf("tagged %s %q, want %s %q", tags[storage.TagVerdict], tags[storage.TagSignature], tt.verdict, tt.signature)
+			}
+			if got, want := store.Metadata(tt.bucket, tt.key)[storage.MetaSource], config.StagingBucket+"/"+url.QueryEscape(tt.key); got != want {
+				t.Errorf("source recorded as %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProcessFileEventOversize(t *testing.T) {
+	tests := []struct {
+		policy string
+		clamd  bool   // Rejected by clamd's StreamMaxLength rather than CLAMAV_MAX_FILE_SIZE_MB
+		bucket string // "" if the event must fail and the file stay in staging
+	}{
+		{policy: "quarantine", bucket: "quarantine"},
+		{policy: "unscanned", bucket: "unscanned"},
+		{policy: "pass-through", bucket: "clean"},
+		{policy: "fail"},
+		{policy: "quarantine", clamd: true, bucket: "quarantine"},
+		{policy: "fail", clamd: true},
+	}
+	for _, tt := range tests {
+		name := tt.policy
+		if tt.clamd {
+			name += " clamd limit"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("OVERSIZE_POLICY", tt.policy)
+			t.Setenv("CLAMAV_MAX_FILE_SIZE_MB", "1")
+			store, clamd := setupPipeline(t)
+			data := make([]byte, 1024*1024+1)
+			if tt.clamd {
+				data = data[:1000]
+				clamd.StreamMax.Store(100)
+			}
+			store.Put(config.StagingBucket, "big.iso", data)
+
+			err := process(t, "big.iso")
+			if tt.bucket == "" {
+				if !errors.Is(err, clamav.ErrFileTooLarge) {
+					t.Fatalf("processFileEvent returned %v, want %v", err, clamav.ErrFileTooLarge)
+				}
+				if _, ok := store.Get(config.StagingBucket, "big.iso"); !ok {
+					t.Error("file not left in the staging bucket")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := store.Get(tt.bucket, "big.iso"); !ok {
+				t.Fatalf("file not moved to the %s bucket", tt.bucket)
+			}
+			// Even when let through, the file is marked as not scanned.
+			tags := store.Tags(tt.bucket, "big.iso")
+			if tags[storage.TagVerdict] != string(clamav.VerdictUnscanned) || tags[storage.TagReason] != "file-too-large" {
+				t.Errorf("tagged %s (%s), want %s (file-too-large)", tags[storage.TagVerdict], tags[storage.TagReason], clamav.VerdictUnscanned)
+			}
+		})
+	}
+}
+
+func TestProcessFileEventNotFound(t *testing.T) {
+	store, clamd := setupPipeline(t)
+	if err := process(t, "missing.txt"); err != nil {
+		t.Errorf("processing a missing file returned %v", err)
+	}
+
+	// A redelivered event finds the file already moved.
+	store.Put(config.StagingBucket, "twice.txt", []byte("hello"))
+	for i := 0; i < 2; i++ {
+		if err := process(t, "twice.txt"); err != nil {
+			t.Fatalf("delivery %d: %v", i+1, err)
+		}
+	}
+	if clamd.Scans.Load() != 1 {
+		t.Errorf("file scanned %d times, want once", clamd.Scans.Load())
+	}
+	if _, ok := store.Get(config.CleanBucket, "twice.txt"); !ok {
+		t.Error("file not moved to the clean bucket")
+	}
+}
+
+func TestProcessFileEventChangedWhileScanned(t *testing.T) {
+	store, clamd := setupPipeline(t)
+	store.Put(config.StagingBucket, "doc.txt", []byte("harmless"))
+	// The file is replaced with malware while the harmless version is scanned.
+	var replaced atomic.Bool
+	clamd.OnScan.Store(func() {
+		if !replaced.Swap(true) {
+			store.Put(config.StagingBucket, "doc.txt", []byte(clamavtest.EICAR))
+		}
+	})
+
+	if err := process(t, "doc.txt"); !errors.Is(err, errObjectChanged) {
+		t.Fatalf("processFileEvent returned %v, want %v", err, errObjectChanged)
+	}
+	if _, ok := store.Get(config.CleanBucket, "doc.txt"); ok {
+		t.Fatal("replaced file moved to the clean bucket under the verdict of the old content")
+	}
+	if data, _ := store.Get(config.StagingBucket, "doc.txt"); string(data) != clamavtest.EICAR {
+		t.Fatal("new content not left in the staging bucket")
+	}
+
+	// The retry scans the new content.
+	if err := process(t, "doc.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := store.Get(config.QuarantineBucket, "doc.txt"); !ok || string(data) != clamavtest.EICAR {
+		t.Error("new content not moved to quarantine")
+	}
+}
+
+// With the fs and minio consumers, replay-dlq processes dead-lettered events
+// itself, and an event failing again stays dead-lettered.
+func TestReplayDeadLettersProcessed(t *testing.T) {
+	m := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDRESS", m.Addr())
+	t.Setenv("DEAD_LETTER_TYPE", "redis")
+	t.Setenv("RETRY_MAX_ATTEMPTS", "1")
+	store, clamd := setupPipeline(t)
+
+	deadLetter := func(key string) {
+		value, err := json.Marshal(models.DeadLetterEvent{Bucket: config.StagingBucket, Key: url.QueryEscape(key), Error: "scan failed", Attempts: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Push(config.DeadLetterCfg.RedisKey, string(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Put(config.StagingBucket, "a.txt", []byte("hello"))
+	store.Put(config.StagingBucket, "changing.txt", []byte("hello"))
+	deadLetter("a.txt")
+	deadLetter("gone.txt") // Moved since, nothing left to do
+	deadLetter("changing.txt")
+	deadLetter("b.txt")
+	clamd.OnScan.Store(func() {
+		if _, ok := store.Get(config.StagingBucket, "changing.txt"); ok {
+			store.Put(config.StagingBucket, "changing.txt", []byte(logging.NewID()))
+		}
+	})
+
+	n, err := deadletter.Replay(context.Background(), config.DeadLetterCfg, 0, processDeadLetter)
+	if !errors.Is(err, errObjectChanged) || n != 2 {
+		t.Fatalf("Replay() = %d, %v, want 2 replayed and %v", n, err, errObjectChanged)
+	}
+	if _, ok := store.Get(config.CleanBucket, "a.txt"); !ok {
+		t.Error("replayed file not moved to the clean bucket")
+	}
+	left, err := m.List(config.DeadLetterCfg.RedisKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || !strings.Contains(left[0], "changing.txt") {
+		t.Errorf("dead-letter queue holds %v, want changing.txt and b.txt", left)
+	}
+}
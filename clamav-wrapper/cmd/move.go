@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"clamav-wrapper/routing"
+	"clamav-wrapper/storage"
+)
+
+// errObjectChanged is returned when an object no longer holds the content that
+// was scanned, because it was overwritten on a bucket without versioning.
+var errObjectChanged = errors.New("object changed since it was scanned")
+
+// statScanned returns the current state of the scanned version of an object,
+// or errObjectChanged if its ETag or size differ from scanned.
+func statScanned(ctx context.Context, bucket, key string, scanned storage.ObjectInfo) (storage.ObjectInfo, error) {
+	obj, err := objectStore.StatObject(ctx, bucket, key, scanned.VersionID)
+	if err != nil {
+		return obj, err
+	}
+	if obj.Size != scanned.Size || (scanned.ETag != "" && obj.ETag != scanned.ETag) {
+		return obj, fmt.Errorf("%w: size %d, ETag %q; scanned %d, %q", errObjectChanged, obj.Size, obj.ETag, scanned.Size, scanned.ETag)
+	}
+	return obj, nil
+}
+
+// copyObject copies the scanned version of an object to its destination unless
+// the destination already holds a copy of it, left by an earlier attempt whose
+// delete failed, and verifies the copy. Only then may the source be deleted.
+// The source bucket, key, ETag and version are recorded in the metadata of
+// annotated copies.
+func copyObject(ctx context.Context, logger *slog.Logger, bucket, key string, scanned storage.ObjectInfo, targetBucket, targetKey string, annotation *storage.ScanInfo) error {
+	src, err := statScanned(ctx, bucket, key, scanned)
+	if err != nil {
+		return err
+	}
+	if annotation != nil {
+		annotation.SourceBucket, annotation.SourceKey = bucket, key
+		annotation.SourceETag, annotation.SourceVersion = src.ETag, src.VersionID
+	}
+
+	dest, err := objectStore.StatObject(ctx, targetBucket, targetKey, "")
+	switch {
+	case err == nil && isCopyOf(dest, src, bucket, false):
+		logger.InfoContext(ctx, "Destination already holds a copy of the file, not copying it again")
+		return nil
+	case err != nil && !errors.Is(err, storage.ErrNotFound):
+		return fmt.Errorf("failed to check destination: %w", err)
+	}
+
+	if err := objectStore.CopyObject(ctx, bucket, key, src.VersionID, targetBucket, targetKey, annotation); err != nil {
+		return err
+	}
+	if dest, err = objectStore.StatObject(ctx, targetBucket, targetKey, ""); err != nil {
+		return fmt.Errorf("failed to verify copy: %w", err)
+	}
+	if !isCopyOf(dest, src, bucket, true) {
+		return fmt.Errorf("copy in %s/%s does not match the source (size %d, ETag %q; expected %d, %q)",
+			targetBucket, targetKey, dest.Size, dest.ETag, src.Size, src.ETag)
+	}
+	return nil
+}
+
+// isCopyOf reports whether dest is a copy of src, found in srcBucket. The sizes
+// must match, and so must the source (and version) recorded in dest's metadata
+// or else the ETags. When neither can be compared (no metadata, and ETags that are missing
+// or of multipart uploads, which differ between copies of the same content),
+// matching sizes are enough only if sizeOnly is true.
+func isCopyOf(dest, src storage.ObjectInfo, srcBucket string, sizeOnly bool) bool {
+	if dest.Size != src.Size {
+		return false
+	}
+	if source := dest.Metadata[storage.MetaSource]; source != "" {
+		if source != srcBucket+"/"+url.QueryEscape(src.Key) {
+			return false
+		}
+		if version := dest.Metadata[storage.MetaSourceVersion]; version != "" && version != src.VersionID {
+			return false
+		}
+		etag := dest.Metadata[storage.MetaSourceETag]
+		return etag == "" || etag == src.ETag
+	}
+	if comparableETag(dest.ETag) && comparableETag(src.ETag) {
+		return dest.ETag == src.ETag
+	}
+	return sizeOnly
+}
+
+// comparableETag reports whether etag identifies the content: single-part
+// uploads and copies have the MD5 of the content as ETag, multipart uploads
+// "<hash of the part hashes>-<parts>".
+func comparableETag(etag string) bool {
+	return etag != "" && !strings.Contains(etag, "-")
+}
+
+// findProcessed looks for the copy of an object no longer in the staging
+// bucket among its possible destinations, and logs what it found. Routing
+// rules using .Verdict, .SHA256 or .Time in keys may hide the copy.
+func findProcessed(ctx context.Context, logger *slog.Logger, bucket, key string) {
+	source := bucket + "/" + url.QueryEscape(key)
+	obj := routing.Object{Bucket: bucket, Key: key, Time: time.Now().UTC()}
+	for _, target := range []routing.Target{routing.Clean, routing.Quarantine, routing.Unscanned} {
+		targetBucket, targetKey, err := router.Resolve(target, obj)
+		if err != nil {
+			continue
+		}
+		dest, err := objectStore.StatObject(ctx, targetBucket, targetKey, "")
+		if err == nil && dest.Metadata[storage.MetaSource] == source {
+			logger.InfoContext(ctx, "File was already processed",
+				"target_bucket", targetBucket, "target_key", targetKey, "verdict", dest.Metadata[storage.TagVerdict])
+			return
+		}
+	}
+	logger.WarnContext(ctx, "File no longer exists, nothing to do")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"clamav-wrapper/clamav"
+	"clamav-wrapper/config"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/metrics"
+	"clamav-wrapper/rescan"
+	"clamav-wrapper/routing"
+	"clamav-wrapper/storage"
+)
+
+// watchSignatures tracks the signature database version of clamd until ctx is
+// cancelled and, with RESCAN_ON_SIGNATURE_UPDATE, rescans the objects of the
+// clean buckets modified within RESCAN_WINDOW_HOURS whenever it changes.
+func watchSignatures(ctx context.Context) {
+	rescan.Watch(ctx, config.RescanCfg.CheckInterval, clamav.RefreshVersion, func(ctx context.Context, previous, current *clamav.VersionInfo) {
+		if !config.RescanCfg.OnUpdate || config.ScanAction != "move" {
+			return
+		}
+		buckets := router.Buckets(routing.Clean)
+		since := time.Now().Add(-config.RescanCfg.Window)
+		slog.Info("Rescanning the clean buckets with the new signatures", "buckets", buckets, "since", since, "database", current.Database)
+		n, failed, err := rescan.Run(ctx, objectStore, buckets, since, config.RescanCfg.Concurrency, rescanObject)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Rescanning the clean buckets failed", "buckets", buckets, "rescanned", n, "failed", failed, "error", err)
+			return
+		}
+		slog.Info("Rescanned the clean buckets", "buckets", buckets, "rescanned", n, "failed", failed, "database", current.Database)
+	})
+}
+
+// rescanObject scans an object of a clean bucket again. If the current
+// signatures find it infected, it is moved to quarantine as routing rules say
+// for the staging object it was copied from, and an alert is published as a
+// scan result with Rescan set. Objects too large to scan, or gone meanwhile,
+// are left alone.
+func rescanObject(ctx context.Context, bucket string, listed storage.ObjectInfo) error {
+	ctx = logging.WithCorrelationID(ctx, "rescan-"+logging.NewID())
+	key := listed.Key
+	logger := slog.With("bucket", bucket, "key", key)
+	objectAttrs := []attribute.KeyValue{attribute.String("bucket", bucket), attribute.String("key", key)}
+
+	return traced(ctx, "rescan", objectAttrs, func(ctx context.Context) error {
+		result, _, obj, err := scanObject(ctx, logger, bucket, key, "", objectAttrs)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return nil
+		case errors.Is(err, clamav.ErrFileTooLarge):
+			logger.DebugContext(ctx, "File too large to rescan", "size", obj.Size)
+			return nil
+		case err != nil:
+			metrics.FilesRescanned.WithLabelValues("error").Inc()
+			return err
+		case result.IsClean():
+			metrics.FilesRescanned.WithLabelValues("clean").Inc()
+			logger.DebugContext(ctx, "File is still clean")
+			return nil
+		}
+		metrics.FilesRescanned.WithLabelValues("infected").Inc()
+		logger = logger.With("verdict", result.Verdict, "signature", result.Signature)
+		logger.WarnContext(ctx, "File in a clean bucket is infected according to the new signatures, moving it to quarantine")
+
+		// Once found, the file is moved even if the service is shutting down.
+		ctx = context.WithoutCancel(ctx)
+		scannedAt := time.Now().UTC()
+		info := storage.ScanInfo{
+			Verdict:   string(result.Verdict),
+			Signature: result.Signature,
+			ScannedAt: scannedAt,
+			Instance:  config.ScannerInstanceID,
+		}
+		if result.Version != nil {
+			info.Engine = result.Version.Engine
+			info.Database = result.Version.Database
+		}
+		targetBucket, targetKey, err := quarantineDestination(ctx, bucket, key, obj, result, scannedAt)
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to route file", "error", err)
+			return err
+		}
+		logger = logger.With("target_bucket", targetBucket, "target_key", targetKey)
+
+		err = copyObject(ctx, logger, bucket, key, obj, targetBucket, targetKey, &info)
+		if errors.Is(err, storage.ErrNotFound) {
+			logger.InfoContext(ctx, "File no longer exists, nothing to do")
+			return nil
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to move file to quarantine", "error", err)
+			return err
+		}
+
+		event := resultEvent(bucket, key, obj, result, "", targetBucket, targetKey, scannedAt)
+		event.Rescan = true
+		if err := publishResult(ctx, event); err != nil {
+			return err
+		}
+
+		versionID := obj.VersionID
+		if versionID == "" {
+			// Without versions, deleting would also remove content moved there since.
+			if _, err := statScanned(ctx, bucket, key, obj); err != nil {
+				if errors.Is(err, errObjectChanged) || errors.Is(err, storage.ErrNotFound) {
+					logger.WarnContext(ctx, "File was replaced after it was copied to quarantine, leaving the new content", "error", err)
+					return nil
+				}
+				return err
+			}
+		}
+		if err := objectStore.DeleteObject(ctx, bucket, key, versionID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logger.ErrorContext(ctx, "Failed to delete file from the clean bucket", "error", err)
+			return err
+		}
+		logger.WarnContext(ctx, "Previously clean file moved to quarantine")
+		return nil
+	})
+}
+
+// quarantineDestination returns where an object of a clean bucket found
+// infected goes. Routing rules match staging objects, so they are applied to
+// the source bucket and key recorded on the copy, which clean-bucket keys
+// already rewritten by a template would not match. Without that record, the
+// object goes to the default quarantine bucket under the same key.
+func quarantineDestination(ctx context.Context, bucket, key string, obj storage.ObjectInfo, result *clamav.ScanResult, scannedAt time.Time) (string, string, error) {
+	metadata := obj.Metadata
+	if metadata == nil {
+		// Downloads do not carry the metadata of the object.
+		stat, err := objectStore.StatObject(ctx, bucket, key, obj.VersionID)
+		if err != nil {
+			return "", "", err
+		}
+		metadata = stat.Metadata
+	}
+
+	sourceBucket, sourceKey, ok := strings.Cut(metadata[storage.MetaSource], "/")
+	if ok {
+		sourceKey, err := url.QueryUnescape(sourceKey)
+		if err == nil && sourceBucket != "" && sourceKey != "" {
+			return router.Resolve(routing.Quarantine, routing.Object{
+				Bucket:  sourceBucket,
+				Key:     sourceKey,
+				Verdict: string(result.Verdict),
+				SHA256:  result.SHA256,
+				Time:    scannedAt,
+			})
+		}
+	}
+	return config.QuarantineBucket, key, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/routing"
+	"clamav-wrapper/storage"
+)
+
+// A file of a clean bucket that new signatures find infected is quarantined
+// where the routing rules send the staging file it was copied from.
+func TestRescanObjectRouting(t *testing.T) {
+	store, clamd := setupPipeline(t)
+	rules := filepath.Join(t.TempDir(), "routing.yaml")
+	err := os.WriteFile(rules, []byte(`rules:
+  - bucket: staging
+    prefix: product-a/
+    clean:
+      bucket: product-a-clean
+      key: 'scanned/{{.Rel}}'
+    quarantine:
+      bucket: product-a-quarantine
+      prefix: q/
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if router, err = routing.New(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Put(config.StagingBucket, "product-a/report.txt", []byte("harmless for now"))
+	if err := process(t, "product-a/report.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get("product-a-clean", "scanned/report.txt"); !ok {
+		t.Fatal("file not moved to the clean bucket of its rule")
+	}
+	// Copied without the record of its source, e.g. by hand.
+	store.Put(config.CleanBucket, "scanned/other.txt", []byte("harmless for now"))
+
+	clamd.Pattern.Store("harmless")
+	tests := []struct {
+		bucket, key         string
+		wantBucket, wantKey string
+	}{
+		{bucket: "product-a-clean", key: "scanned/report.txt", wantBucket: "product-a-quarantine", wantKey: "q/product-a/report.txt"},
+		{bucket: config.CleanBucket, key: "scanned/other.txt", wantBucket: config.QuarantineBucket, wantKey: "scanned/other.txt"},
+	}
+	for _, tt := range tests {
+		obj, err := store.StatObject(context.Background(), tt.bucket, tt.key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rescanObject(context.Background(), tt.bucket, obj); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := store.Get(tt.bucket, tt.key); ok {
+			t.Errorf("%s/%s left in the clean bucket", tt.bucket, tt.key)
+		}
+		if _, ok := store.Get(tt.wantBucket, tt.wantKey); !ok {
+			t.Errorf("%s/%s not moved to %s/%s", tt.bucket, tt.key, tt.wantBucket, tt.wantKey)
+			continue
+		}
+		if got := store.Metadata(tt.wantBucket, tt.wantKey)[storage.MetaSource]; got != tt.bucket+"/"+url.QueryEscape(tt.key) {
+			t.Errorf("quarantined copy records source %q", got)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBucketLists(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string][]string
+	}{
+		{in: "", want: map[string][]string{}},
+		{in: "image/*,Application/PDF", want: map[string][]string{"*": {"image/*", "application/pdf"}}},
+		{
+			in:   "Uploads=image/PNG, text/plain ; avatars=image/png;*=text/plain",
+			want: map[string][]string{"Uploads": {"image/png", "text/plain"}, "avatars": {"image/png"}, "*": {"text/plain"}},
+		},
+		{in: "docs=application/pdf;docs=text/plain", want: map[string][]string{"docs": {"application/pdf", "text/plain"}}},
+	}
+	for _, tt := range tests {
+		if got := parseBucketLists(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseBucketLists(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/models"
+	"clamav-wrapper/tracing"
+	"clamav-wrapper/worker"
+)
+
+// AMQPConsumer implements the MessageConsumer interface for RabbitMQ and other
+// AMQP 0.9.1 brokers. Messages are acknowledged manually once every record in
+// them was processed successfully, and returned to the queue otherwise, after
+// RequeueDelay so that a failing message is not redelivered at once, over and
+// over. At most Prefetch messages are delivered to an instance without being
+// acknowledged.
+type AMQPConsumer struct {
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	pool     *worker.Pool
+	cfg      config.AMQPConfig
+	filter   *eventFilter
+	failures failureCounter
+}
+
+// amqpMaxTracked bounds the failing messages whose deliveries an instance counts.
+const amqpMaxTracked = 10000
+
+// failureCounter counts the failed deliveries of messages by ID, for queues
+// that do not count deliveries themselves. The least recently failed messages
+// are forgotten beyond amqpMaxTracked.
+type failureCounter struct {
+	mu     sync.Mutex
+	counts *lru.Cache[string, int]
+}
+
+// add records a failed delivery of the message id and returns how many were seen.
+func (f *failureCounter) add(id string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.counts == nil {
+		f.counts, _ = lru.New[string, int](amqpMaxTracked)
+	}
+	n, _ := f.counts.Get(id)
+	n++
+	f.counts.Add(id, n)
+	return n
+}
+
+// forget drops the count of a message that was settled for good.
+func (f *failureCounter) forget(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.counts != nil {
+		f.counts.Remove(id)
+	}
+}
+
+// NewAMQPConsumer connects to the broker and sets the prefetch count. With an
+// exchange configured, the queue is declared and bound to it; otherwise it
+// must exist.
+func NewAMQPConsumer(cfg config.AMQPConfig, pool *worker.Pool) (*AMQPConsumer, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("worker pool cannot be nil for AMQPConsumer")
+	}
+
+	conn, err := amqp.Dial(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to AMQP broker: %w", err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open AMQP channel: %w", err)
+	}
+	if err := ch.Qos(cfg.Prefetch, 0, false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set AMQP prefetch count: %w", err)
+	}
+	if cfg.Exchange != "" {
+		if _, err := ch.QueueDeclare(cfg.Queue, true, false, false, false, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to declare AMQP queue %s: %w", cfg.Queue, err)
+		}
+		if err := ch.QueueBind(cfg.Queue, cfg.RoutingKey, cfg.Exchange, false, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to bind AMQP queue %s to exchange %s: %w", cfg.Queue, cfg.Exchange, err)
+		}
+	}
+
+	slog.Info("Successfully connected to AMQP broker", "queue", cfg.Queue, "prefetch", cfg.Prefetch)
+
+	return &AMQPConsumer{
+		conn:    conn,
+		channel: ch,
+		pool:    pool,
+		cfg:     cfg,
+		filter:  newEventFilter(config.EventFilterCfg),
+	}, nil
+}
+
+// StartConsumer consumes the queue and submits the records of every message to
+// the worker pool. Submitting blocks while all workers are busy; the broker
+// stops delivering once Prefetch messages are unacknowledged.
+// This method blocks until ctx is cancelled, in which case it cancels the
+// subscription and returns nil, or until the connection is lost. Messages
+// delivered but not processed are returned to the queue when the channel is
+// closed.
+func (ac *AMQPConsumer) StartConsumer(ctx context.Context) error {
+	deliveries, err := ac.channel.Consume(ac.cfg.Queue, ac.cfg.ConsumerTag, false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to consume AMQP queue %s: %w", ac.cfg.Queue, err)
+	}
+	closed := ac.channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	slog.Info("Subscribed to AMQP queue", "queue", ac.cfg.Queue, "consumer_tag", ac.cfg.ConsumerTag)
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := ac.channel.Cancel(ac.cfg.ConsumerTag, false); err != nil {
+				slog.Warn("Failed to cancel AMQP subscription", "error", err)
+			}
+			return nil // Shutting down
+		case d, ok := <-deliveries:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				var reason error = errors.New("delivery channel closed")
+				if amqpErr := <-closed; amqpErr != nil {
+					reason = amqpErr
+				}
+				slog.Error("AMQP channel closed", "error", reason)
+				return fmt.Errorf("AMQP channel closed: %w", reason)
+			}
+			if err := ac.submitDelivery(ctx, d); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
+
+// submitDelivery submits every record of a message that passes the event
+// filter to the worker pool. The message is acknowledged once they were all
+// processed, or right away if it can never be processed (malformed, or without
+// such records), and handed to requeue if one of them failed. Its message ID,
+// or else a hash of its body, forms the correlation ID of its events.
+func (ac *AMQPConsumer) submitDelivery(ctx context.Context, d amqp.Delivery) (err error) {
+	id := d.MessageId
+	if id == "" {
+		id = "amqp-" + logging.HashID(d.Body)
+	}
+	ctx, span := startDequeue(ctx, id,
+		attribute.String("messaging.destination.name", ac.cfg.Queue),
+		attribute.String("messaging.rabbitmq.destination.routing_key", d.RoutingKey),
+		attribute.Bool("messaging.rabbitmq.redelivered", d.Redelivered),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	var event models.NotificationEvent
+	if err := json.Unmarshal(d.Body, &event); err != nil {
+		slog.WarnContext(ctx, "Invalid event message, skipping it", "queue", ac.cfg.Queue, "error", err)
+		ac.ack(ctx, d)
+		return nil
+	}
+
+	var records []models.S3Record
+	for _, record := range event.Records {
+		if ac.filter.accept(ctx, record) {
+			records = append(records, record)
+		}
+	}
+
+	return submitRecords(ctx, ac.pool, records, func(err error) {
+		switch {
+		case err == nil:
+			ac.failures.forget(id)
+			ac.ack(ctx, d)
+		case errors.Is(err, worker.ErrClosed) || ctx.Err() != nil:
+			// Not processed because of shutdown: let another instance have it now.
+			ac.nack(ctx, d, true)
+		default:
+			ac.requeue(ctx, d, id, err)
+		}
+	})
+}
+
+// requeue returns a message that failed to the queue once RequeueDelay has
+// passed, meanwhile counting against Prefetch, which also slows down
+// consumption while messages keep failing. Once it was delivered MaxDeliveries
+// times, the message is rejected instead, and dead-lettered by the broker if
+// the queue has a dead-letter exchange. Quorum queues count deliveries in the
+// x-delivery-count header; classic queues do not, so the instance also counts
+// the failed deliveries of message id it saw itself.
+func (ac *AMQPConsumer) requeue(ctx context.Context, d amqp.Delivery, id string, err error) {
+	deliveries := max(deliveryCount(d), ac.failures.add(id))
+	if ac.cfg.MaxDeliveries > 0 && deliveries >= ac.cfg.MaxDeliveries {
+		slog.ErrorContext(ctx, "Error processing message from AMQP, delivery limit reached, rejecting it", "queue", ac.cfg.Queue, "deliveries", deliveries, "error", err)
+		ac.failures.forget(id)
+		ac.nack(ctx, d, false)
+		return
+	}
+	slog.ErrorContext(ctx, "Error processing message from AMQP, returning it to the queue", "queue", ac.cfg.Queue, "deliveries", deliveries, "delay", ac.cfg.RequeueDelay.String(), "error", err)
+	time.AfterFunc(ac.cfg.RequeueDelay, func() { ac.nack(ctx, d, true) })
+}
+
+// deliveryCount returns how often d was delivered, this delivery included,
+// according to its x-delivery-count header; 1 without the header.
+func deliveryCount(d amqp.Delivery) int {
+	switch n := d.Headers["x-delivery-count"].(type) {
+	case int64:
+		return int(n) + 1
+	case int32:
+		return int(n) + 1
+	case int16:
+		return int(n) + 1
+	case int:
+		return n + 1
+	}
+	return 1
+}
+
+// nack returns d to the queue, or has the broker drop or dead-letter it.
+// Messages still unacknowledged when the channel closes are returned by the
+// broker anyway.
+func (ac *AMQPConsumer) nack(ctx context.Context, d amqp.Delivery, requeue bool) {
+	if err := d.Nack(false, requeue); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		slog.ErrorContext(ctx, "Failed to negatively acknowledge AMQP message", "queue", ac.cfg.Queue, "requeue", requeue, "error", err)
+	}
+}
+
+func (ac *AMQPConsumer) ack(ctx context.Context, d amqp.Delivery) {
+	if err := d.Ack(false); err != nil {
+		slog.ErrorContext(ctx, "Failed to acknowledge AMQP message", "queue", ac.cfg.Queue, "error", err)
+	}
+}
+
+// Ping reports whether the connection and channel to the broker are open.
+func (ac *AMQPConsumer) Ping(ctx context.Context) error {
+	if ac.conn.IsClosed() || ac.channel.IsClosed() {
+		return errors.New("AMQP connection closed")
+	}
+	return nil
+}
+
+// Lag returns the number of messages ready in the queue. It is read on a
+// channel of its own, as a failed passive declare closes its channel.
+func (ac *AMQPConsumer) Lag(ctx context.Context) (int64, error) {
+	ch, err := ac.conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	q, err := ch.QueueDeclarePassive(ac.cfg.Queue, true, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+	return int64(q.Messages), nil
+}
+
+// Close closes the channel, returning messages delivered but not acknowledged
+// to the queue, and the connection.
+func (ac *AMQPConsumer) Close() error {
+	slog.Info("Closing AMQP consumer connection")
+	if err := ac.channel.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		ac.conn.Close()
+		return err
+	}
+	if err := ac.conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return nil
+}
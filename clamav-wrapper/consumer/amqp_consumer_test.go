@@ -0,0 +1,177 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/models"
+	"clamav-wrapper/worker"
+)
+
+// eventBody returns the body of a notification about keys of the staging bucket.
+func eventBody(t *testing.T, keys ...string) []byte {
+	t.Helper()
+	var event models.NotificationEvent
+	for _, key := range keys {
+		record := models.NewS3Record("staging", key)
+		record.EventName = "s3:ObjectCreated:Put"
+		event.Records = append(event.Records, record)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// startPool starts a worker pool running handler, shut down at the end of the test.
+func startPool(t *testing.T, handler worker.Handler) *worker.Pool {
+	t.Helper()
+	pool, err := worker.NewPool(config.WorkerConfig{Concurrency: 4}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// fakeAcknowledger stands in for the AMQP channel a delivery is settled on.
+type fakeAcknowledger struct {
+	settled chan string // "ack", "requeue" or "reject"
+}
+
+func newFakeAcknowledger() *fakeAcknowledger {
+	return &fakeAcknowledger{settled: make(chan string, 10)}
+}
+
+func (f *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	f.settled <- "ack"
+	return nil
+}
+
+func (f *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	if requeue {
+		f.settled <- "requeue"
+	} else {
+		f.settled <- "reject"
+	}
+	return nil
+}
+
+func (f *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return f.Nack(tag, false, requeue)
+}
+
+// next waits for the delivery to be settled.
+func (f *fakeAcknowledger) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case s := <-f.settled:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery was not settled")
+		return ""
+	}
+}
+
+func TestAMQPSubmitDelivery(t *testing.T) {
+	errScan := errors.New("scan failed")
+	pool := startPool(t, func(ctx context.Context, bucket, key, versionID string) error {
+		if key == "bad.txt" {
+			return errScan
+		}
+		return nil
+	})
+	cfg := config.AMQPConfig{Queue: "scan", RequeueDelay: 200 * time.Millisecond, MaxDeliveries: 3}
+	ac := &AMQPConsumer{pool: pool, cfg: cfg, filter: newEventFilter(config.EventFilterConfig{Types: []string{"s3:ObjectCreated:*"}})}
+
+	tests := []struct {
+		name     string
+		body     []byte
+		headers  amqp.Table
+		want     string
+		minDelay time.Duration
+	}{
+		{name: "processed", body: eventBody(t, "a.txt", "b.txt"), want: "ack"},
+		{name: "malformed", body: []byte("not json"), want: "ack"},
+		{name: "no records", body: eventBody(t), want: "ack"},
+		{name: "failed", body: eventBody(t, "a.txt", "bad.txt"), want: "requeue", minDelay: cfg.RequeueDelay},
+		{name: "failed again", body: eventBody(t, "bad.txt"), headers: amqp.Table{"x-delivery-count": int64(1)}, want: "requeue", minDelay: cfg.RequeueDelay},
+		{name: "delivery limit", body: eventBody(t, "bad.txt"), headers: amqp.Table{"x-delivery-count": int64(2)}, want: "reject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := newFakeAcknowledger()
+			d := amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Headers: tt.headers, Body: tt.body}
+			start := time.Now()
+			if err := ac.submitDelivery(context.Background(), d); err != nil {
+				t.Fatal(err)
+			}
+			got := ack.next(t)
+			if delay := time.Since(start); delay < tt.minDelay {
+				t.Errorf("delivery settled after %s, want at least %s", delay, tt.minDelay)
+			}
+			if got != tt.want {
+				t.Errorf("delivery settled with %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Classic queues do not count deliveries: the consumer counts the failures of
+// a message itself, by message ID.
+func TestAMQPSubmitDeliveryClassicQueue(t *testing.T) {
+	pool := startPool(t, func(ctx context.Context, bucket, key, versionID string) error { return errors.New("scan failed") })
+	ac := &AMQPConsumer{pool: pool, cfg: config.AMQPConfig{Queue: "scan", MaxDeliveries: 3}, filter: newEventFilter(config.EventFilterConfig{Types: []string{"s3:*"}})}
+
+	for i, want := range []string{"requeue", "requeue", "reject", "requeue"} {
+		ack := newFakeAcknowledger()
+		d := amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, MessageId: "m1", Redelivered: i > 0, Body: eventBody(t, "bad.txt")}
+		if err := ac.submitDelivery(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+		// Once rejected, the count starts over for a message published again.
+		if got := ack.next(t); got != want {
+			t.Errorf("delivery %d settled with %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestAMQPSubmitDeliveryClosedPool(t *testing.T) {
+	pool := startPool(t, func(ctx context.Context, bucket, key, versionID string) error { return nil })
+	pool.Close()
+	ac := &AMQPConsumer{pool: pool, cfg: config.AMQPConfig{Queue: "scan", RequeueDelay: time.Hour}, filter: newEventFilter(config.EventFilterConfig{Types: []string{"s3:*"}})}
+
+	ack := newFakeAcknowledger()
+	d := amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Body: eventBody(t, "a.txt")}
+	if err := ac.submitDelivery(context.Background(), d); !errors.Is(err, worker.ErrClosed) {
+		t.Fatalf("submitDelivery returned %v, want %v", err, worker.ErrClosed)
+	}
+	// Returned at once for another instance, not after RequeueDelay.
+	if got := ack.next(t); got != "requeue" {
+		t.Errorf("delivery settled with %s, want requeue", got)
+	}
+}
+
+func TestDeliveryCount(t *testing.T) {
+	for _, tt := range []struct {
+		headers amqp.Table
+		want    int
+	}{
+		{nil, 1},
+		{amqp.Table{"x-delivery-count": int64(0)}, 1},
+		{amqp.Table{"x-delivery-count": int64(4)}, 5},
+		{amqp.Table{"x-delivery-count": int32(2)}, 3},
+		{amqp.Table{"x-delivery-count": "4"}, 1},
+	} {
+		if got := deliveryCount(amqp.Delivery{Headers: tt.headers}); got != tt.want {
+			t.Errorf("deliveryCount(%v) = %d, want %d", tt.headers, got, tt.want)
+		}
+	}
+}
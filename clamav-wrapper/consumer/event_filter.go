@@ -0,0 +1,88 @@
+package consumer
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/metrics"
+	"clamav-wrapper/models"
+)
+
+// eventFilter decides which records of bucket notifications are scanned.
+// Only the creation of objects needs a scan: removals would fail for want of
+// the object, and metadata changes such as tagging leave the content as it
+// was. Records without an event name, such as those replayed from the
+// dead-letter queue, always pass the event type check.
+type eventFilter struct {
+	cfg config.EventFilterConfig
+}
+
+func newEventFilter(cfg config.EventFilterConfig) *eventFilter {
+	return &eventFilter{cfg: cfg}
+}
+
+// accept reports whether record should be scanned, and logs why not otherwise.
+func (f *eventFilter) accept(ctx context.Context, record models.S3Record) bool {
+	if !f.acceptType(record.EventName) {
+		slog.DebugContext(ctx, "Skipping event of an unwanted type", "event", record.EventName, "bucket", record.S3.Bucket.Name, "key", record.S3.Object.Key)
+		metrics.EventsSkipped.WithLabelValues("event-type").Inc()
+		return false
+	}
+	if !f.acceptKey(record.S3.Object.Key) {
+		slog.DebugContext(ctx, "Skipping event for a key outside the configured prefixes and suffixes", "bucket", record.S3.Bucket.Name, "key", record.S3.Object.Key)
+		metrics.EventsSkipped.WithLabelValues("key").Inc()
+		return false
+	}
+	return true
+}
+
+// acceptType matches an event name against the configured patterns. AWS
+// names events without the "s3:" prefix MinIO and the patterns use.
+func (f *eventFilter) acceptType(name string) bool {
+	if name == "" {
+		return true
+	}
+	if !strings.HasPrefix(name, "s3:") {
+		name = "s3:" + name
+	}
+	return matchEvent(f.cfg.Types, name) && !matchEvent(f.cfg.ExcludeTypes, name)
+}
+
+// acceptKey matches the decoded object key against the configured prefixes
+// and suffixes; an empty list accepts every key.
+func (f *eventFilter) acceptKey(keyEncoded string) bool {
+	if len(f.cfg.Prefixes) == 0 && len(f.cfg.Suffixes) == 0 {
+		return true
+	}
+	key, err := url.QueryUnescape(keyEncoded)
+	if err != nil {
+		key = keyEncoded
+	}
+	return matchAffix(f.cfg.Prefixes, key, strings.HasPrefix) && matchAffix(f.cfg.Suffixes, key, strings.HasSuffix)
+}
+
+// matchEvent reports whether name matches one of patterns, e.g. "s3:ObjectCreated:*".
+func matchEvent(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAffix(affixes []string, key string, has func(s, affix string) bool) bool {
+	if len(affixes) == 0 {
+		return true
+	}
+	for _, affix := range affixes {
+		if has(key, affix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,324 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.opentelemetry.io/otel/attribute"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/tracing"
+	"clamav-wrapper/worker"
+)
+
+// FSConsumer implements the MessageConsumer interface for a local directory.
+// It watches the staging bucket directory of the filesystem storage backend
+// (and every directory below it) with inotify and submits a file event for each
+// file once it has stopped changing for the configured settle time, so files
+// still being written are not scanned half-way.
+type FSConsumer struct {
+	watcher *fsnotify.Watcher
+	dir     string // Directory of the staging bucket
+	bucket  string
+	pool    *worker.Pool
+	cfg     config.FSConsumerConfig
+
+	mu       sync.Mutex
+	pending  map[string]fileState // Files waiting to settle, by path
+	inFlight map[string]bool      // Files submitted to the pool and not done yet
+	handled  map[string]fileState // Files processed but still present (failed, dead-lettered or tagged in place)
+}
+
+// fileState identifies a version of a file; a change means it is being written to.
+type fileState struct {
+	size    int64
+	modTime time.Time
+	seen    time.Time // When the state was last observed to change
+}
+
+func (s fileState) sameFile(o fileState) bool {
+	return s.size == o.size && s.modTime.Equal(o.modTime)
+}
+
+// NewFSConsumer creates a consumer for the directory dir, which holds the
+// objects of bucket. The directory must exist.
+func NewFSConsumer(cfg config.FSConsumerConfig, dir, bucket string, pool *worker.Pool) (*FSConsumer, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("worker pool cannot be nil for FSConsumer")
+	}
+	if cfg.SettleTime <= 0 {
+		return nil, fmt.Errorf("settle time must be positive, got %s", cfg.SettleTime)
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("cannot watch %s: %w", dir, err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("cannot watch %s: not a directory", dir)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inotify watcher: %w", err)
+	}
+
+	return &FSConsumer{
+		watcher:  watcher,
+		dir:      dir,
+		bucket:   bucket,
+		pool:     pool,
+		cfg:      cfg,
+		pending:  make(map[string]fileState),
+		inFlight: make(map[string]bool),
+		handled:  make(map[string]fileState),
+	}, nil
+}
+
+// StartConsumer watches the directory until ctx is cancelled. Files already
+// present when it starts are picked up too, and the whole tree is swept again
+// every RescanInterval to catch events the kernel dropped.
+func (fc *FSConsumer) StartConsumer(ctx context.Context) error {
+	slog.Info("Watching directory for new files", "dir", fc.dir, "bucket", fc.bucket)
+	fc.sweep()
+
+	settle := time.NewTicker(max(fc.cfg.SettleTime/2, 10*time.Millisecond))
+	defer settle.Stop()
+
+	var rescan <-chan time.Time
+	if fc.cfg.RescanInterval > 0 {
+		t := time.NewTicker(fc.cfg.RescanInterval)
+		defer t.Stop()
+		rescan = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-fc.watcher.Events:
+			if !ok {
+				return nil // Watcher closed by Close
+			}
+			fc.handleEvent(event)
+		case err, ok := <-fc.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// Typically an inotify queue overflow; the next sweep finds what was missed.
+			slog.Error("Error watching directory", "dir", fc.dir, "error", err)
+		case <-rescan:
+			fc.sweep()
+		case <-settle.C:
+			if err := fc.submitSettled(ctx); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
+
+func (fc *FSConsumer) handleEvent(event fsnotify.Event) {
+	switch {
+	case event.Has(fsnotify.Create):
+		fi, err := os.Lstat(event.Name)
+		if err != nil {
+			return // Already gone
+		}
+		if fi.IsDir() {
+			// New directories (e.g. created by mkdir -p or moved in) are watched
+			// and swept, since files may have been created before the watch was added.
+			fc.walk(event.Name)
+			return
+		}
+		fc.observe(event.Name, fi)
+	case event.Has(fsnotify.Write):
+		if fi, err := os.Lstat(event.Name); err == nil {
+			fc.observe(event.Name, fi)
+		}
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		fc.mu.Lock()
+		delete(fc.pending, event.Name)
+		delete(fc.handled, event.Name)
+		fc.mu.Unlock()
+	}
+	// Chmod events (including extended attributes set when tagging in place) are ignored.
+}
+
+// sweep watches every directory of the tree and observes every file in it.
+func (fc *FSConsumer) sweep() {
+	fc.mu.Lock()
+	for path := range fc.handled {
+		if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+			delete(fc.handled, path)
+		}
+	}
+	fc.mu.Unlock()
+
+	fc.walk(fc.dir)
+}
+
+func (fc *FSConsumer) walk(root string) {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Error("Error walking directory", "path", path, "error", err)
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && ignoredName(d.Name()) {
+				return filepath.SkipDir
+			}
+			if err := fc.watcher.Add(path); err != nil {
+				slog.Error("Failed to watch directory", "path", path, "error", err)
+			}
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			fc.observe(path, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error walking directory", "path", root, "error", err)
+	}
+}
+
+// observe records the current state of a file. A file that changed (or is new)
+// starts waiting to settle again.
+func (fc *FSConsumer) observe(path string, fi fs.FileInfo) {
+	if !fi.Mode().IsRegular() || ignoredName(fi.Name()) {
+		return
+	}
+	state := fileState{size: fi.Size(), modTime: fi.ModTime(), seen: time.Now()}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.inFlight[path] {
+		return
+	}
+	if prev, ok := fc.handled[path]; ok {
+		if prev.sameFile(state) {
+			return
+		}
+		delete(fc.handled, path)
+	}
+	if prev, ok := fc.pending[path]; ok && prev.sameFile(state) {
+		return
+	}
+	fc.pending[path] = state
+}
+
+// submitSettled submits every pending file that has not changed for SettleTime.
+func (fc *FSConsumer) submitSettled(ctx context.Context) error {
+	now := time.Now()
+	var ready []string
+
+	fc.mu.Lock()
+	for path, state := range fc.pending {
+		if now.Sub(state.seen) < fc.cfg.SettleTime {
+			continue
+		}
+		fi, err := os.Lstat(path)
+		if err != nil {
+			delete(fc.pending, path)
+			continue
+		}
+		current := fileState{size: fi.Size(), modTime: fi.ModTime(), seen: now}
+		if !current.sameFile(state) {
+			fc.pending[path] = current // Written to without an event reaching us yet
+			continue
+		}
+		delete(fc.pending, path)
+		fc.inFlight[path] = true
+		ready = append(ready, path)
+	}
+	fc.mu.Unlock()
+
+	for i, path := range ready {
+		if err := fc.submit(ctx, path); err != nil {
+			// Not submitted: forget them, the next sweep picks them up again.
+			fc.mu.Lock()
+			for _, p := range ready[i:] {
+				delete(fc.inFlight, p)
+			}
+			fc.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// submit submits a settled file. Files carry no message ID, so each submission
+// gets a random correlation ID.
+func (fc *FSConsumer) submit(ctx context.Context, path string) (err error) {
+	ctx, span := startDequeue(ctx, "fs-"+logging.NewID(), attribute.String("file.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	rel, err := filepath.Rel(fc.dir, path)
+	if err != nil {
+		return err
+	}
+	// Keys are URL-encoded, like in S3 notifications.
+	key := url.QueryEscape(filepath.ToSlash(rel))
+
+	return fc.pool.Submit(ctx, fc.bucket, key, "", func(err error) {
+		if err != nil {
+			slog.ErrorContext(ctx, "Error processing file", "path", path, "error", err)
+		}
+
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		delete(fc.inFlight, path)
+		// A file still there (processing failed, was dead-lettered, or was only tagged)
+		// is not submitted again until it changes.
+		if fi, statErr := os.Lstat(path); statErr == nil {
+			fc.handled[path] = fileState{size: fi.Size(), modTime: fi.ModTime()}
+		}
+	})
+}
+
+// ignoredName reports whether a file or directory is skipped: hidden names,
+// which include the temporary files of the filesystem storage backend, and
+// common partial-upload suffixes.
+func ignoredName(name string) bool {
+	return strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, ".tmp") ||
+		strings.HasSuffix(name, ".part") ||
+		strings.HasSuffix(name, ".partial")
+}
+
+// Ping checks that the watched directory still exists.
+func (fc *FSConsumer) Ping(ctx context.Context) error {
+	fi, err := os.Stat(fc.dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", fc.dir)
+	}
+	return nil
+}
+
+// Lag returns the number of files waiting to settle.
+func (fc *FSConsumer) Lag(ctx context.Context) (int64, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return int64(len(fc.pending)), nil
+}
+
+// Close stops watching the directory.
+func (fc *FSConsumer) Close() error {
+	slog.Info("Closing filesystem watcher")
+	return fc.watcher.Close()
+}
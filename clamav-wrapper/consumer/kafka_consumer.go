@@ -4,78 +4,163 @@ import (
 	"context"
 	"encoding/json"
 	"fmt" // Added for fmt.Errorf
-	"log"
+	"log/slog"
 
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
 
 	"clamav-wrapper/config"
 	"clamav-wrapper/models"
+	"clamav-wrapper/tracing"
+	"clamav-wrapper/worker"
 )
 
 // KafkaConsumer implements the MessageConsumer interface for Apache Kafka.
 // It handles the connection to Kafka, message consumption, and deserialization.
+// Offsets are committed explicitly, only once every record of a message has been
+// scanned and moved (at-least-once delivery).
 type KafkaConsumer struct {
 	Reader  *kafka.Reader
-	handler func(bucketName string, objectKeyEncoded string) error
+	pool    *worker.Pool
+	offsets *offsetTracker
+	filter  *eventFilter
 }
 
 // NewKafkaConsumer creates and configures a new KafkaConsumer.
 // It initializes a Kafka reader based on configuration from config.KafkaCfg
-// and stores the provided handler function.
-// Returns the configured KafkaConsumer or an error if initialization fails (e.g. nil handler).
-func NewKafkaConsumer(cfg config.KafkaConfig, handlerFunc func(bucketName string, objectKeyEncoded string) error) (*KafkaConsumer, error) {
-	if handlerFunc == nil {
-		return nil, fmt.Errorf("handler function cannot be nil for KafkaConsumer")
+// and stores the worker pool that file events are submitted to.
+// Returns the configured KafkaConsumer or an error if initialization fails (e.g. nil pool).
+func NewKafkaConsumer(cfg config.KafkaConfig, pool *worker.Pool) (*KafkaConsumer, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("worker pool cannot be nil for KafkaConsumer")
 	}
 	r := kafka.NewReader(kafka.ReaderConfig{
 		Brokers: cfg.Brokers,
 		Topic:   cfg.Topic,
 		GroupID: cfg.ConsumerGroupID,
+		// With a non-zero interval, CommitMessages only records the offset and the reader
+		// flushes commits in batches; with zero every commit is sent synchronously.
+		CommitInterval: cfg.CommitInterval,
 	})
-	return &KafkaConsumer{Reader: r, handler: handlerFunc}, nil
+	return &KafkaConsumer{
+		Reader:  r,
+		pool:    pool,
+		offsets: newOffsetTracker(r.CommitMessages, kafkaMaxPending),
+		filter:  newEventFilter(config.EventFilterCfg),
+	}, nil
 }
 
 // StartConsumer begins consuming messages from the Kafka topic.
-// It continuously reads messages, deserializes them into models.KakfaEvent,
-// and then passes them to the handler function stored in the KafkaConsumer.
-// This method will block until a read error occurs, the context is cancelled
-// (which can be triggered by closing the reader via the Close method), or if the handler is not set.
-func (kc *KafkaConsumer) StartConsumer() error {
-	if kc.handler == nil {
-		return fmt.Errorf("KafkaConsumer's handler is not set")
+// It continuously fetches messages, deserializes them into models.KakfaEvent,
+// and then submits every record to the worker pool stored in the KafkaConsumer.
+// Submitting blocks while all workers are busy, so no new messages are fetched until one frees up.
+// A message's offset is committed once all of its records were processed or
+// dead-lettered; a failed record holds back commits on its partition.
+// This method blocks until ctx is cancelled, in which case it returns nil, until a
+// read error occurs (e.g. the reader was closed via the Close method), or if the pool is not set.
+func (kc *KafkaConsumer) StartConsumer(ctx context.Context) error {
+	if kc.pool == nil {
+		return fmt.Errorf("KafkaConsumer's worker pool is not set")
 	}
 
-	log.Printf("Subscribed to kafka topic: %s", config.KafkaCfg.Topic)
+	slog.Info("Subscribed to Kafka topic", "topic", config.KafkaCfg.Topic)
 
 	for {
-		m, err := kc.Reader.ReadMessage(context.Background())
+		m, err := kc.Reader.FetchMessage(ctx)
 		if err != nil {
-			// If the reader is closed, ReadMessage will return an error.
-			// This is the expected way to stop the consumer.
-			log.Printf("Kafka read error: %v. This might indicate the consumer is closing.", err)
+			if ctx.Err() != nil {
+				return nil // Shutting down
+			}
+			// If the reader is closed, FetchMessage will return an error.
+			slog.Error("Kafka read error, the consumer might be closing", "error", err)
 			return err // Return error to signal consumer stop or failure
 		}
 
-		var event models.KafkaEvent
-		if err := json.Unmarshal(m.Value, &event); err != nil {
-			log.Printf("Invalid event message: %v. Skipping message.", err)
-			continue // Skip malformed messages
+		if err := kc.submitMessage(ctx, m); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
 		}
+	}
+}
+
+// submitMessage submits every record of a fetched message that passes the event
+// filter to the worker pool. Messages without such records are committed right away.
+// The message's topic, partition and offset form the correlation ID of its events.
+func (kc *KafkaConsumer) submitMessage(ctx context.Context, m kafka.Message) (err error) {
+	ctx, span := startDequeue(ctx, fmt.Sprintf("%s-%d-%d", m.Topic, m.Partition, m.Offset),
+		attribute.String("messaging.destination.name", m.Topic),
+		attribute.Int("messaging.kafka.destination.partition", m.Partition),
+		attribute.Int64("messaging.kafka.message.offset", m.Offset),
+		attribute.String("messaging.kafka.message.key", string(m.Key)),
+	)
+	defer func() { tracing.End(span, err) }()
 
-		for _, record := range event.Records {
-			// Call the stored handler with the received event
-			if err := kc.handler(record.S3.Bucket.Name, record.S3.Object.Key); err != nil {
-				log.Printf("Error processing event: %v. Continuing to next message.", err)
+	var event models.KafkaEvent
+	if err := json.Unmarshal(m.Value, &event); err != nil {
+		slog.WarnContext(ctx, "Invalid event message, skipping it", "error", err)
+		_, err := kc.offsets.track(ctx, m, 0) // Commit past malformed messages, they will never parse
+		return err
+	}
+
+	var records []models.S3Record
+	for _, record := range event.Records {
+		if kc.filter.accept(ctx, record) {
+			records = append(records, record)
+		}
+	}
+
+	tracked, err := kc.offsets.track(ctx, m, len(records))
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		// Hand the record over to the worker pool; the offset is committed once all records are done
+		err := kc.pool.Submit(ctx, record.S3.Bucket.Name, record.S3.Object.Key, record.S3.Object.VersionID, func(err error) {
+			if err != nil {
+				slog.ErrorContext(ctx, "Error processing event", "partition", m.Partition, "offset", m.Offset, "error", err)
 			}
+			kc.offsets.done(tracked, err)
+		})
+		if err != nil {
+			// Records that were never submitted count as interrupted, so the offset is not committed.
+			for range records[i:] {
+				kc.offsets.done(tracked, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping connects to the first reachable broker of the configuration.
+func (kc *KafkaConsumer) Ping(ctx context.Context) error {
+	var lastErr error
+	for _, broker := range kc.Reader.Config().Brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			lastErr = err
+			continue
 		}
+		return conn.Close()
 	}
+	return fmt.Errorf("no Kafka broker reachable: %w", lastErr)
+}
+
+// Lag returns how far the reader is behind the end of the partition it
+// fetched from last, as measured on that fetch. Reader.Lag is not available
+// with consumer groups, so the reader's stats are used instead.
+func (kc *KafkaConsumer) Lag(ctx context.Context) (int64, error) {
+	return kc.Reader.Stats().Lag, nil
 }
 
-// Close gracefully shuts down the Kafka consumer by closing the underlying Kafka reader.
+// Close gracefully shuts down the Kafka consumer by closing the underlying Kafka reader,
+// which also flushes offsets still waiting for the next commit interval.
 // This will cause the StartConsumer loop to exit.
 func (kc *KafkaConsumer) Close() error {
 	if kc.Reader != nil {
-		log.Println("Closing Kafka consumer reader.")
+		slog.Info("Closing Kafka consumer reader")
 		return kc.Reader.Close()
 	}
 	return nil
@@ -0,0 +1,138 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+
+	"clamav-wrapper/worker"
+)
+
+// kafkaMaxPending bounds the messages tracked per partition: fetching waits
+// while that many messages are in flight or done behind one still processing.
+const kafkaMaxPending = 1000
+
+// offsetTracker decides when a fetched Kafka message may be committed.
+// A message is complete once every record of its KafkaEvent has been handled.
+// Kafka commits are positional (committing offset N implies everything before
+// N), so per partition the tracker only commits up to the last message of the
+// leading run of complete messages.
+//
+// Only records handled successfully count: processed, or dead-lettered once
+// their retries were exhausted. A record that failed (no dead-letter queue, or
+// publishing to it failed) or was interrupted by shutdown holds back commits
+// on its partition, so that its message is redelivered after the next restart
+// or rebalance rather than lost. FetchMessage never redelivers it meanwhile, so
+// the partition stalls once maxPending messages are waiting behind it.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[int][]*trackedMessage // pending messages per partition, in fetch order
+	changed    chan struct{}             // closed and replaced whenever messages are popped
+	maxPending int
+	commit     func(ctx context.Context, msgs ...kafka.Message) error
+}
+
+type trackedMessage struct {
+	msg       kafka.Message
+	remaining int   // records still being processed
+	err       error // first error of its records, if any failed or were interrupted by shutdown
+}
+
+func newOffsetTracker(commit func(ctx context.Context, msgs ...kafka.Message) error, maxPending int) *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[int][]*trackedMessage),
+		changed:    make(chan struct{}),
+		maxPending: maxPending,
+		commit:     commit,
+	}
+}
+
+// track registers a fetched message with the number of records that will be
+// reported through done. It must be called before any record is submitted. It
+// waits while maxPending messages of the partition are pending, and returns
+// ctx.Err() if ctx is cancelled meanwhile.
+func (t *offsetTracker) track(ctx context.Context, m kafka.Message, records int) (*trackedMessage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := t.partitions[m.Partition]
+	if n := len(pending); n > 0 && m.Offset <= pending[n-1].msg.Offset {
+		// The partition was rewound (rebalance or redelivery); earlier state no longer applies.
+		slog.Info("Kafka partition rewound, resetting commit tracking", "partition", m.Partition, "offset", m.Offset)
+		t.partitions[m.Partition] = nil
+	}
+	for len(t.partitions[m.Partition]) >= t.maxPending {
+		changed := t.changed
+		t.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.mu.Lock()
+			return nil, ctx.Err()
+		}
+		t.mu.Lock()
+	}
+
+	tm := &trackedMessage{msg: m, remaining: records}
+	t.partitions[m.Partition] = append(t.partitions[m.Partition], tm)
+
+	if records == 0 {
+		t.advanceLocked(m.Partition)
+	}
+	return tm, nil
+}
+
+// done records the outcome of one record of tm and commits whatever became
+// committable as a result.
+func (t *offsetTracker) done(tm *trackedMessage, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tm.err == nil {
+		tm.err = err
+	}
+	tm.remaining--
+	if tm.remaining > 0 {
+		return
+	}
+	if tm.err != nil {
+		if interruptedByShutdown(tm.err) {
+			slog.Warn("Kafka message interrupted by shutdown, holding back commits on the partition so it is redelivered", "partition", tm.msg.Partition, "offset", tm.msg.Offset)
+		} else {
+			slog.Error("Kafka message failed, holding back commits on the partition until it is redelivered after a restart", "partition", tm.msg.Partition, "offset", tm.msg.Offset, "error", tm.err)
+		}
+		return
+	}
+	t.advanceLocked(tm.msg.Partition)
+}
+
+// interruptedByShutdown reports whether a record failed because the pool or
+// its context was shut down, rather than because processing failed.
+func interruptedByShutdown(err error) bool {
+	return errors.Is(err, worker.ErrClosed) || errors.Is(err, context.Canceled)
+}
+
+// advanceLocked pops the leading complete messages of a partition and commits
+// the last of them. Commits happen under the lock so offsets never go backwards.
+func (t *offsetTracker) advanceLocked(partition int) {
+	pending := t.partitions[partition]
+
+	var last *trackedMessage
+	for len(pending) > 0 && pending[0].remaining == 0 && pending[0].err == nil {
+		last, pending = pending[0], pending[1:]
+	}
+	t.partitions[partition] = pending
+
+	if last == nil {
+		return
+	}
+	close(t.changed)
+	t.changed = make(chan struct{})
+
+	if err := t.commit(context.Background(), last.msg); err != nil {
+		slog.Error("Failed to commit Kafka offset", "partition", partition, "offset", last.msg.Offset, "error", err)
+	}
+}
@@ -0,0 +1,198 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"clamav-wrapper/worker"
+)
+
+// commitLog records the offsets committed by an offsetTracker.
+type commitLog struct {
+	mu      sync.Mutex
+	offsets []int64
+}
+
+func (c *commitLog) commit(ctx context.Context, msgs ...kafka.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range msgs {
+		c.offsets = append(c.offsets, m.Offset)
+	}
+	return nil
+}
+
+func (c *commitLog) get() []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int64(nil), c.offsets...)
+}
+
+func message(partition int, offset int64) kafka.Message {
+	return kafka.Message{Partition: partition, Offset: offset}
+}
+
+func mustTrack(t *testing.T, tr *offsetTracker, m kafka.Message, records int) *trackedMessage {
+	t.Helper()
+	tm, err := tr.track(context.Background(), m, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestOffsetTracker(t *testing.T) {
+	errScan := errors.New("scan failed")
+	interrupted := fmt.Errorf("processing interrupted: %w", context.Canceled)
+
+	tests := []struct {
+		name    string
+		records []int    // Records of the messages at offsets 0, 1, 2...
+		done    [][2]int // Message index and outcome (0 success, 1 failure, 2 interrupted), in completion order
+		want    []int64
+	}{
+		{
+			name:    "in order",
+			records: []int{1, 1, 1},
+			done:    [][2]int{{0, 0}, {1, 0}, {2, 0}},
+			want:    []int64{0, 1, 2},
+		},
+		{
+			name:    "out of order",
+			records: []int{1, 1, 1},
+			done:    [][2]int{{2, 0}, {1, 0}, {0, 0}},
+			want:    []int64{2},
+		},
+		{
+			name:    "waits for every record",
+			records: []int{2, 1},
+			done:    [][2]int{{0, 0}, {1, 0}, {0, 0}},
+			want:    []int64{1},
+		},
+		{
+			name:    "failure holds back commits",
+			records: []int{1, 1, 1},
+			done:    [][2]int{{0, 0}, {2, 0}, {1, 1}},
+			want:    []int64{0},
+		},
+		{
+			name:    "failed record among successful ones",
+			records: []int{2, 1},
+			done:    [][2]int{{0, 1}, {1, 0}, {0, 0}},
+			want:    nil,
+		},
+		{
+			name:    "interruption holds back commits",
+			records: []int{1, 1, 1},
+			done:    [][2]int{{0, 0}, {1, 2}, {2, 0}},
+			want:    []int64{0},
+		},
+		{
+			name:    "no records",
+			records: []int{0, 1, 0},
+			done:    [][2]int{{1, 0}},
+			want:    []int64{0, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log commitLog
+			tr := newOffsetTracker(log.commit, 100)
+			var tracked []*trackedMessage
+			for i, n := range tt.records {
+				tracked = append(tracked, mustTrack(t, tr, message(0, int64(i)), n))
+			}
+			for _, d := range tt.done {
+				var err error
+				switch d[1] {
+				case 1:
+					err = errScan
+				case 2:
+					err = interrupted
+				}
+				tr.done(tracked[d[0]], err)
+			}
+			if got := log.get(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("committed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerPartitions(t *testing.T) {
+	var log commitLog
+	tr := newOffsetTracker(log.commit, 100)
+	a := mustTrack(t, tr, message(0, 10), 1)
+	b := mustTrack(t, tr, message(1, 20), 1)
+	c := mustTrack(t, tr, message(0, 11), 1)
+
+	tr.done(c, nil) // Waits for offset 10 of partition 0
+	tr.done(b, nil)
+	tr.done(a, nil)
+	if got := log.get(); fmt.Sprint(got) != "[20 11]" {
+		t.Errorf("committed %v, want [20 11]", got)
+	}
+}
+
+func TestOffsetTrackerRewind(t *testing.T) {
+	var log commitLog
+	tr := newOffsetTracker(log.commit, 100)
+	mustTrack(t, tr, message(0, 5), 1) // Never done: the partition is reassigned
+	again := mustTrack(t, tr, message(0, 5), 1)
+	tr.done(again, nil)
+	if got := log.get(); fmt.Sprint(got) != "[5]" {
+		t.Errorf("committed %v, want [5]", got)
+	}
+}
+
+func TestOffsetTrackerClosedPool(t *testing.T) {
+	var log commitLog
+	tr := newOffsetTracker(log.commit, 100)
+	tm := mustTrack(t, tr, message(0, 0), 1)
+	tr.done(tm, worker.ErrClosed)
+	if got := log.get(); len(got) != 0 {
+		t.Errorf("committed %v after the pool closed, want nothing", got)
+	}
+}
+
+func TestOffsetTrackerMaxPending(t *testing.T) {
+	var log commitLog
+	tr := newOffsetTracker(log.commit, 2)
+	first := mustTrack(t, tr, message(0, 0), 1)
+	mustTrack(t, tr, message(0, 1), 1)
+
+	tracked := make(chan error, 1)
+	go func() {
+		_, err := tr.track(context.Background(), message(0, 2), 1)
+		tracked <- err
+	}()
+	select {
+	case <-tracked:
+		t.Fatal("track did not wait while the partition was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tr.done(first, nil)
+	select {
+	case err := <-tracked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("track still waiting after a message was committed")
+	}
+
+	// Other partitions are not held up, and waiting ends with the context.
+	mustTrack(t, tr, message(1, 0), 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := tr.track(ctx, message(0, 3), 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("track on a full partition returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
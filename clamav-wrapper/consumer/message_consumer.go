@@ -4,15 +4,50 @@
 // common interface.
 package consumer
 
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/tracing"
+)
+
 // MessageConsumer defines the interface for a message consumer.
 // It provides a way to start consuming messages and to gracefully close the consumer.
 type MessageConsumer interface {
 	// StartConsumer begins listening for messages from the configured message broker.
-	// It uses the handler function provided during its creation to process each message.
+	// It submits each file event to the worker pool provided during its creation.
 	// The method should block until an unrecoverable error occurs or the consumer is closed.
-	StartConsumer() error
+	// Once ctx is cancelled it stops fetching new messages and returns nil; events
+	// already submitted keep running on the pool.
+	StartConsumer(ctx context.Context) error
 
 	// Close gracefully shuts down the message consumer, releasing any resources.
-	// It should ensure that any in-flight message processing is completed if possible.
+	// It is called after the worker pool has drained, and should flush offsets or
+	// acknowledgements of the events processed in the meantime before disconnecting.
 	Close() error
+
+	// Ping checks that the message broker (or watched directory) is reachable.
+	// It is used by the health and readiness endpoints.
+	Ping(ctx context.Context) error
+}
+
+// startDequeue tags ctx with the correlation ID of a received message and
+// starts its "dequeue" span. Events submitted with the returned context are
+// logged with the correlation ID, and their processing spans are children of
+// the dequeue span. The span is ended once the message's events were submitted.
+func startDequeue(ctx context.Context, correlationID string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx = logging.WithCorrelationID(ctx, correlationID)
+	attrs = append(attrs, attribute.String("messaging.system", config.MessageBrokerType))
+	return tracing.Start(ctx, "dequeue", attrs...)
+}
+
+// LagReporter is implemented by consumers that can tell how many messages are
+// waiting to be consumed. The lag is exported as a Prometheus metric.
+type LagReporter interface {
+	// Lag returns the number of messages not consumed yet.
+	Lag(ctx context.Context) (int64, error)
 }
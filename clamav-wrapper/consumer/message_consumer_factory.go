@@ -2,22 +2,26 @@ package consumer
 
 import (
 	"clamav-wrapper/config" // Added to access config.RedisCfg
+	"clamav-wrapper/storage"
+	"clamav-wrapper/worker"
 	"fmt"
+	"path/filepath"
 )
 
 // MessageConsumerFactory defines an interface for creating instances of MessageConsumer.
-// This allows for different implementations of consumers (e.g., Kafka, Redis)
+// This allows for different implementations of consumers (e.g., Kafka, Redis, NATS)
 // to be created based on configuration.
 type MessageConsumerFactory interface {
 	// CreateConsumer constructs a new MessageConsumer based on the specified brokerType.
-	// It takes a handler function that will be invoked for each message received by the consumer.
+	// It takes the worker pool that every file event received by the consumer is submitted to.
 	// Returns the configured MessageConsumer or an error if the brokerType is unsupported
 	// or if there's an issue during consumer initialization.
-	CreateConsumer(brokerType string, handler func(bucketName string, objectKeyEncoded string) error) (MessageConsumer, error)
+	CreateConsumer(brokerType string, pool *worker.Pool) (MessageConsumer, error)
 }
 
 // DefaultConsumerFactory is a concrete implementation of MessageConsumerFactory.
-// It can create Kafka consumers. Support for other types like Redis can be added here.
+// It can create Kafka, Redis, NATS JetStream, AMQP, MinIO bucket notification
+// and filesystem watch consumers.
 type DefaultConsumerFactory struct{}
 
 // NewDefaultConsumerFactory creates a new instance of DefaultConsumerFactory.
@@ -26,25 +30,65 @@ func NewDefaultConsumerFactory() *DefaultConsumerFactory {
 }
 
 // CreateConsumer creates a message consumer based on the brokerType.
-// It supports "kafka" and "redis" broker types.
-func (f *DefaultConsumerFactory) CreateConsumer(brokerType string, handler func(bucketName string, objectKeyEncoded string) error) (MessageConsumer, error) {
-	if handler == nil {
-		return nil, fmt.Errorf("handler function cannot be nil for CreateConsumer")
+// It supports "kafka", "redis", "nats", "amqp" (or "rabbitmq"), "minio" and "fs" broker types,
+// and "none" to consume nothing.
+func (f *DefaultConsumerFactory) CreateConsumer(brokerType string, pool *worker.Pool) (MessageConsumer, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("worker pool cannot be nil for CreateConsumer")
 	}
 	switch brokerType {
 	case "kafka":
-		// NewKafkaConsumer now takes the handler and returns (consumer, error)
-		consumer, err := NewKafkaConsumer(config.KafkaCfg, handler)
+		// NewKafkaConsumer takes the worker pool and returns (consumer, error)
+		consumer, err := NewKafkaConsumer(config.KafkaCfg, pool)
 		if err != nil {
 			return nil, fmt.Errorf("error creating Kafka consumer: %w", err)
 		}
 		return consumer, nil
 	case "redis":
-		consumer, err := NewRedisConsumer(config.RedisCfg, handler)
+		consumer, err := NewRedisConsumer(config.RedisCfg, pool)
 		if err != nil {
 			return nil, fmt.Errorf("error creating Redis consumer: %w", err)
 		}
 		return consumer, nil
+	case "nats":
+		consumer, err := NewNATSConsumer(config.NATSCfg, pool)
+		if err != nil {
+			return nil, fmt.Errorf("error creating NATS consumer: %w", err)
+		}
+		return consumer, nil
+	case "amqp", "rabbitmq":
+		consumer, err := NewAMQPConsumer(config.AMQPCfg, pool)
+		if err != nil {
+			return nil, fmt.Errorf("error creating AMQP consumer: %w", err)
+		}
+		return consumer, nil
+	case "minio":
+		// Notifications are only sent by MinIO itself, for the bucket the storage backend reads.
+		if config.StorageType != "minio" && config.StorageType != "s3" {
+			return nil, fmt.Errorf("the minio consumer requires STORAGE_TYPE=minio, got %s", config.StorageType)
+		}
+		store, err := storage.NewMinioStorage(config.MinioEndpoint, config.MinioAccessKey, config.MinioSecretKey, config.UseSSL)
+		if err != nil {
+			return nil, err
+		}
+		consumer, err := NewMinioConsumer(config.MinioListenCfg, store, config.StagingBucket, pool)
+		if err != nil {
+			return nil, fmt.Errorf("error creating MinIO notification consumer: %w", err)
+		}
+		return consumer, nil
+	case "fs":
+		// Files are read and moved through the filesystem storage backend, so both must agree on the layout.
+		if config.StorageType != "fs" {
+			return nil, fmt.Errorf("the fs consumer requires STORAGE_TYPE=fs, got %s", config.StorageType)
+		}
+		dir := filepath.Join(config.StorageFSRoot, config.StagingBucket)
+		consumer, err := NewFSConsumer(config.FSCfg, dir, config.StagingBucket, pool)
+		if err != nil {
+			return nil, fmt.Errorf("error creating filesystem consumer: %w", err)
+		}
+		return consumer, nil
+	case "none":
+		return NoneConsumer{}, nil
 	default:
 		return nil, fmt.Errorf("unsupported message broker type: %s", brokerType)
 	}
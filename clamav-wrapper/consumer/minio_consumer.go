@@ -0,0 +1,295 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"go.opentelemetry.io/otel/attribute"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/models"
+	"clamav-wrapper/storage"
+	"clamav-wrapper/tracing"
+	"clamav-wrapper/worker"
+)
+
+// minioListenRetryDelay is how long to wait before listening again once the
+// notification stream ended with an error the client does not retry itself.
+const minioListenRetryDelay = 5 * time.Second
+
+// MinioConsumer implements the MessageConsumer interface without a message
+// broker: it listens to the notifications of the staging bucket with MinIO's
+// ListenBucketNotification API. Notifications raised while it is not
+// connected are lost, so it also lists the bucket at startup, after every
+// reconnection and every SweepInterval, and submits the objects older than
+// SweepMinAge that are neither being processed nor were processed already.
+// MinIO sends every notification to every listener, so only one instance
+// should run.
+type MinioConsumer struct {
+	store  *storage.MinioStorage
+	bucket string
+	events []string // Event types MinIO is asked to send
+	pool   *worker.Pool
+	cfg    config.MinioListenConfig
+	filter *eventFilter
+	resync chan struct{} // Asks for a sweep, after events may have been missed
+
+	mu       sync.Mutex
+	inFlight map[string]int    // Objects submitted and not done yet, by decoded key
+	handled  map[string]string // ETags of objects processed but still in the bucket (failed or dead-lettered), by decoded key
+}
+
+// NewMinioConsumer creates a consumer for the notifications of bucket, using
+// store's client. Sweeping is only done with SCAN_ACTION=move: files tagged in
+// place stay in the bucket, and the listing cannot tell them from files not
+// scanned yet.
+func NewMinioConsumer(cfg config.MinioListenConfig, store *storage.MinioStorage, bucket string, pool *worker.Pool) (*MinioConsumer, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("worker pool cannot be nil for MinioConsumer")
+	}
+	if store == nil {
+		return nil, fmt.Errorf("MinIO storage cannot be nil for MinioConsumer")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := store.CheckBucket(ctx, bucket); err != nil {
+		return nil, fmt.Errorf("cannot listen to bucket %s: %w", bucket, err)
+	}
+
+	if config.ScanAction != "move" {
+		cfg.SweepInterval = 0
+	}
+	return &MinioConsumer{
+		store:    store,
+		bucket:   bucket,
+		events:   config.EventFilterCfg.Types,
+		pool:     pool,
+		cfg:      cfg,
+		filter:   newEventFilter(config.EventFilterCfg),
+		resync:   make(chan struct{}, 1),
+		inFlight: make(map[string]int),
+		handled:  make(map[string]string),
+	}, nil
+}
+
+// StartConsumer listens to the bucket's notifications until ctx is cancelled,
+// listening again whenever the stream ends, and sweeps the bucket meanwhile.
+func (mc *MinioConsumer) StartConsumer(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if mc.cfg.SweepInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mc.sweepLoop(ctx)
+		}()
+	}
+
+	slog.Info("Listening to MinIO bucket notifications", "bucket", mc.bucket, "events", mc.events)
+	for {
+		err := mc.listen(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		slog.Warn("MinIO bucket notification stream ended, listening again", "bucket", mc.bucket, "retry_in", minioListenRetryDelay.String())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(minioListenRetryDelay):
+		}
+		mc.requestSweep()
+	}
+}
+
+// listen submits the records of one notification stream until it ends. It
+// returns an error only if a record could not be submitted.
+func (mc *MinioConsumer) listen(ctx context.Context) error {
+	// The client keeps sending to the stream until its context is cancelled.
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for info := range mc.store.Client.ListenBucketNotification(listenCtx, mc.bucket, "", "", mc.events) {
+		if info.Err != nil {
+			// The client reconnects by itself after most errors, but events may have been missed.
+			slog.Error("Error listening to MinIO bucket notifications", "bucket", mc.bucket, "error", info.Err)
+			mc.requestSweep()
+			continue
+		}
+		if err := mc.submitNotification(ctx, info.Records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submitNotification submits every record of a notification that passes the
+// event filter to the worker pool. The sequencer of its first record forms
+// the correlation ID of its events.
+func (mc *MinioConsumer) submitNotification(ctx context.Context, events []notification.Event) (err error) {
+	records, err := s3Records(events)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid bucket notification, skipping it", "bucket", mc.bucket, "error", err)
+		return nil
+	}
+	id := "minio-" + logging.NewID()
+	if len(records) > 0 && records[0].S3.Object.Sequencer != "" {
+		id = "minio-" + records[0].S3.Object.Sequencer
+	}
+	ctx, span := startDequeue(ctx, id, attribute.String("messaging.destination.name", mc.bucket))
+	defer func() { tracing.End(span, err) }()
+
+	for _, record := range records {
+		if !mc.filter.accept(ctx, record) {
+			continue
+		}
+		if err := mc.submit(ctx, record.S3.Object.Key, record.S3.Object.VersionID, record.S3.Object.ETag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3Records converts notifications decoded by the MinIO client, whose JSON
+// form is that of S3 event records, into the records of the other consumers.
+func s3Records(events []notification.Event) ([]models.S3Record, error) {
+	data, err := json.Marshal(events)
+	if err != nil {
+		return nil, err
+	}
+	var records []models.S3Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// submit queues an object of the bucket and tracks it until it is done. etag
+// is the ETag of the content the event is about, "" if unknown.
+func (mc *MinioConsumer) submit(ctx context.Context, keyEncoded, versionID, etag string) error {
+	key, err := url.QueryUnescape(keyEncoded)
+	if err != nil {
+		key = keyEncoded
+	}
+	mc.mu.Lock()
+	mc.inFlight[key]++
+	mc.mu.Unlock()
+
+	err = mc.pool.Submit(ctx, mc.bucket, keyEncoded, versionID, func(err error) {
+		if err != nil {
+			slog.ErrorContext(ctx, "Error processing event", "bucket", mc.bucket, "key", keyEncoded, "error", err)
+		}
+		mc.mu.Lock()
+		mc.release(key)
+		mc.handled[key] = etag
+		mc.mu.Unlock()
+	})
+	if err != nil {
+		mc.mu.Lock()
+		mc.release(key)
+		mc.mu.Unlock()
+	}
+	return err
+}
+
+// release forgets one submission of key. mc.mu must be held.
+func (mc *MinioConsumer) release(key string) {
+	if mc.inFlight[key]--; mc.inFlight[key] <= 0 {
+		delete(mc.inFlight, key)
+	}
+}
+
+// requestSweep asks for a sweep, unless one is already pending.
+func (mc *MinioConsumer) requestSweep() {
+	select {
+	case mc.resync <- struct{}{}:
+	default:
+	}
+}
+
+// sweepLoop sweeps the bucket right away, then every SweepInterval and
+// whenever events may have been missed, until ctx is cancelled.
+func (mc *MinioConsumer) sweepLoop(ctx context.Context) {
+	ticker := time.NewTicker(mc.cfg.SweepInterval)
+	defer ticker.Stop()
+	for {
+		mc.sweep(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-mc.resync:
+		}
+	}
+}
+
+// sweep submits the objects of the bucket last modified more than
+// SweepMinAge ago, unless they are being processed or were processed in the
+// same state already. Younger objects are left to their notifications.
+func (mc *MinioConsumer) sweep(ctx context.Context) {
+	cutoff := time.Now().Add(-mc.cfg.SweepMinAge)
+	present := make(map[string]bool)
+	n := 0
+	err := mc.store.ListObjects(ctx, mc.bucket, func(obj storage.ObjectInfo) error {
+		present[obj.Key] = true
+		keyEncoded := url.QueryEscape(obj.Key) // Keys are URL-encoded, like in S3 notifications
+		if obj.LastModified.After(cutoff) || !mc.filter.acceptKey(keyEncoded) {
+			return nil
+		}
+		mc.mu.Lock()
+		etag, handled := mc.handled[obj.Key]
+		skip := mc.inFlight[obj.Key] > 0 || (handled && etag == obj.ETag)
+		mc.mu.Unlock()
+		if skip {
+			return nil
+		}
+
+		ctx := logging.WithCorrelationID(ctx, "sweep-"+logging.NewID())
+		slog.DebugContext(ctx, "Submitting file found in staging bucket", "bucket", mc.bucket, "key", obj.Key, "last_modified", obj.LastModified)
+		if err := mc.submit(ctx, keyEncoded, "", obj.ETag); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() == nil && !errors.Is(err, worker.ErrClosed) {
+			slog.Error("Sweeping the staging bucket failed", "bucket", mc.bucket, "submitted", n, "error", err)
+		}
+		return
+	}
+
+	// Objects no longer listed were moved or deleted; they need no memory.
+	mc.mu.Lock()
+	for key := range mc.handled {
+		if !present[key] {
+			delete(mc.handled, key)
+		}
+	}
+	mc.mu.Unlock()
+	if n > 0 {
+		slog.Info("Swept the staging bucket for missed events", "bucket", mc.bucket, "submitted", n)
+	}
+}
+
+// Ping checks that the bucket is reachable.
+func (mc *MinioConsumer) Ping(ctx context.Context) error {
+	return mc.store.CheckBucket(ctx, mc.bucket)
+}
+
+// Close releases nothing: listening and sweeping stop once the context passed
+// to StartConsumer is cancelled.
+func (mc *MinioConsumer) Close() error {
+	slog.Info("Closing MinIO bucket notification consumer")
+	return nil
+}
@@ -0,0 +1,249 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel/attribute"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/models"
+	"clamav-wrapper/tracing"
+	"clamav-wrapper/worker"
+)
+
+// NATSConsumer implements the MessageConsumer interface for NATS JetStream.
+// It reads the stream MinIO publishes to through a durable pull consumer shared
+// by all instances. A message is acknowledged once every record in it was
+// processed successfully; failed messages are left unacknowledged and
+// redelivered once AckWait has passed, until they were delivered MaxDeliver
+// times. While its records are processed, the
+// message is reported in progress so that scans taking longer than AckWait are
+// not redelivered meanwhile.
+type NATSConsumer struct {
+	conn     *nats.Conn
+	consumer jetstream.Consumer
+	pool     *worker.Pool
+	cfg      config.NATSConfig
+	filter   *eventFilter
+}
+
+// NewNATSConsumer connects to NATS and creates or updates the durable consumer
+// on the configured stream, which must exist.
+func NewNATSConsumer(cfg config.NATSConfig, pool *worker.Pool) (*NATSConsumer, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("worker pool cannot be nil for NATSConsumer")
+	}
+	if cfg.Durable == "" {
+		return nil, fmt.Errorf("a durable consumer name is required for NATS")
+	}
+
+	conn, err := nats.Connect(cfg.URL, NATSOptions(cfg)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS at %s: %w", cfg.URL, err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	consumerCfg := jetstream.ConsumerConfig{
+		Durable:       cfg.Durable,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       cfg.AckWait,
+		MaxAckPending: cfg.MaxAckPending,
+		MaxDeliver:    maxDeliver(cfg.MaxDeliver),
+		FilterSubject: cfg.Subject,
+	}
+	cons, err := js.CreateOrUpdateConsumer(ctx, cfg.Stream, consumerCfg)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create consumer %s on NATS stream %s: %w", cfg.Durable, cfg.Stream, err)
+	}
+
+	slog.Info("Successfully connected to NATS", "url", conn.ConnectedUrlRedacted(), "stream", cfg.Stream, "durable", cfg.Durable)
+
+	return &NATSConsumer{
+		conn:     conn,
+		consumer: cons,
+		pool:     pool,
+		cfg:      cfg,
+		filter:   newEventFilter(config.EventFilterCfg),
+	}, nil
+}
+
+// maxDeliver returns the MaxDeliver of the consumer for the configured limit:
+// JetStream takes -1 for no limit.
+func maxDeliver(n int) int {
+	if n <= 0 {
+		return -1
+	}
+	return n
+}
+
+// NATSOptions returns the connection options of cfg: credentials, and
+// reconnecting for as long as it takes.
+func NATSOptions(cfg config.NATSConfig) []nats.Option {
+	opts := []nats.Option{nats.Name("clamav-wrapper"), nats.MaxReconnects(-1)}
+	if cfg.Username != "" {
+		opts = append(opts, nats.UserInfo(cfg.Username, cfg.Password))
+	}
+	if cfg.Token != "" {
+		opts = append(opts, nats.Token(cfg.Token))
+	}
+	if cfg.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.CredsFile))
+	}
+	return opts
+}
+
+// StartConsumer pulls messages from the durable consumer and submits their
+// records to the worker pool. Submitting blocks while all workers are busy, so
+// at most FetchBatchSize messages wait in the client meanwhile.
+// This method blocks until ctx is cancelled, in which case it returns nil, or
+// until the message iterator fails.
+func (nc *NATSConsumer) StartConsumer(ctx context.Context) error {
+	it, err := nc.consumer.Messages(jetstream.PullMaxMessages(nc.cfg.FetchBatchSize))
+	if err != nil {
+		return fmt.Errorf("failed to pull from NATS consumer %s: %w", nc.cfg.Durable, err)
+	}
+	// Next does not take a context: stopping the iterator unblocks it.
+	stopped := context.AfterFunc(ctx, it.Stop)
+	defer func() {
+		if stopped() {
+			it.Stop()
+		}
+	}()
+
+	slog.Info("Subscribed to NATS stream", "stream", nc.cfg.Stream, "subject", nc.cfg.Subject, "durable", nc.cfg.Durable)
+
+	for {
+		msg, err := it.Next()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+				return nil // Shutting down
+			}
+			slog.Error("NATS read error", "stream", nc.cfg.Stream, "error", err)
+			return err
+		}
+		if err := nc.submitMessage(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// submitMessage submits every record of a message that passes the event filter
+// to the worker pool, and acknowledges the message once they were all
+// processed. Messages that can never be processed (malformed, or without such
+// records) are acknowledged right away. The stream name and sequence form the
+// correlation ID of its events.
+func (nc *NATSConsumer) submitMessage(ctx context.Context, msg jetstream.Msg) (err error) {
+	id := "nats-" + msg.Subject()
+	attrs := []attribute.KeyValue{attribute.String("messaging.destination.name", msg.Subject())}
+	if meta, err := msg.Metadata(); err == nil {
+		id = fmt.Sprintf("%s-%d", meta.Stream, meta.Sequence.Stream)
+		attrs = append(attrs, attribute.Int64("messaging.nats.stream.sequence", int64(meta.Sequence.Stream)),
+			attribute.Int64("messaging.nats.delivered", int64(meta.NumDelivered)))
+	}
+	ctx, span := startDequeue(ctx, id, attrs...)
+	defer func() { tracing.End(span, err) }()
+
+	var event models.NotificationEvent
+	if err := json.Unmarshal(msg.Data(), &event); err != nil {
+		slog.WarnContext(ctx, "Invalid event message, skipping it", "subject", msg.Subject(), "error", err)
+		nc.ack(ctx, msg)
+		return nil
+	}
+
+	var records []models.S3Record
+	for _, record := range event.Records {
+		if nc.filter.accept(ctx, record) {
+			records = append(records, record)
+		}
+	}
+
+	stop := nc.keepInProgress(ctx, msg)
+	return submitRecords(ctx, nc.pool, records, func(err error) {
+		stop()
+		switch {
+		case err == nil:
+			nc.ack(ctx, msg)
+		case errors.Is(err, worker.ErrClosed) || ctx.Err() != nil:
+			// Not processed because of shutdown: let another instance have it now.
+			if err := msg.Nak(); err != nil {
+				slog.WarnContext(ctx, "Failed to return message to NATS", "error", err)
+			}
+		default:
+			slog.ErrorContext(ctx, "Error processing message from NATS, it will be redelivered", "ack_wait", nc.cfg.AckWait.String(), "error", err)
+		}
+	})
+}
+
+// keepInProgress tells the server every third of AckWait that msg is still
+// being processed, which restarts its AckWait, until the returned function is
+// called.
+func (nc *NATSConsumer) keepInProgress(ctx context.Context, msg jetstream.Msg) (stop func()) {
+	if nc.cfg.AckWait <= 0 {
+		return func() {}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(nc.cfg.AckWait / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-ticker.C:
+				if err := msg.InProgress(); err != nil {
+					slog.WarnContext(ctx, "Failed to report NATS message in progress", "subject", msg.Subject(), "error", err)
+				}
+			}
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+func (nc *NATSConsumer) ack(ctx context.Context, msg jetstream.Msg) {
+	if err := msg.Ack(); err != nil {
+		slog.ErrorContext(ctx, "Failed to acknowledge NATS message", "subject", msg.Subject(), "error", err)
+	}
+}
+
+// Ping makes a round trip to the NATS server.
+func (nc *NATSConsumer) Ping(ctx context.Context) error {
+	if !nc.conn.IsConnected() {
+		return fmt.Errorf("not connected to NATS (%s)", strings.ToLower(nc.conn.Status().String()))
+	}
+	return nc.conn.FlushWithContext(ctx)
+}
+
+// Lag returns the number of messages of the stream not yet delivered to the consumer.
+func (nc *NATSConsumer) Lag(ctx context.Context) (int64, error) {
+	info, err := nc.consumer.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return int64(info.NumPending), nil
+}
+
+// Close flushes pending acknowledgements and disconnects from NATS.
+func (nc *NATSConsumer) Close() error {
+	slog.Info("Closing NATS consumer connection")
+	err := nc.conn.Flush()
+	nc.conn.Close()
+	return err
+}
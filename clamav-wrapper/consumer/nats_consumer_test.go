@@ -0,0 +1,194 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"clamav-wrapper/config"
+)
+
+// startNATS runs an embedded NATS server with JetStream and a MINIO stream on
+// the minio.events subject, and returns a client for publishing to it.
+func startNATS(t *testing.T) (*server.Server, jetstream.JetStream) {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	js, err := jetstream.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.CreateStream(context.Background(), jetstream.StreamConfig{Name: "MINIO", Subjects: []string{"minio.events"}}); err != nil {
+		t.Fatal(err)
+	}
+	return s, js
+}
+
+// handlerCalls counts the calls of a handler per key.
+type handlerCalls struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+// add counts a call for key and returns the number of calls so far.
+func (h *handlerCalls) add(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.calls == nil {
+		h.calls = make(map[string]int)
+	}
+	h.calls[key]++
+	return h.calls[key]
+}
+
+func (h *handlerCalls) get(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls[key]
+}
+
+func TestNATSConsumer(t *testing.T) {
+	s, js := startNATS(t)
+
+	const ackWait = time.Second
+	var calls handlerCalls
+	pool := startPool(t, func(ctx context.Context, bucket, key, versionID string) error {
+		switch n := calls.add(key); {
+		case key == "slow.txt":
+			// Longer than AckWait: only heartbeats keep it from being redelivered.
+			time.Sleep(3 * ackWait)
+		case key == "flaky.txt" && n == 1:
+			return errors.New("scan failed")
+		}
+		return nil
+	})
+
+	cfg := config.NATSConfig{
+		URL:            s.ClientURL(),
+		Stream:         "MINIO",
+		Subject:        "minio.events",
+		Durable:        "clamav-wrapper",
+		AckWait:        ackWait,
+		MaxAckPending:  100,
+		FetchBatchSize: 10,
+	}
+	nc, err := NewNATSConsumer(cfg, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.filter = newEventFilter(config.EventFilterConfig{Types: []string{"s3:ObjectCreated:*"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- nc.StartConsumer(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Errorf("StartConsumer returned %v", err)
+		}
+		nc.Close()
+	})
+
+	for _, body := range [][]byte{
+		eventBody(t, "a.txt", "b.txt"),
+		eventBody(t, "slow.txt"),
+		eventBody(t, "flaky.txt"),
+		[]byte("not json"),
+	} {
+		if _, err := js.Publish(context.Background(), "minio.events", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every message ends up acknowledged, the failed one after a redelivery.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info, err := nc.consumer.Info(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.AckFloor.Stream == 4 && info.NumAckPending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("messages not acknowledged: ack floor %d, %d pending", info.AckFloor.Stream, info.NumAckPending)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for key, want := range map[string]int{"a.txt": 1, "b.txt": 1, "slow.txt": 1, "flaky.txt": 2} {
+		if got := calls.get(key); got != want {
+			t.Errorf("%s processed %d times, want %d", key, got, want)
+		}
+	}
+	if lag, err := nc.Lag(context.Background()); err != nil || lag != 0 {
+		t.Errorf("Lag() = %d, %v, want 0", lag, err)
+	}
+	pingCtx, cancelPing := context.WithTimeout(context.Background(), time.Second)
+	defer cancelPing()
+	if err := nc.Ping(pingCtx); err != nil {
+		t.Errorf("Ping() = %v", err)
+	}
+}
+
+// A message failing every time is no longer redelivered once it was delivered
+// MaxDeliver times.
+func TestNATSConsumerMaxDeliver(t *testing.T) {
+	s, js := startNATS(t)
+
+	var calls handlerCalls
+	pool := startPool(t, func(ctx context.Context, bucket, key, versionID string) error {
+		calls.add(key)
+		return errors.New("scan failed")
+	})
+	const ackWait = 300 * time.Millisecond
+	cfg := config.NATSConfig{
+		URL:            s.ClientURL(),
+		Stream:         "MINIO",
+		Subject:        "minio.events",
+		Durable:        "clamav-wrapper",
+		AckWait:        ackWait,
+		MaxAckPending:  100,
+		FetchBatchSize: 10,
+		MaxDeliver:     2,
+	}
+	nc, err := NewNATSConsumer(cfg, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.filter = newEventFilter(config.EventFilterConfig{Types: []string{"s3:ObjectCreated:*"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- nc.StartConsumer(ctx) }()
+	defer func() {
+		cancel()
+		<-stopped
+		nc.Close()
+	}()
+
+	if _, err := js.Publish(context.Background(), "minio.events", eventBody(t, "broken.txt")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(6 * ackWait)
+	if got := calls.get("broken.txt"); got != 2 {
+		t.Errorf("failing message processed %d times, want 2", got)
+	}
+}
@@ -0,0 +1,27 @@
+package consumer
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NoneConsumer implements the MessageConsumer interface without consuming
+// anything. It is used when the service only serves the HTTP scanning API.
+type NoneConsumer struct{}
+
+// StartConsumer blocks until ctx is cancelled.
+func (NoneConsumer) StartConsumer(ctx context.Context) error {
+	slog.Info("No message broker configured, only serving the scan API")
+	<-ctx.Done()
+	return nil
+}
+
+// Ping always succeeds.
+func (NoneConsumer) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing.
+func (NoneConsumer) Close() error {
+	return nil
+}
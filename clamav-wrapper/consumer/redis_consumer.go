@@ -4,123 +4,207 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
 
 	"clamav-wrapper/config"
+	"clamav-wrapper/logging"
+	"clamav-wrapper/messaging"
 	"clamav-wrapper/models"
+	"clamav-wrapper/tracing"
+	"clamav-wrapper/worker"
 )
 
-// RedisConsumer implements the MessageConsumer interface for Redis, using BLPOP on a list.
+// Redis consumption modes, selected with config.RedisConfig.Mode.
+const (
+	// RedisModeList pops messages with BLPOP. A message popped right before a crash is lost.
+	RedisModeList = "list"
+	// RedisModeReliableList moves messages with BLMOVE into a per-consumer processing
+	// list and removes them only after they were processed.
+	RedisModeReliableList = "reliable-list"
+	// RedisModeStream reads a Redis Stream through a consumer group, acknowledging
+	// entries with XACK and reclaiming stale pending entries with XCLAIM.
+	RedisModeStream = "stream"
+)
+
+// RedisConsumer implements the MessageConsumer interface for Redis.
+// Depending on the configured mode it uses BLPOP or BLMOVE on a list, or a Redis
+// Stream consumer group.
 type RedisConsumer struct {
-	client  *redis.Client
-	key     string // Redis list key to pop messages from
-	handler func(bucketName string, objectKeyEncoded string) error
+	client *redis.Client
+	key    string // Redis list or stream key to consume messages from
+	pool   *worker.Pool
+	cfg    config.RedisConfig
+	filter *eventFilter
+
+	mu       sync.Mutex
+	inFlight map[string]struct{} // IDs of the stream entries submitted and not done yet
 }
 
+// redisBlockTimeout bounds each blocking BLPOP, BLMOVE and XREADGROUP call:
+// go-redis does not interrupt a blocked command when its context is cancelled,
+// so the consume loops check for shutdown between calls instead.
+const redisBlockTimeout = 5 * time.Second
+
 // NewRedisConsumer creates and configures a new RedisConsumer.
 // It initializes a Redis client, pings the server, and stores configuration.
-func NewRedisConsumer(cfg config.RedisConfig, handlerFunc func(bucketName string, objectKeyEncoded string) error) (*RedisConsumer, error) {
-	if handlerFunc == nil {
-		return nil, fmt.Errorf("handler function cannot be nil for RedisConsumer")
+func NewRedisConsumer(cfg config.RedisConfig, pool *worker.Pool) (*RedisConsumer, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("worker pool cannot be nil for RedisConsumer")
 	}
-
-	opt := &redis.Options{
-		Addr:     cfg.Address,
-		Password: cfg.Password,
-		DB:       cfg.DB,
+	switch cfg.Mode {
+	case RedisModeList, RedisModeReliableList, RedisModeStream:
+	default:
+		return nil, fmt.Errorf("unsupported Redis consumer mode: %s", cfg.Mode)
 	}
-	client := redis.NewClient(opt)
-
-	// Ping Redis to check connectivity
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second) // 5-second timeout for ping
-	defer cancel()
-	if _, err := client.Ping(ctx).Result(); err != nil {
-		client.Close() // Close client if ping fails
-		return nil, fmt.Errorf("failed to connect to Redis at %s: %w", cfg.Address, err)
+	if cfg.Mode != RedisModeList && cfg.ConsumerName == "" {
+		return nil, fmt.Errorf("a consumer name is required for Redis mode %s", cfg.Mode)
 	}
 
-	log.Printf("Successfully connected to Redis at %s", cfg.Address)
+	client, err := messaging.NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Successfully connected to Redis", "address", cfg.Address)
 
 	return &RedisConsumer{
-		client:  client,
-		key:     cfg.Key,
-		handler: handlerFunc,
+		client:   client,
+		key:      cfg.Key,
+		pool:     pool,
+		cfg:      cfg,
+		filter:   newEventFilter(config.EventFilterCfg),
+		inFlight: make(map[string]struct{}),
 	}, nil
 }
 
-// StartConsumer begins consuming messages from the configured Redis list using BLPOP.
-func (rc *RedisConsumer) StartConsumer() error {
-	if rc.handler == nil {
-		return fmt.Errorf("RedisConsumer's handler is not set")
+// StartConsumer begins consuming messages from the configured Redis key using the configured mode.
+// Every event is submitted to the worker pool; submitting blocks while all workers
+// are busy, so no new messages are fetched until one frees up.
+// It returns nil once ctx is cancelled, after the current blocking call timed out.
+func (rc *RedisConsumer) StartConsumer(ctx context.Context) error {
+	if rc.pool == nil {
+		return fmt.Errorf("RedisConsumer's worker pool is not set")
 	}
 	if rc.client == nil {
 		return fmt.Errorf("RedisConsumer's client is not initialized")
 	}
 
-	log.Printf("Starting Redis consumer for key %s using BLPOP", rc.key)
-	ctx := context.Background()
+	switch rc.cfg.Mode {
+	case RedisModeReliableList:
+		return rc.consumeReliableList(ctx)
+	case RedisModeStream:
+		return rc.consumeStream(ctx)
+	default:
+		return rc.consumeList(ctx)
+	}
+}
 
-	for {
-		results, err := rc.client.BLPop(ctx, 0*time.Second, rc.key).Result()
+// consumeList pops messages from the list with BLPOP.
+func (rc *RedisConsumer) consumeList(ctx context.Context) error {
+	slog.Info("Starting Redis consumer using BLPOP", "key", rc.key)
+
+	for ctx.Err() == nil {
+		results, err := rc.client.BLPop(ctx, redisBlockTimeout, rc.key).Result()
 		if err != nil {
-			if err == redis.Nil { // redis.Nil is returned on timeout if BLPop timeout > 0. With 0, it blocks indefinitely.
-				// This path might be taken if client is closing / context is cancelled.
-				log.Printf("Redis BLPop returned nil (key: %s), client might be closing or context cancelled.", rc.key)
-				// Check context error for graceful shutdown
-				if ctx.Err() != nil {
-					log.Printf("Context error detected: %v. Shutting down Redis consumer.", ctx.Err())
-					return nil // Graceful shutdown
-				}
-				// If no context error, it might be an unexpected nil, possibly retry or log more.
-				// For indefinite timeout (0), redis.Nil is not expected unless client is closed.
-				return fmt.Errorf("unexpected redis.Nil from BLPop with 0 timeout for key %s: %w", rc.key, err)
+			if err == redis.Nil || ctx.Err() != nil {
+				continue // Timed out without a message, or shutting down
+			}
+			if err == redis.ErrClosed {
+				return nil // Client closed by Close
 			}
-			log.Printf("Error receiving message from Redis key %s using BLPop: %v", rc.key, err)
+			slog.Error("Error receiving message from Redis using BLPOP", "key", rc.key, "error", err)
 			// Add a small delay before retrying to prevent tight loop on persistent errors.
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
 		if len(results) < 2 {
-			log.Printf("Error: BLPop for key %s returned unexpected results length: %d. Expected 2 (key, value).", rc.key, len(results))
+			slog.Error("BLPOP returned an unexpected number of results, expected 2 (key, value)", "key", rc.key, "results", len(results))
 			continue
 		}
 		// results[0] is the key name, results[1] is the value (JSON payload string)
-		payload := results[1]
-
-		var event models.RedisEvent
-		if err := json.Unmarshal([]byte(payload), &event); err != nil {
-			log.Printf("Error unmarshalling RedisEvent array from Redis: %v. Payload: %s", err, payload)
-			continue
+		// BLPOP has already removed the message, so there is nothing to acknowledge. It is
+		// submitted even if shutdown began meanwhile, since it could not be redelivered.
+		if err := rc.submitPayload(context.Background(), results[1], func(error) {}); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if len(event) == 0 {
-			log.Printf("Received empty notifications array from Redis key %s. Payload: %s", rc.key, payload)
+// submitPayload decodes a models.RedisEvent payload and submits every event in it
+// to the worker pool. done is called with nil, meaning the payload may be
+// acknowledged, once all events of the payload have been processed
+// successfully, or right away for payloads that can never be processed
+// (malformed or empty), so they are not redelivered forever, or that hold no
+// event passing the event filter. Otherwise it is called with the first error,
+// also if ctx is cancelled while waiting for a worker.
+// Unless ctx already carries one, the correlation ID of the events is derived
+// from the payload.
+func (rc *RedisConsumer) submitPayload(ctx context.Context, payload string, done func(error)) (err error) {
+	id := logging.CorrelationID(ctx)
+	if id == "" {
+		id = "redis-" + logging.HashID([]byte(payload))
+	}
+	ctx, span := startDequeue(ctx, id, attribute.String("messaging.destination.name", rc.key))
+	defer func() { tracing.End(span, err) }()
+
+	var event models.RedisEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		slog.WarnContext(ctx, "Error unmarshalling RedisEvent array from Redis, skipping it", "key", rc.key, "payload", payload, "error", err)
+		done(nil)
+		return nil
+	}
+
+	if len(event) == 0 {
+		slog.WarnContext(ctx, "Received empty notifications array from Redis", "key", rc.key, "payload", payload)
+		done(nil)
+		return nil
+	}
+
+	var records []models.S3Record
+	for _, redisEvent := range event {
+		if len(redisEvent.Event) == 0 {
+			slog.WarnContext(ctx, "Received empty event array from Redis", "key", rc.key, "payload", payload)
 			continue
 		}
-
-		for _, redisEvent := range event {
-			if len(redisEvent.Event) == 0 {
-				log.Printf("Received empty event array from Redis key %s. Payload: %s", rc.key, payload)
+		for _, event := range redisEvent.Event {
+			if !rc.filter.accept(ctx, event) {
 				continue
 			}
-			for _, event := range redisEvent.Event {
-				if err := rc.handler(event.S3.Bucket.Name, event.S3.Object.Key); err != nil {
-					log.Printf("Error processing event from Redis: %v", err)
-					// Continue processing next message
-				}
-			}
+			records = append(records, event)
 		}
 	}
+
+	if err := submitRecords(ctx, rc.pool, records, done); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// Ping sends PING to the Redis server.
+func (rc *RedisConsumer) Ping(ctx context.Context) error {
+	return rc.client.Ping(ctx).Err()
+}
+
+// Lag returns the length of the list in the list modes, and the number of
+// entries not yet delivered to the consumer group in stream mode.
+func (rc *RedisConsumer) Lag(ctx context.Context) (int64, error) {
+	if rc.cfg.Mode == RedisModeStream {
+		return rc.streamLag(ctx)
+	}
+	return rc.client.LLen(ctx, rc.key).Result()
 }
 
 // Close gracefully shuts down the Redis consumer by closing the Redis client.
 func (rc *RedisConsumer) Close() error {
 	if rc.client != nil {
-		log.Println("Closing Redis consumer client.")
+		slog.Info("Closing Redis consumer client")
 		return rc.client.Close()
 	}
 	return nil
@@ -0,0 +1,137 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"clamav-wrapper/logging"
+	"clamav-wrapper/worker"
+)
+
+// processingKey is the list holding messages this consumer has taken but not
+// finished yet. It must be stable across restarts of the same consumer so the
+// recovery sweep finds what a crashed instance left behind.
+func (rc *RedisConsumer) processingKey() string {
+	return fmt.Sprintf("%s:processing:%s", rc.key, rc.cfg.ConsumerName)
+}
+
+// deliveriesKey is the hash counting the failed deliveries of reliable-list
+// messages, by hash of the payload, across all consumers of the list.
+func (rc *RedisConsumer) deliveriesKey() string {
+	return rc.key + ":deliveries"
+}
+
+// consumeReliableList atomically moves each message from the main list into the
+// consumer's processing list with BLMOVE and removes it from there with LREM
+// once every event in it was processed. Messages whose processing failed are
+// moved back to the tail of the main list, by settleFailed. Messages
+// interrupted by shutdown stay in the processing list and are pushed back by
+// the recovery sweep on the next start.
+func (rc *RedisConsumer) consumeReliableList(ctx context.Context) error {
+	processing := rc.processingKey()
+
+	if err := rc.recoverProcessingList(ctx); err != nil {
+		return err
+	}
+
+	slog.Info("Starting Redis consumer using BLMOVE", "key", rc.key, "processing", processing)
+
+	for ctx.Err() == nil {
+		payload, err := rc.client.BLMove(ctx, rc.key, processing, "LEFT", "RIGHT", redisBlockTimeout).Result()
+		if err != nil {
+			if err == redis.Nil || ctx.Err() != nil {
+				continue // Timed out without a message, or shutting down
+			}
+			if err == redis.ErrClosed {
+				return nil // Client closed by Close
+			}
+			slog.Error("Error receiving message from Redis using BLMOVE", "key", rc.key, "error", err)
+			// Add a small delay before retrying to prevent tight loop on persistent errors.
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		err = rc.submitPayload(ctx, payload, func(err error) {
+			switch {
+			case err == nil:
+				rc.settle(payload, false)
+			case errors.Is(err, worker.ErrClosed) || ctx.Err() != nil:
+				// Pushed back by the recovery sweep on the next start
+			default:
+				rc.settleFailed(payload, err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settle removes a message from the processing list, and forgets how often it
+// failed, pushing it back to the tail of the main list first if requeue is set.
+// Both happen in one transaction, so the message is never lost nor duplicated.
+func (rc *RedisConsumer) settle(payload string, requeue bool) {
+	processing := rc.processingKey()
+	ctx := context.Background()
+	_, err := rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, processing, 1, payload)
+		if requeue {
+			pipe.RPush(ctx, rc.key, payload)
+		} else {
+			pipe.HDel(ctx, rc.deliveriesKey(), logging.HashID([]byte(payload)))
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to remove message from the processing list", "processing", processing, "requeue", requeue, "error", err)
+	}
+}
+
+// settleFailed counts a failed delivery of a message and returns it to the
+// main list to be consumed again, or drops it once it failed MaxDeliveries
+// times, so that an event which keeps failing is not redelivered forever.
+func (rc *RedisConsumer) settleFailed(payload string, err error) {
+	id := logging.HashID([]byte(payload))
+	deliveries, hErr := rc.client.HIncrBy(context.Background(), rc.deliveriesKey(), id, 1).Result()
+	if hErr != nil {
+		slog.Error("Failed to count the deliveries of a failed message, leaving it in the processing list", "processing", rc.processingKey(), "error", hErr)
+		return
+	}
+	if rc.cfg.MaxDeliveries > 0 && deliveries >= int64(rc.cfg.MaxDeliveries) {
+		slog.Error("Error processing message from Redis, delivery limit reached, dropping it", "key", rc.key, "message", id, "deliveries", deliveries, "payload", payload, "error", err)
+		rc.settle(payload, false)
+		return
+	}
+	slog.Error("Error processing message from Redis, returning it to the list", "key", rc.key, "message", id, "deliveries", deliveries, "error", err)
+	rc.settle(payload, true)
+}
+
+// recoverProcessingList pushes messages left in the processing list by a
+// previous run back to the head of the main list, oldest first, so they are
+// the next ones to be consumed.
+func (rc *RedisConsumer) recoverProcessingList(ctx context.Context) error {
+	processing := rc.processingKey()
+	recovered := 0
+
+	for {
+		err := rc.client.LMove(ctx, processing, rc.key, "RIGHT", "LEFT").Err()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to recover messages from %s: %w", processing, err)
+		}
+		recovered++
+	}
+
+	if recovered > 0 {
+		slog.Info("Recovered unfinished messages", "processing", processing, "key", rc.key, "count", recovered)
+	}
+	return nil
+}
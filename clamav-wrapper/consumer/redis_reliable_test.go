@@ -0,0 +1,87 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/models"
+)
+
+// Failed reliable-list messages are consumed again while the consumer runs,
+// until they failed MaxDeliveries times.
+func TestRedisReliableListRequeue(t *testing.T) {
+	m := miniredis.RunT(t)
+	var calls handlerCalls
+	pool := startPool(t, func(ctx context.Context, bucket, key, versionID string) error {
+		n := calls.add(key)
+		if key == "poison.txt" || key == "flaky.txt" && n == 1 {
+			return errors.New("scan failed")
+		}
+		return nil
+	})
+	cfg := config.RedisConfig{
+		Address:       m.Addr(),
+		Key:           "events",
+		Mode:          RedisModeReliableList,
+		ConsumerName:  "a",
+		MaxDeliveries: 3,
+	}
+	rc, err := NewRedisConsumer(cfg, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.filter = newEventFilter(config.EventFilterConfig{Types: []string{"s3:ObjectCreated:*"}})
+
+	for _, key := range []string{"poison.txt", "flaky.txt", "ok.txt"} {
+		record := models.NewS3Record("staging", key)
+		record.EventName = "s3:ObjectCreated:Put"
+		payload, err := json.Marshal(models.RedisEvent{{Event: []models.S3Record{record}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Push(cfg.Key, string(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- rc.StartConsumer(ctx) }()
+	defer func() {
+		cancel()
+		rc.Close()
+		<-stopped
+	}()
+
+	want := map[string]int{"poison.txt": 3, "flaky.txt": 2, "ok.txt": 1}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		done := true
+		for key, n := range want {
+			done = done && calls.get(key) >= n
+		}
+		main, _ := m.List(cfg.Key)
+		processing, _ := m.List(rc.processingKey())
+		if done && len(main) == 0 && len(processing) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("messages not settled: %d in the list, %d processing", len(main), len(processing))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for key, n := range want {
+		if got := calls.get(key); got != n {
+			t.Errorf("%s processed %d times, want %d", key, got, n)
+		}
+	}
+	if left, _ := m.HKeys(rc.deliveriesKey()); len(left) != 0 {
+		t.Errorf("failure counts left behind: %v", left)
+	}
+}
@@ -0,0 +1,280 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"clamav-wrapper/logging"
+)
+
+// consumeStream reads the stream through a consumer group. Entries are
+// acknowledged with XACK once every event in them was processed. Entries that
+// are never acknowledged (crash or processing error) stay pending and are
+// reclaimed by claimLoop once idle for longer than ClaimMinIdle.
+func (rc *RedisConsumer) consumeStream(ctx context.Context) error {
+	err := rc.client.XGroupCreateMkStream(ctx, rc.key, rc.cfg.StreamGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group %s on stream %s: %w", rc.cfg.StreamGroup, rc.key, err)
+	}
+
+	slog.Info("Starting Redis stream consumer", "stream", rc.key, "consumer", rc.cfg.ConsumerName, "group", rc.cfg.StreamGroup)
+
+	// Entries delivered to this consumer before a restart but never acknowledged come first.
+	if err := rc.readStream(ctx, "0"); err != nil {
+		return err
+	}
+
+	go rc.claimLoop(ctx)
+
+	for ctx.Err() == nil {
+		if err := rc.readStream(ctx, ">"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStream runs XREADGROUP from id: "0" returns this consumer's own pending
+// entries until none are left, ">" returns one batch of new entries.
+func (rc *RedisConsumer) readStream(ctx context.Context, id string) error {
+	for {
+		streams, err := rc.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    rc.cfg.StreamGroup,
+			Consumer: rc.cfg.ConsumerName,
+			Streams:  []string{rc.key, id},
+			Count:    int64(rc.cfg.StreamBatchSize),
+			Block:    redisBlockTimeout,
+		}).Result()
+		if err == redis.Nil || ctx.Err() != nil {
+			return nil // Block timed out without new entries, or shutting down
+		}
+		if err == redis.ErrClosed {
+			return nil // Client closed by Close
+		}
+		if err != nil {
+			slog.Error("Error reading from Redis stream", "stream", rc.key, "error", err)
+			// Add a small delay before retrying to prevent tight loop on persistent errors.
+			time.Sleep(1 * time.Second)
+			return nil
+		}
+
+		delivered := 0
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				if err := rc.submitStreamMessage(ctx, msg); err != nil {
+					return err
+				}
+				delivered++
+			}
+		}
+
+		if id == ">" || delivered == 0 {
+			return nil
+		}
+		// Own pending entries are returned in ID order; continue after the last one.
+		last := streams[len(streams)-1].Messages
+		id = last[len(last)-1].ID
+	}
+}
+
+// submitStreamMessage submits the payload stored in the configured field of a
+// stream entry and acknowledges the entry once it has been processed. Until
+// then, the entry is in flight and not reclaimed by claimLoop.
+// The stream key and entry ID form the correlation ID of its events.
+func (rc *RedisConsumer) submitStreamMessage(ctx context.Context, msg redis.XMessage) error {
+	ctx = logging.WithCorrelationID(ctx, rc.key+"-"+msg.ID)
+	payload, ok := msg.Values[rc.cfg.StreamField].(string)
+	if !ok {
+		slog.WarnContext(ctx, "Stream entry has no payload field, acknowledging and skipping it", "stream", rc.key, "id", msg.ID, "field", rc.cfg.StreamField)
+		rc.ack(ctx, msg.ID)
+		return nil
+	}
+
+	rc.mu.Lock()
+	rc.inFlight[msg.ID] = struct{}{}
+	rc.mu.Unlock()
+	return rc.submitPayload(ctx, payload, func(err error) {
+		rc.mu.Lock()
+		delete(rc.inFlight, msg.ID)
+		rc.mu.Unlock()
+		if err == nil {
+			rc.ack(ctx, msg.ID)
+		}
+	})
+}
+
+func (rc *RedisConsumer) ack(ctx context.Context, id string) {
+	if err := rc.client.XAck(context.Background(), rc.key, rc.cfg.StreamGroup, id).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to acknowledge stream entry", "stream", rc.key, "id", id, "error", err)
+	}
+}
+
+// claimLoop periodically takes over entries that have been pending for longer
+// than ClaimMinIdle, whether they belong to a crashed consumer or failed here.
+// It stops when ctx is cancelled.
+func (rc *RedisConsumer) claimLoop(ctx context.Context) {
+	ticker := time.NewTicker(rc.cfg.ClaimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := rc.claimStale(ctx); err != nil {
+			if err != redis.ErrClosed && ctx.Err() == nil {
+				slog.Error("Error claiming stale stream entries", "stream", rc.key, "error", err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// claimStale lists the entries of the group pending for longer than
+// ClaimMinIdle with XPENDING, and claims and submits them batch by batch.
+// Entries still being processed by this instance are left alone: their scan
+// is merely slow. Entries already delivered MaxDeliveries times are
+// acknowledged instead, so that an event that keeps failing, or crashing the
+// consumer, is not redelivered forever; they remain in the stream until it is
+// trimmed.
+func (rc *RedisConsumer) claimStale(ctx context.Context) error {
+	start := "-"
+	for {
+		pending, err := rc.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: rc.key,
+			Group:  rc.cfg.StreamGroup,
+			Idle:   rc.cfg.ClaimMinIdle,
+			Start:  start,
+			End:    "+",
+			Count:  int64(rc.cfg.StreamBatchSize),
+		}).Result()
+		if err != nil {
+			return err
+		}
+
+		var ids []string
+		for _, p := range pending {
+			rc.mu.Lock()
+			_, inFlight := rc.inFlight[p.ID]
+			rc.mu.Unlock()
+			switch {
+			case inFlight:
+				slog.Debug("Stale stream entry is still being processed here, not claiming it", "stream", rc.key, "id", p.ID, "idle", p.Idle.String())
+			case rc.cfg.MaxDeliveries > 0 && p.RetryCount >= int64(rc.cfg.MaxDeliveries):
+				slog.Error("Stream entry reached the delivery limit, acknowledging it without processing it",
+					"stream", rc.key, "id", p.ID, "consumer", p.Consumer, "deliveries", p.RetryCount)
+				rc.ack(ctx, p.ID)
+			default:
+				ids = append(ids, p.ID)
+			}
+		}
+
+		if len(ids) > 0 {
+			msgs, err := rc.claim(ctx, ids)
+			if err != nil {
+				return err
+			}
+			if len(msgs) > 0 {
+				slog.Info("Claimed stale stream entries", "stream", rc.key, "count", len(msgs))
+			}
+			for _, msg := range msgs {
+				if err := rc.submitStreamMessage(ctx, msg); err != nil {
+					return err
+				}
+				if ctx.Err() != nil {
+					return nil
+				}
+			}
+		}
+
+		if len(pending) < rc.cfg.StreamBatchSize {
+			return nil
+		}
+		start = nextStreamID(pending[len(pending)-1].ID)
+	}
+}
+
+// nextStreamID returns the smallest stream entry ID after id, to continue a
+// range after it; exclusive ranges need Redis 6.2.
+func nextStreamID(id string) string {
+	ms, seq, _ := strings.Cut(id, "-")
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return id
+	}
+	return ms + "-" + strconv.FormatUint(n+1, 10)
+}
+
+// claim runs XCLAIM for ids, which only takes over entries still idle for
+// ClaimMinIdle, so an entry another instance claimed meanwhile is skipped. The
+// reply is parsed by hand: Redis before 7 returns nil for entries deleted from
+// the stream while pending, which the go-redis v8 helper fails on.
+func (rc *RedisConsumer) claim(ctx context.Context, ids []string) ([]redis.XMessage, error) {
+	args := []interface{}{"XCLAIM", rc.key, rc.cfg.StreamGroup, rc.cfg.ConsumerName, rc.cfg.ClaimMinIdle.Milliseconds()}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	entries, err := rc.client.Do(ctx, args...).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []redis.XMessage
+	for _, e := range entries {
+		entry, ok := e.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue // Entry deleted from the stream while pending
+		}
+		id, _ := entry[0].(string)
+		fields, _ := entry[1].([]interface{})
+		values := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if k, ok := fields[i].(string); ok {
+				values[k] = fields[i+1]
+			}
+		}
+		msgs = append(msgs, redis.XMessage{ID: id, Values: values})
+	}
+	return msgs, nil
+}
+
+// streamLag returns the "lag" of the consumer group as reported by XINFO GROUPS:
+// the number of entries not delivered to any consumer yet. Redis only reports it
+// from version 7.0, and not at all when entries were deleted from the middle of
+// the stream.
+func (rc *RedisConsumer) streamLag(ctx context.Context) (int64, error) {
+	groups, err := rc.client.Do(ctx, "XINFO", "GROUPS", rc.key).Slice()
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range groups {
+		fields, ok := g.([]interface{})
+		if !ok {
+			continue
+		}
+		info := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if k, ok := fields[i].(string); ok {
+				info[k] = fields[i+1]
+			}
+		}
+		if info["name"] != rc.cfg.StreamGroup {
+			continue
+		}
+		lag, ok := info["lag"].(int64)
+		if !ok {
+			return 0, fmt.Errorf("lag of consumer group %s on stream %s is unknown", rc.cfg.StreamGroup, rc.key)
+		}
+		return lag, nil
+	}
+	return 0, fmt.Errorf("consumer group %s not found on stream %s", rc.cfg.StreamGroup, rc.key)
+}
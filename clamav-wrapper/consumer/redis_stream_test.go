@@ -0,0 +1,129 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/models"
+)
+
+func TestRedisClaimStale(t *testing.T) {
+	m := miniredis.RunT(t)
+	processed := make(chan string, 10)
+	pool := startPool(t, func(ctx context.Context, bucket, key, versionID string) error {
+		processed <- key
+		return nil
+	})
+	cfg := config.RedisConfig{
+		Address:         m.Addr(),
+		Key:             "events",
+		Mode:            RedisModeStream,
+		ConsumerName:    "a",
+		StreamGroup:     "clamav-wrapper",
+		StreamField:     "event",
+		StreamBatchSize: 2,
+		ClaimMinIdle:    time.Minute,
+		ClaimInterval:   time.Hour,
+		MaxDeliveries:   3,
+	}
+	rc, err := NewRedisConsumer(cfg, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	rc.filter = newEventFilter(config.EventFilterConfig{Types: []string{"s3:ObjectCreated:*"}})
+
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer client.Close()
+	if err := client.XGroupCreateMkStream(ctx, cfg.Key, cfg.StreamGroup, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, key := range []string{"slow.txt", "poison.txt", "stale.txt", "other.txt"} {
+		record := models.NewS3Record("staging", key)
+		record.EventName = "s3:ObjectCreated:Put"
+		payload, err := json.Marshal(models.RedisEvent{{Event: []models.S3Record{record}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := client.XAdd(ctx, &redis.XAddArgs{Stream: cfg.Key, Values: map[string]interface{}{"event": payload}}).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// slow.txt and poison.txt were delivered to this instance, the others to one that died.
+	for consumer, count := range map[string]int64{"a": 2, "b": 2} {
+		if err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: cfg.StreamGroup, Consumer: consumer, Streams: []string{cfg.Key, ">"}, Count: count}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// slow.txt is still being processed here; poison.txt has been delivered as often as allowed.
+	rc.inFlight[ids[0]] = struct{}{}
+	if err := client.Do(ctx, "XCLAIM", cfg.Key, cfg.StreamGroup, "a", 0, ids[1], "RETRYCOUNT", cfg.MaxDeliveries).Err(); err != nil {
+		t.Fatal(err)
+	}
+	m.SetTime(time.Now().Add(time.Hour))
+
+	if err := rc.claimStale(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case key := <-processed:
+			got[key] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("processed %v, want stale.txt and other.txt", got)
+		}
+	}
+	if !got["stale.txt"] || !got["other.txt"] {
+		t.Errorf("processed %v, want stale.txt and other.txt", got)
+	}
+
+	// Processed entries are acknowledged, the poison one dropped, the slow one left alone.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := client.XPendingExt(ctx, &redis.XPendingExtArgs{Stream: cfg.Key, Group: cfg.StreamGroup, Start: "-", End: "+", Count: 10}).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 1 && pending[0].ID == ids[0] && pending[0].Consumer == "a" && pending[0].RetryCount == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending entries %+v, want only %s, delivered once", pending, ids[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case key := <-processed:
+		t.Errorf("%s processed as well", key)
+	default:
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.inFlight) != 1 {
+		t.Errorf("%d entries in flight, want only the slow one", len(rc.inFlight))
+	}
+}
+
+func TestNextStreamID(t *testing.T) {
+	for id, want := range map[string]string{
+		"1700000000000-0":        "1700000000000-1",
+		"1700000000000-9":        "1700000000000-10",
+		"5-18446744073709551614": "5-18446744073709551615",
+	} {
+		if got := nextStreamID(id); got != want {
+			t.Errorf("nextStreamID(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
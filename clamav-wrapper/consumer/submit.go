@@ -0,0 +1,58 @@
+package consumer
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"clamav-wrapper/models"
+	"clamav-wrapper/worker"
+)
+
+// submitRecords submits records to the worker pool and calls done once, with
+// nil when every record was processed successfully, or else with the first
+// error. If a record cannot be submitted (ctx cancelled or pool closed), the
+// error is returned and done is called with it once the records submitted
+// before it are done. With no records, done is called right away.
+func submitRecords(ctx context.Context, pool *worker.Pool, records []models.S3Record, done func(error)) error {
+	if len(records) == 0 {
+		done(nil)
+		return nil
+	}
+
+	var (
+		mu        sync.Mutex
+		remaining = len(records)
+		first     error
+	)
+	finish := func(err error) {
+		mu.Lock()
+		if first == nil {
+			first = err
+		}
+		remaining--
+		last, err := remaining == 0, first
+		mu.Unlock()
+		if last {
+			done(err)
+		}
+	}
+
+	for i, r := range records {
+		bucket, key := r.S3.Bucket.Name, r.S3.Object.Key
+		err := pool.Submit(ctx, bucket, key, r.S3.Object.VersionID, func(err error) {
+			if err != nil {
+				slog.ErrorContext(ctx, "Error processing event", "bucket", bucket, "key", key, "error", err)
+			}
+			finish(err)
+		})
+		if err != nil {
+			// Records that were never submitted count as failed.
+			for range records[i:] {
+				finish(err)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+// Package deadletter publishes file events that could not be processed to a
+// dead-letter Kafka topic or Redis list, and replays them into the main queue.
+package deadletter
+
+import (
+	"context"
+	"fmt"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/models"
+)
+
+// Publisher stores dead-lettered events.
+type Publisher interface {
+	// Publish stores a single dead-lettered event.
+	Publish(ctx context.Context, event models.DeadLetterEvent) error
+
+	// Close releases the connection to the dead-letter store.
+	Close() error
+}
+
+// NewPublisher creates the publisher selected by cfg.Type.
+// It returns nil, nil when dead-lettering is disabled (empty type).
+func NewPublisher(cfg config.DeadLetterConfig) (Publisher, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "kafka":
+		return NewKafkaPublisher(config.KafkaCfg, cfg.KafkaTopic)
+	case "redis":
+		return NewRedisPublisher(config.RedisCfg, cfg.RedisKey)
+	default:
+		return nil, fmt.Errorf("unsupported dead-letter type: %s", cfg.Type)
+	}
+}
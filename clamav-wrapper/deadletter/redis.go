@@ -0,0 +1,45 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/messaging"
+	"clamav-wrapper/models"
+)
+
+// RedisPublisher appends dead-lettered events as JSON to a Redis list.
+type RedisPublisher struct {
+	client *redis.Client
+	key    string
+}
+
+// NewRedisPublisher creates a publisher for the list key on the server of cfg.
+func NewRedisPublisher(cfg config.RedisConfig, key string) (*RedisPublisher, error) {
+	if key == "" {
+		return nil, fmt.Errorf("dead-letter Redis key cannot be empty")
+	}
+	client, err := messaging.NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisPublisher{client: client, key: key}, nil
+}
+
+// Publish appends event to the dead-letter list.
+func (p *RedisPublisher) Publish(ctx context.Context, event models.DeadLetterEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return p.client.RPush(ctx, p.key, value).Err()
+}
+
+// Close closes the Redis client.
+func (p *RedisPublisher) Close() error {
+	return p.client.Close()
+}
@@ -0,0 +1,239 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/segmentio/kafka-go"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/consumer"
+	"clamav-wrapper/messaging"
+	"clamav-wrapper/models"
+)
+
+// replayIdleTimeout ends a Kafka replay once no dead-lettered event arrived for this long.
+const replayIdleTimeout = 10 * time.Second
+
+// EnqueueFunc hands a dead-lettered event back for processing, e.g. by putting
+// it into the main queue as a fresh S3 notification.
+type EnqueueFunc func(ctx context.Context, event models.DeadLetterEvent) error
+
+// Replay moves up to limit dead-lettered events (all of them when limit is 0)
+// from the dead-letter queue described by cfg to enqueue, or when enqueue is
+// nil, back into the main queue of config.MessageBrokerType. An event is only
+// removed from the dead-letter queue after enqueue succeeded. It returns the
+// number of events replayed.
+func Replay(ctx context.Context, cfg config.DeadLetterConfig, limit int, enqueue EnqueueFunc) (int, error) {
+	if enqueue == nil {
+		var closeEnqueue func()
+		var err error
+		enqueue, closeEnqueue, err = newEnqueuer(config.MessageBrokerType)
+		if err != nil {
+			return 0, err
+		}
+		defer closeEnqueue()
+	}
+
+	switch cfg.Type {
+	case "kafka":
+		return replayKafka(ctx, cfg, limit, enqueue)
+	case "redis":
+		return replayRedis(ctx, cfg, limit, enqueue)
+	case "":
+		return 0, errors.New("dead-lettering is disabled, set DEAD_LETTER_TYPE")
+	default:
+		return 0, fmt.Errorf("unsupported dead-letter type: %s", cfg.Type)
+	}
+}
+
+// newEnqueuer returns a function writing to the main queue of brokerType.
+func newEnqueuer(brokerType string) (EnqueueFunc, func(), error) {
+	switch brokerType {
+	case "kafka":
+		w := messaging.NewKafkaWriter(config.KafkaCfg.Brokers, config.KafkaCfg.Topic)
+		enqueue := func(ctx context.Context, event models.DeadLetterEvent) error {
+			return w.WriteJSON(ctx, event.Bucket+"/"+event.Key, models.KafkaEvent{
+				Records: []models.S3Record{replayRecord(event)},
+			})
+		}
+		return enqueue, func() { w.Close() }, nil
+
+	case "redis":
+		cfg := config.RedisCfg
+		client, err := messaging.NewRedisClient(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		enqueue := func(ctx context.Context, event models.DeadLetterEvent) error {
+			payload, err := json.Marshal(models.RedisEvent{
+				{Event: []models.S3Record{replayRecord(event)}},
+			})
+			if err != nil {
+				return err
+			}
+			if cfg.Mode == consumer.RedisModeStream {
+				return client.XAdd(ctx, &redis.XAddArgs{
+					Stream: cfg.Key,
+					Values: map[string]interface{}{cfg.StreamField: string(payload)},
+				}).Err()
+			}
+			return client.RPush(ctx, cfg.Key, payload).Err()
+		}
+		return enqueue, func() { client.Close() }, nil
+
+	case "nats":
+		cfg := config.NATSCfg
+		if cfg.Subject == "" || strings.ContainsAny(cfg.Subject, "*>") {
+			return nil, nil, errors.New("replaying into NATS requires NATS_SUBJECT to name a single subject of the stream")
+		}
+		conn, err := nats.Connect(cfg.URL, consumer.NATSOptions(cfg)...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		js, err := jetstream.New(conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		enqueue := func(ctx context.Context, event models.DeadLetterEvent) error {
+			payload, err := json.Marshal(models.NotificationEvent{Records: []models.S3Record{replayRecord(event)}})
+			if err != nil {
+				return err
+			}
+			_, err = js.Publish(ctx, cfg.Subject, payload)
+			return err
+		}
+		return enqueue, func() { conn.Close() }, nil
+
+	case "amqp", "rabbitmq":
+		cfg := config.AMQPCfg
+		conn, err := amqp.Dial(cfg.URL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to AMQP broker: %w", err)
+		}
+		ch, err := conn.Channel()
+		if err == nil {
+			err = ch.Confirm(false)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("failed to open AMQP channel: %w", err)
+		}
+		enqueue := func(ctx context.Context, event models.DeadLetterEvent) error {
+			payload, err := json.Marshal(models.NotificationEvent{Records: []models.S3Record{replayRecord(event)}})
+			if err != nil {
+				return err
+			}
+			// The default exchange routes straight to the queue named by the routing key.
+			confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", cfg.Queue, false, false, amqp.Publishing{
+				ContentType:  "application/json",
+				DeliveryMode: amqp.Persistent,
+				Body:         payload,
+			})
+			if err != nil {
+				return err
+			}
+			if ok, err := confirm.WaitContext(ctx); err != nil || !ok {
+				return fmt.Errorf("AMQP broker did not confirm the message: %v", err)
+			}
+			return nil
+		}
+		return enqueue, func() { conn.Close() }, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported message broker type: %s", brokerType)
+	}
+}
+
+// replayRecord builds the notification record enqueued again for event.
+func replayRecord(event models.DeadLetterEvent) models.S3Record {
+	r := models.NewS3Record(event.Bucket, event.Key)
+	r.S3.Object.VersionID = event.VersionID
+	return r
+}
+
+// replayKafka reads the dead-letter topic with its own consumer group and
+// commits each event once it was enqueued again. It stops when the topic has
+// been idle for replayIdleTimeout.
+func replayKafka(ctx context.Context, cfg config.DeadLetterConfig, limit int, enqueue EnqueueFunc) (int, error) {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: config.KafkaCfg.Brokers,
+		Topic:   cfg.KafkaTopic,
+		GroupID: cfg.ReplayGroupID,
+	})
+	defer r.Close()
+
+	replayed := 0
+	for limit == 0 || replayed < limit {
+		fetchCtx, cancel := context.WithTimeout(ctx, replayIdleTimeout)
+		m, err := r.FetchMessage(fetchCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				break // Nothing left to replay
+			}
+			return replayed, err
+		}
+
+		var event models.DeadLetterEvent
+		if err := json.Unmarshal(m.Value, &event); err != nil {
+			slog.Warn("Skipping invalid dead-letter message", "offset", m.Offset, "error", err)
+		} else {
+			if err := enqueue(ctx, event); err != nil {
+				return replayed, fmt.Errorf("failed to enqueue %s/%s: %w", event.Bucket, event.Key, err)
+			}
+			replayed++
+		}
+
+		if err := r.CommitMessages(ctx, m); err != nil {
+			return replayed, fmt.Errorf("failed to commit dead-letter offset %d: %w", m.Offset, err)
+		}
+	}
+	return replayed, nil
+}
+
+// replayRedis enqueues the head of the dead-letter list and only then pops it,
+// so an interrupted replay never loses an event (it may enqueue one twice).
+func replayRedis(ctx context.Context, cfg config.DeadLetterConfig, limit int, enqueue EnqueueFunc) (int, error) {
+	client, err := messaging.NewRedisClient(config.RedisCfg)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	replayed := 0
+	for limit == 0 || replayed < limit {
+		value, err := client.LIndex(ctx, cfg.RedisKey, 0).Result()
+		if err == redis.Nil {
+			break // Dead-letter list is empty
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		var event models.DeadLetterEvent
+		if err := json.Unmarshal([]byte(value), &event); err != nil {
+			slog.Warn("Skipping invalid dead-letter entry", "key", cfg.RedisKey, "error", err)
+		} else {
+			if err := enqueue(ctx, event); err != nil {
+				return replayed, fmt.Errorf("failed to enqueue %s/%s: %w", event.Bucket, event.Key, err)
+			}
+			replayed++
+		}
+
+		if err := client.LPop(ctx, cfg.RedisKey).Err(); err != nil {
+			return replayed, fmt.Errorf("failed to remove replayed entry from %s: %w", cfg.RedisKey, err)
+		}
+	}
+	return replayed, nil
+}
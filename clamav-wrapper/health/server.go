@@ -0,0 +1,167 @@
+// Package health serves the liveness, readiness and Prometheus metrics
+// endpoints used by orchestrators and monitoring.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// checkTimeout bounds each dependency check of a /healthz or /readyz request.
+const checkTimeout = 5 * time.Second
+
+// Check verifies that a dependency (clamd, a bucket, the broker) is reachable.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Report is the body of /healthz and /readyz: "ok" or the error of every check.
+type Report struct {
+	Status string            `json:"status"` // "ok", "failing" or "not ready"
+	Checks map[string]string `json:"checks"`
+}
+
+// Server serves /healthz, /readyz and /metrics.
+type Server struct {
+	addr  string
+	http  *http.Server
+	ready atomic.Bool
+
+	mu     sync.Mutex
+	checks []Check
+}
+
+// NewServer creates the server for addr. It is not ready until SetReady(true) is called.
+func NewServer(addr string) *Server {
+	s := &Server{addr: addr}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	s.http = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// AddCheck adds a dependency check run by both /healthz and /readyz.
+func (s *Server) AddCheck(name string, run func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks = append(s.checks, Check{Name: name, Run: run})
+}
+
+// SetReady marks the service as ready to receive work (true once the consumer
+// runs) or not (false as soon as it starts shutting down).
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// Start listens on the configured address and serves requests in the background.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+	slog.Info("Health and metrics endpoints listening", "addr", ln.Addr().String())
+
+	go func() {
+		if err := s.http.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Health server error", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the server, waiting for running requests until ctx expires.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// handleHealth answers 200 when every dependency check passes, 503 otherwise.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	report := s.runChecks(r.Context())
+	writeReport(w, report)
+}
+
+// handleReady is like handleHealth, but also fails while the consumer has not
+// started yet and once shutdown began, so no new work is routed to the instance.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	report := s.runChecks(r.Context())
+	if !s.ready.Load() {
+		report.Status = "not ready"
+	}
+	writeReport(w, report)
+}
+
+// runChecks runs every check concurrently. Checks that do not finish within
+// checkTimeout are reported as timed out, even if they ignore ctx.
+func (s *Server) runChecks(ctx context.Context) Report {
+	s.mu.Lock()
+	checks := append([]Check(nil), s.checks...)
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks)) // Buffered so late checks do not block
+	for _, c := range checks {
+		go func(c Check) {
+			results <- result{c.Name, c.Run(ctx)}
+		}(c)
+	}
+
+	report := Report{Status: "ok", Checks: make(map[string]string, len(checks))}
+	for _, c := range checks {
+		report.Checks[c.Name] = "timed out"
+	}
+	for range checks {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				report.Checks[r.name] = r.err.Error()
+			} else {
+				report.Checks[r.name] = "ok"
+			}
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	for _, v := range report.Checks {
+		if v != "ok" {
+			report.Status = "failing"
+		}
+	}
+	return report
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,42 @@
+// Package messaging holds the Kafka and Redis plumbing shared by the packages
+// talking to them: the consumers, the verdict cache, dead-lettering and scan
+// result publishing.
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaWriter writes JSON messages to a Kafka topic. Messages with the same key
+// go to the same partition, so those about one object stay in order.
+type KafkaWriter struct {
+	Writer *kafka.Writer
+}
+
+// NewKafkaWriter creates a writer for topic on brokers. Writes wait for all
+// in-sync replicas to acknowledge them.
+func NewKafkaWriter(brokers []string, topic string) *KafkaWriter {
+	return &KafkaWriter{Writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}}
+}
+
+// WriteJSON writes v as JSON under key and waits for the brokers to acknowledge it.
+func (w *KafkaWriter) WriteJSON(ctx context.Context, key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.Writer.WriteMessages(ctx, kafka.Message{Key: []byte(key), Value: value})
+}
+
+// Close flushes and closes the Kafka writer.
+func (w *KafkaWriter) Close() error {
+	return w.Writer.Close()
+}
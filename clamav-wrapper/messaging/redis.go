@@ -0,0 +1,32 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"clamav-wrapper/config"
+)
+
+// redisPingTimeout bounds the ping checking a new Redis client can connect.
+const redisPingTimeout = 5 * time.Second
+
+// NewRedisClient creates a client for the server of cfg and pings it, so a
+// wrong address or password fails at startup rather than on first use.
+func NewRedisClient(cfg config.RedisConfig) (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Address,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %w", cfg.Address, err)
+	}
+	return client, nil
+}
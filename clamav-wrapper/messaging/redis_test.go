@@ -0,0 +1,32 @@
+package messaging
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"clamav-wrapper/config"
+)
+
+func TestNewRedisClient(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.RequireAuth("secret")
+
+	client, err := NewRedisClient(config.RedisConfig{Address: m.Addr(), Password: "secret", DB: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Set(context.Background(), "k", "v", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m.DB(2).Get("k"); got != "v" {
+		t.Errorf("key written to the wrong database")
+	}
+
+	if _, err := NewRedisClient(config.RedisConfig{Address: m.Addr(), Password: "wrong"}); err == nil || !strings.Contains(err.Error(), m.Addr()) {
+		t.Errorf("NewRedisClient() with a wrong password = %v, want a connection error", err)
+	}
+}
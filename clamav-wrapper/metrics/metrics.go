@@ -0,0 +1,130 @@
+// Package metrics holds the Prometheus metrics exported on /metrics.
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "clamav_wrapper"
+
+var (
+	// FilesScanned counts scans by result: "clean", "infected", "error" or "oversized".
+	FilesScanned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "files_scanned_total",
+		Help:      "Files scanned, by result (clean, infected, error or oversized).",
+	}, []string{"result"})
+
+	// ScanDuration observes how long clamd took to scan a file.
+	ScanDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scan_duration_seconds",
+		Help:      "Time spent streaming a file to clamd and waiting for the verdict.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14), // 5ms to ~41s
+	})
+
+	// CacheLookups counts verdict cache lookups by result: "hit" or "miss".
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scan_cache_lookups_total",
+		Help:      "Verdict cache lookups, by result (hit or miss).",
+	}, []string{"result"})
+
+	// PolicyViolations counts files clamd found clean but the content policy blocked, by reason.
+	PolicyViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "content_policy_violations_total",
+		Help:      "Files blocked by the content policy, by reason.",
+	}, []string{"reason"})
+
+	// EventsSkipped counts bucket notifications the event filter dropped, by
+	// reason: "event-type" or "key".
+	EventsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_skipped_total",
+		Help:      "Bucket notifications not processed because of the event filter, by reason (event-type or key).",
+	}, []string{"reason"})
+
+	// DatabaseVersion is the newest signature database version of the clamd daemons.
+	DatabaseVersion = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "signature_database_version",
+		Help:      "Newest signature database version reported by clamd.",
+	})
+
+	// FilesRescanned counts objects of the clean buckets scanned again after a
+	// signature update, by result: "clean", "infected" or "error".
+	FilesRescanned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "files_rescanned_total",
+		Help:      "Objects of the clean buckets rescanned after a signature update, by result (clean, infected or error).",
+	}, []string{"result"})
+
+	// FileSize observes the size of scanned files.
+	FileSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "file_size_bytes",
+		Help:      "Size of scanned files.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 12), // 1KiB to 4GiB
+	})
+)
+
+// ObserveScan records a completed scan. result is "clean", "infected", "error"
+// or "oversized".
+func ObserveScan(result string, duration time.Duration, size int64) {
+	FilesScanned.WithLabelValues(result).Inc()
+	if result == "error" || result == "oversized" {
+		return
+	}
+	ScanDuration.Observe(duration.Seconds())
+	if size >= 0 {
+		FileSize.Observe(float64(size))
+	}
+}
+
+// RegisterInFlight exports the number of file events being processed, as reported by inFlight.
+func RegisterInFlight(inFlight func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_in_flight",
+		Help:      "File events currently being processed by the worker pool.",
+	}, func() float64 { return float64(inFlight()) })
+}
+
+// lagTimeout bounds the broker round trip made on every scrape to measure lag.
+const lagTimeout = 5 * time.Second
+
+// lagCollector asks the consumer for its lag on every scrape.
+type lagCollector struct {
+	desc *prometheus.Desc
+	lag  func(ctx context.Context) (int64, error)
+}
+
+func (c *lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *lagCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), lagTimeout)
+	defer cancel()
+
+	lag, err := c.lag(ctx)
+	if err != nil {
+		slog.Warn("Failed to measure consumer lag", "error", err)
+		return // Leave the series out rather than report a wrong value
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(lag))
+}
+
+// RegisterConsumerLag exports the number of messages waiting to be consumed, as reported by lag.
+func RegisterConsumerLag(lag func(ctx context.Context) (int64, error)) {
+	prometheus.MustRegister(&lagCollector{
+		desc: prometheus.NewDesc(namespace+"_consumer_lag", "Messages waiting in the broker to be consumed.", nil, nil),
+		lag:  lag,
+	})
+}
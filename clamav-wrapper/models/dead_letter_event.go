@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// DeadLetterEvent records a file event that could not be processed after all retries.
+type DeadLetterEvent struct {
+	Bucket         string    `json:"bucket"`
+	Key            string    `json:"key"` // URL-encoded, as received in the notification
+	VersionID      string    `json:"versionId,omitempty"`
+	Error          string    `json:"error"`
+	Attempts       int       `json:"attempts"`
+	FirstAttemptAt time.Time `json:"firstAttemptAt"`
+	LastAttemptAt  time.Time `json:"lastAttemptAt"`
+	DeadLetteredAt time.Time `json:"deadLetteredAt"`
+	Source         string    `json:"source"` // Message broker type the event was consumed from
+}
@@ -1,14 +1,4 @@
 package models
 
-type KafkaEvent struct {
-	Records []struct {
-		S3 struct {
-			Bucket struct {
-				Name string `json:"name"`
-			} `json:"bucket"`
-			Object struct {
-				Key string `json:"key"`
-			} `json:"object"`
-		} `json:"s3"`
-	} `json:"Records"`
-}
+// KafkaEvent is the message MinIO publishes to Kafka.
+type KafkaEvent = NotificationEvent
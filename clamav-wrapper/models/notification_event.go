@@ -0,0 +1,10 @@
+package models
+
+// NotificationEvent is a bucket event notification as MinIO publishes it to its
+// Kafka, NATS and AMQP targets: the records of a single event, with its name
+// and "<bucket>/<key>" repeated at the top level.
+type NotificationEvent struct {
+	EventName string     `json:"EventName,omitempty"`
+	Key       string     `json:"Key,omitempty"`
+	Records   []S3Record `json:"Records"`
+}
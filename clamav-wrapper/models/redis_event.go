@@ -1,14 +1,5 @@
 package models
 
 type RedisEvent []struct {
-	Event []struct {
-		S3 struct {
-			Bucket struct {
-				Name string `json:"name"`
-			} `json:"bucket"`
-			Object struct {
-				Key string `json:"key"`
-			} `json:"object"`
-		} `json:"s3"`
-	} `json:"Event"`
+	Event []S3Record `json:"Event"`
 }
@@ -0,0 +1,82 @@
+package models
+
+import "time"
+
+// S3Record is a single record of an S3 bucket event notification, as sent by
+// MinIO and AWS S3. Fields a sender leaves out are zero; records replayed from
+// the dead-letter queue only carry the bucket name and object key.
+type S3Record struct {
+	EventVersion      string            `json:"eventVersion,omitempty"`
+	EventSource       string            `json:"eventSource,omitempty"` // "minio:s3" or "aws:s3"
+	AWSRegion         string            `json:"awsRegion,omitempty"`
+	EventTime         string            `json:"eventTime,omitempty"`    // RFC 3339, see Time
+	EventName         string            `json:"eventName,omitempty"`    // e.g. "s3:ObjectCreated:Put"; AWS leaves out the "s3:" prefix
+	UserIdentity      *Identity         `json:"userIdentity,omitempty"` // Who made the request
+	RequestParameters map[string]string `json:"requestParameters,omitempty"`
+	ResponseElements  map[string]string `json:"responseElements,omitempty"`
+	S3                S3Entity          `json:"s3"`
+	Source            *S3Source         `json:"source,omitempty"` // MinIO only
+}
+
+// Identity names the principal behind a request.
+type Identity struct {
+	PrincipalID string `json:"principalId"`
+}
+
+// S3Entity describes the bucket and object an event is about.
+type S3Entity struct {
+	SchemaVersion   string   `json:"s3SchemaVersion,omitempty"`
+	ConfigurationID string   `json:"configurationId,omitempty"`
+	Bucket          S3Bucket `json:"bucket"`
+	Object          S3Object `json:"object"`
+}
+
+// S3Bucket is the bucket of an event.
+type S3Bucket struct {
+	Name          string    `json:"name"`
+	OwnerIdentity *Identity `json:"ownerIdentity,omitempty"`
+	ARN           string    `json:"arn,omitempty"`
+}
+
+// S3Object is the object of an event. Key is URL-encoded.
+type S3Object struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size,omitempty"`
+	ETag         string            `json:"eTag,omitempty"`
+	VersionID    string            `json:"versionId,omitempty"`
+	Sequencer    string            `json:"sequencer,omitempty"`
+	ContentType  string            `json:"contentType,omitempty"`  // MinIO only
+	UserMetadata map[string]string `json:"userMetadata,omitempty"` // MinIO only
+}
+
+// S3Source is the client a MinIO request came from.
+type S3Source struct {
+	Host      string `json:"host"`
+	Port      string `json:"port"`
+	UserAgent string `json:"userAgent"`
+}
+
+// NewS3Record builds a record for an object; key must be URL-encoded like in MinIO notifications.
+func NewS3Record(bucketName, objectKeyEncoded string) S3Record {
+	var r S3Record
+	r.S3.Bucket.Name = bucketName
+	r.S3.Object.Key = objectKeyEncoded
+	return r
+}
+
+// Time returns when the event happened, or the zero time if the record does not say.
+func (r S3Record) Time() time.Time {
+	t, err := time.Parse(time.RFC3339Nano, r.EventTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Requester returns the principal that made the request, "" if unknown.
+func (r S3Record) Requester() string {
+	if r.UserIdentity != nil && r.UserIdentity.PrincipalID != "" {
+		return r.UserIdentity.PrincipalID
+	}
+	return r.RequestParameters["principalId"]
+}
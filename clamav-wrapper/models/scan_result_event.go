@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// ScanResultEvent is published for every object that was scanned and then moved
+// or tagged, and as an alert for every object of a clean bucket a rescan after
+// a signature update found infected; Bucket and Key then name the clean copy.
+type ScanResultEvent struct {
+	Bucket       string    `json:"bucket"`              // Bucket the object was uploaded to
+	Key          string    `json:"key"`                 // Decoded object key
+	VersionID    string    `json:"versionId,omitempty"` // Version scanned, on versioned buckets
+	ETag         string    `json:"eTag,omitempty"`      // ETag of the content scanned
+	Verdict      string    `json:"verdict"`
+	Signature    string    `json:"signature,omitempty"` // Only set for infected objects
+	Reason       string    `json:"reason,omitempty"`    // Why the object was not scanned, for the "unscanned" verdict
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256,omitempty"`
+	DurationMs   int64     `json:"durationMs"`       // Time clamd took to scan the object
+	Cached       bool      `json:"cached,omitempty"` // Verdict taken from the cache of earlier scans of the same content
+	TargetBucket string    `json:"targetBucket"`     // Same as Bucket when tagging in place
+	TargetKey    string    `json:"targetKey"`        // Key in TargetBucket, which routing rules may rewrite
+	ScannedAt    time.Time `json:"scannedAt"`
+	Rescan       bool      `json:"rescan,omitempty"` // Found by a rescan of a clean bucket, and moved to quarantine
+}
@@ -0,0 +1,166 @@
+package policy
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// maxNestedSize is the largest archive member opened to look inside it. Members
+// are decompressed into memory, so larger ones are only counted as a level of
+// nesting, without looking further.
+const maxNestedSize = 64 << 20
+
+// maxInspectDepth bounds the recursion when no depth limit is configured.
+const maxInspectDepth = 16
+
+// ErrCorrupt is wrapped by the errors Inspect returns for archives it cannot
+// walk: truncated, or with damaged headers.
+var ErrCorrupt = errors.New("corrupt archive")
+
+// corrupt returns an error wrapping ErrCorrupt.
+func corrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+var (
+	zipMagic  = []byte("PK\x03\x04")
+	rar4Magic = []byte("Rar!\x1a\x07\x00")
+	rar5Magic = []byte("Rar!\x1a\x07\x01\x00")
+)
+
+// Content describes what inspecting a file found.
+type Content struct {
+	MIME      string `json:"mime"`                // Detected from the leading bytes, without parameters
+	Encrypted bool   `json:"encrypted,omitempty"` // A ZIP or RAR archive with encrypted members or headers
+	Macros    bool   `json:"macros,omitempty"`    // An OOXML document with a VBA project
+	Depth     int    `json:"depth,omitempty"`     // Levels of nested archives: 1 for a ZIP, 2 for a ZIP in a ZIP...
+	Corrupt   bool   `json:"corrupt,omitempty"`   // An archive that could not be walked, so what it holds is unknown
+}
+
+// Inspect detects the type of the size bytes of r and looks inside ZIP (and
+// OOXML) and RAR archives. ZIP members that are archives themselves are
+// inspected in turn, down to maxDepth levels (0 means no limit): once an
+// archive is known to be nested deeper than that, the exact depth no longer matters.
+// For a truncated or damaged archive, at any level, it returns what it found
+// so far with Corrupt set, and an error wrapping ErrCorrupt.
+func Inspect(r io.ReaderAt, size int64, maxDepth int) (*Content, error) {
+	if maxDepth <= 0 || maxDepth > maxInspectDepth {
+		maxDepth = maxInspectDepth
+	}
+	mtype, err := mimetype.DetectReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	c := &Content{MIME: baseType(mtype.String())}
+	if err := inspectArchive(c, r, size, 1, maxDepth); err != nil {
+		if errors.Is(err, ErrCorrupt) {
+			c.Corrupt = true
+			return c, err
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// inspectArchive records what the archive r, found at nesting level depth,
+// contains. Anything that is not a ZIP or RAR archive is left alone.
+func inspectArchive(c *Content, r io.ReaderAt, size int64, depth, maxDepth int) error {
+	head := make([]byte, len(rar5Magic))
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, zipMagic):
+		c.Depth = max(c.Depth, depth)
+		return inspectZip(c, r, size, depth, maxDepth)
+	case bytes.HasPrefix(head, rar4Magic):
+		c.Depth = max(c.Depth, depth)
+		encrypted, err := rar4Encrypted(io.NewSectionReader(r, 0, size))
+		c.Encrypted = c.Encrypted || encrypted
+		return err
+	case bytes.HasPrefix(head, rar5Magic):
+		c.Depth = max(c.Depth, depth)
+		encrypted, err := rar5Encrypted(io.NewSectionReader(r, 0, size))
+		c.Encrypted = c.Encrypted || encrypted
+		return err
+	}
+	return nil
+}
+
+func inspectZip(c *Content, r io.ReaderAt, size int64, depth, maxDepth int) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return corrupt("ZIP: %v", err)
+	}
+	for _, f := range zr.File {
+		if f.Flags&0x1 != 0 {
+			c.Encrypted = true
+			continue // Its content cannot be read anyway
+		}
+		if isVBAProject(f.Name) {
+			c.Macros = true
+		}
+		if depth >= maxDepth || f.FileInfo().IsDir() {
+			continue
+		}
+		if err := inspectMember(c, f, depth, maxDepth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inspectMember inspects a ZIP member that is an archive itself.
+func inspectMember(c *Content, f *zip.File, depth, maxDepth int) error {
+	rc, err := f.Open()
+	if errors.Is(err, zip.ErrAlgorithm) {
+		return nil // Compressed with a method Go cannot read: left to clamd
+	}
+	if err != nil {
+		return corrupt("ZIP member %s: %v", f.Name, err)
+	}
+	defer rc.Close()
+
+	head := make([]byte, len(rar5Magic))
+	n, err := io.ReadFull(rc, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return corrupt("ZIP member %s: %v", f.Name, err)
+	}
+	head = head[:n]
+	if !bytes.HasPrefix(head, zipMagic) && !bytes.HasPrefix(head, rar4Magic) && !bytes.HasPrefix(head, rar5Magic) {
+		return nil
+	}
+	if f.UncompressedSize64 > maxNestedSize {
+		c.Depth = max(c.Depth, depth+1)
+		return nil
+	}
+
+	rest, err := io.ReadAll(io.LimitReader(rc, maxNestedSize))
+	if err != nil {
+		return corrupt("ZIP member %s: %v", f.Name, err)
+	}
+	data := append(head, rest...)
+	return inspectArchive(c, bytes.NewReader(data), int64(len(data)), depth+1, maxDepth)
+}
+
+// isVBAProject reports whether name is the macro storage of an OOXML document
+// (word/vbaProject.bin, xl/vbaProject.bin, ppt/vbaProject.bin).
+func isVBAProject(name string) bool {
+	return strings.EqualFold(path.Base(name), "vbaProject.bin")
+}
+
+// baseType strips the parameters of a MIME type, e.g. "; charset=utf-8".
+func baseType(mtype string) string {
+	t, _, _ := strings.Cut(mtype, ";")
+	return strings.TrimSpace(t)
+}
@@ -0,0 +1,256 @@
+package policy
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// member is a file of a crafted ZIP archive.
+type member struct {
+	name      string
+	data      []byte
+	encrypted bool // Only flagged as such; the data is stored as is
+}
+
+func zipOf(t *testing.T, members ...member) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range members {
+		fh := &zip.FileHeader{Name: m.name, Method: zip.Store}
+		if m.encrypted {
+			fh.Flags |= 0x1
+		}
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(m.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// rar4Block returns a RAR 4.x block: CRC, type, flags and size, then the
+// 4 byte data size and the data for blocks that have some.
+func rar4Block(typ byte, flags uint16, data []byte) []byte {
+	size := 7
+	if data != nil {
+		flags |= rar4LongBlock
+		size += 4
+	}
+	b := []byte{0, 0, typ}
+	b = binary.LittleEndian.AppendUint16(b, flags)
+	b = binary.LittleEndian.AppendUint16(b, uint16(size))
+	if data != nil {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+		b = append(b, data...)
+	}
+	return b
+}
+
+func rar4Of(blocks ...[]byte) []byte {
+	return append(append([]byte(nil), rar4Magic...), bytes.Join(blocks, nil)...)
+}
+
+// rar5Block returns a RAR 5.0 block: CRC32, header size, then a header of
+// the given type, with the extra area and data given.
+func rar5Block(typ byte, extra, data []byte) []byte {
+	header := []byte{typ}
+	var flags byte
+	if extra != nil {
+		flags |= rar5HasExtra
+	}
+	if data != nil {
+		flags |= rar5HasData
+	}
+	header = append(header, flags)
+	if extra != nil {
+		header = append(header, byte(len(extra)))
+	}
+	if data != nil {
+		header = append(header, byte(len(data)))
+	}
+	header = append(header, 0) // Type-specific flags
+	header = append(header, extra...)
+	b := append([]byte{0, 0, 0, 0, byte(len(header))}, header...)
+	return append(b, data...)
+}
+
+func rar5Of(blocks ...[]byte) []byte {
+	return append(append([]byte(nil), rar5Magic...), bytes.Join(blocks, nil)...)
+}
+
+// strictReader fails the test when asked to read from past the end of its data.
+type strictReader struct {
+	t    *testing.T
+	data []byte
+}
+
+func (r strictReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(r.data)) {
+		r.t.Errorf("read at offset %d of %d bytes", off, len(r.data))
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func inspect(t *testing.T, data []byte, maxDepth int) (*Content, error) {
+	t.Helper()
+	return Inspect(strictReader{t, data}, int64(len(data)), maxDepth)
+}
+
+var (
+	rar5Main      = rar5Block(1, nil, nil)
+	rar5End       = rar5Block(rar5EndHeader, nil, nil)
+	rar5EncRecord = []byte{3, rar5ExtraEncryption, 0, 0} // Size, type, then record data
+)
+
+func TestInspect(t *testing.T) {
+	plainZip := zipOf(t, member{name: "a.txt", data: []byte("hello")})
+	nested := zipOf(t, member{name: "inner.zip", data: zipOf(t, member{name: "innermost.zip", data: plainZip})})
+
+	tests := []struct {
+		name     string
+		data     []byte
+		maxDepth int
+		want     Content
+	}{
+		{name: "text", data: []byte("just text\n"), want: Content{MIME: "text/plain"}},
+		{name: "zip", data: plainZip, want: Content{MIME: "application/zip", Depth: 1}},
+		{
+			name: "encrypted zip",
+			data: zipOf(t, member{name: "a.txt", data: []byte("hello")}, member{name: "secret.txt", data: []byte("x"), encrypted: true}),
+			want: Content{MIME: "application/zip", Encrypted: true, Depth: 1},
+		},
+		{
+			name: "macro-enabled ooxml",
+			data: zipOf(t,
+				member{name: "[Content_Types].xml", data: []byte(`<?xml version="1.0"?><Types></Types>`)},
+				member{name: "word/document.xml", data: []byte("<w:document/>")},
+				member{name: "word/vbaProject.bin", data: []byte("VBA")},
+			),
+			want: Content{MIME: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Macros: true, Depth: 1},
+		},
+		{
+			name: "macros in a nested archive",
+			data: zipOf(t, member{name: "doc.zip", data: zipOf(t, member{name: "xl/vbaProject.bin", data: []byte("VBA")})}),
+			want: Content{MIME: "application/zip", Macros: true, Depth: 2},
+		},
+		{name: "nested", data: nested, want: Content{MIME: "application/zip", Depth: 3}},
+		{name: "depth limit", data: nested, maxDepth: 2, want: Content{MIME: "application/zip", Depth: 2}},
+		{
+			name: "rar4",
+			data: rar4Of(rar4Block(rar4MainHeader, 0, nil), rar4Block(rar4FileHeader, 0, []byte("data")), rar4Block(rar4EndHeader, 0, nil)),
+			want: Content{MIME: "application/x-rar-compressed", Depth: 1},
+		},
+		{
+			name: "rar4 encrypted member",
+			data: rar4Of(rar4Block(rar4MainHeader, 0, nil), rar4Block(rar4FileHeader, rar4FilePassword, []byte("data")), rar4Block(rar4EndHeader, 0, nil)),
+			want: Content{MIME: "application/x-rar-compressed", Encrypted: true, Depth: 1},
+		},
+		{
+			name: "rar4 encrypted headers",
+			data: rar4Of(rar4Block(rar4MainHeader, rar4MainPassword, nil), []byte("encrypted headers")),
+			want: Content{MIME: "application/x-rar-compressed", Encrypted: true, Depth: 1},
+		},
+		{
+			name: "rar4 without end header",
+			data: rar4Of(rar4Block(rar4MainHeader, 0, nil), rar4Block(rar4FileHeader, 0, []byte("data"))),
+			want: Content{MIME: "application/x-rar-compressed", Depth: 1},
+		},
+		{
+			name: "rar5",
+			data: rar5Of(rar5Main, rar5Block(rar5FileHeader, []byte{2, 7, 0}, []byte("data")), rar5End),
+			want: Content{MIME: "application/x-rar-compressed", Depth: 1},
+		},
+		{
+			name: "rar5 encrypted member",
+			data: rar5Of(rar5Main, rar5Block(rar5FileHeader, rar5EncRecord, []byte("data")), rar5End),
+			want: Content{MIME: "application/x-rar-compressed", Encrypted: true, Depth: 1},
+		},
+		{
+			name: "rar5 encrypted headers",
+			data: rar5Of(rar5Block(rar5EncryptionHeader, nil, nil), []byte("encrypted headers")),
+			want: Content{MIME: "application/x-rar-compressed", Encrypted: true, Depth: 1},
+		},
+		{
+			name: "rar in a zip",
+			data: zipOf(t, member{name: "a.rar", data: rar5Of(rar5Main, rar5Block(rar5FileHeader, rar5EncRecord, []byte("data")), rar5End)}),
+			want: Content{MIME: "application/zip", Encrypted: true, Depth: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := inspect(t, tt.data, tt.maxDepth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInspectCorrupt(t *testing.T) {
+	plainZip := zipOf(t, member{name: "a.txt", data: []byte("hello")})
+	rar4 := rar4Of(rar4Block(rar4MainHeader, 0, nil), rar4Block(rar4FileHeader, 0, []byte("data")), rar4Block(rar4EndHeader, 0, nil))
+	rar5 := rar5Of(rar5Main, rar5Block(rar5FileHeader, []byte{2, 7, 0}, []byte("data")), rar5End)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "truncated zip", data: plainZip[:len(plainZip)/2]},
+		{name: "damaged nested zip", data: zipOf(t, member{name: "inner.zip", data: append([]byte("PK\x03\x04"), "garbage"...)})},
+		{name: "rar4 cut in a header", data: rar4[:len(rar4Magic)+3]},
+		{name: "rar4 header too small", data: rar4Of([]byte{0, 0, rar4MainHeader, 0, 0, 3, 0})},
+		{name: "rar4 data past the end", data: rar4[:len(rar4)-len(rar4Block(rar4EndHeader, 0, nil))-2]},
+		{name: "rar4 long block without data size", data: rar4Of([]byte{0, 0, rar4FileHeader, 0, 0, 7, 0})},
+		{name: "rar5 cut in a header", data: rar5[:len(rar5Magic)+6]},
+		{name: "rar5 data past the end", data: rar5[:len(rar5)-len(rar5End)-2]},
+		{name: "rar5 overlong size", data: rar5Of(append([]byte{0, 0, 0, 0}, bytes.Repeat([]byte{0x80}, 12)...))},
+		{name: "rar5 extra area larger than the header", data: rar5Of([]byte{0, 0, 0, 0, 4, rar5FileHeader, rar5HasExtra, 100, 0})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := inspect(t, tt.data, 0)
+			if !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("got error %v, want %v", err, ErrCorrupt)
+			}
+			if got == nil || !got.Corrupt {
+				t.Errorf("got %+v, want Corrupt set", got)
+			}
+		})
+	}
+}
+
+// Every truncation of valid archives is parsed without panicking or reading
+// past the end.
+func TestInspectTruncated(t *testing.T) {
+	for _, data := range [][]byte{
+		zipOf(t, member{name: "inner.zip", data: zipOf(t, member{name: "a.txt", data: []byte("hello")})}),
+		rar4Of(rar4Block(rar4MainHeader, 0, nil), rar4Block(rar4FileHeader, 0, []byte("data")), rar4Block(rar4EndHeader, 0, nil)),
+		rar5Of(rar5Main, rar5Block(rar5FileHeader, rar5EncRecord[:2], []byte("data")), rar5End),
+	} {
+		for n := 0; n <= len(data); n++ {
+			if _, err := inspect(t, data[:n], 0); err != nil && !errors.Is(err, ErrCorrupt) {
+				t.Errorf("%d of %d bytes: %v", n, len(data), err)
+			}
+		}
+	}
+}
+
+func TestCheckCorrupt(t *testing.T) {
+	p := &Policy{}
+	if got := p.Check("uploads", &Content{MIME: "application/zip", Corrupt: true}); got != ReasonCorrupt {
+		t.Errorf("Check() = %q, want %q", got, ReasonCorrupt)
+	}
+}
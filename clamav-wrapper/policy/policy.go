@@ -0,0 +1,100 @@
+// Package policy blocks files clamd has no objection to but which are not
+// wanted anyway: types outside an allow list (or on a deny list) of the bucket
+// they were uploaded to, encrypted archives clamd cannot look into, OOXML
+// documents carrying macros, archives nested too deeply, and archives too
+// damaged to look into. The file type is detected from its content, never
+// from its name.
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"clamav-wrapper/config"
+)
+
+// Reasons a file violates the policy, used in the scan-reason tag.
+const (
+	ReasonTypeDenied     = "type-denied"
+	ReasonTypeNotAllowed = "type-not-allowed"
+	ReasonEncrypted      = "encrypted-archive"
+	ReasonMacros         = "macros"
+	ReasonNestedTooDeep  = "nested-too-deep"
+	ReasonCorrupt        = "corrupt-archive"
+)
+
+// defaultBucket keys the type lists that apply to buckets without their own.
+const defaultBucket = "*"
+
+// Policy decides whether inspected content is acceptable.
+type Policy struct {
+	cfg config.ContentPolicyConfig
+}
+
+// New creates the policy configured by cfg. It returns nil when cfg.Enabled is false.
+func New(cfg config.ContentPolicyConfig) (*Policy, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	for _, lists := range []map[string][]string{cfg.Allow, cfg.Deny} {
+		for bucket, patterns := range lists {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+					return nil, fmt.Errorf("invalid MIME type pattern %q for bucket %s", pattern, bucket)
+				}
+			}
+		}
+	}
+	return &Policy{cfg: cfg}, nil
+}
+
+// MaxDepth is the nesting depth to inspect archives down to.
+func (p *Policy) MaxDepth() int {
+	if p.cfg.MaxDepth <= 0 {
+		return 0
+	}
+	return p.cfg.MaxDepth + 1 // One level more tells whether the limit is exceeded
+}
+
+// Check returns the reason c is not acceptable in bucket, or "" if it is.
+func (p *Policy) Check(bucket string, c *Content) string {
+	if matchAny(listFor(p.cfg.Deny, bucket), c.MIME) {
+		return ReasonTypeDenied
+	}
+	if allow := listFor(p.cfg.Allow, bucket); len(allow) > 0 && !matchAny(allow, c.MIME) {
+		return ReasonTypeNotAllowed
+	}
+	if p.cfg.BlockEncrypted && c.Encrypted {
+		return ReasonEncrypted
+	}
+	if p.cfg.BlockMacros && c.Macros {
+		return ReasonMacros
+	}
+	if p.cfg.MaxDepth > 0 && c.Depth > p.cfg.MaxDepth {
+		return ReasonNestedTooDeep
+	}
+	if c.Corrupt {
+		// What it holds is unknown, so it could be any of the above.
+		return ReasonCorrupt
+	}
+	return ""
+}
+
+// listFor returns the types listed for bucket, or else for every bucket.
+func listFor(lists map[string][]string, bucket string) []string {
+	if list, ok := lists[bucket]; ok {
+		return list
+	}
+	return lists[defaultBucket]
+}
+
+// matchAny reports whether mimeType matches one of patterns, e.g. "image/*".
+func matchAny(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mimeType); ok {
+			return true
+		}
+	}
+	return false
+}
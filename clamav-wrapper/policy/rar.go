@@ -0,0 +1,198 @@
+package policy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// maxRARHeaders bounds the number of headers walked, so damaged archives
+// cannot keep the parser busy.
+const maxRARHeaders = 100000
+
+// RAR 4.x header types and flags.
+const (
+	rar4MainHeader = 0x73
+	rar4FileHeader = 0x74
+	rar4EndHeader  = 0x7b
+
+	rar4MainPassword = 0x0080 // Block headers are encrypted
+	rar4FilePassword = 0x0004 // File data is encrypted
+	rar4LongBlock    = 0x8000 // A 4 byte ADD_SIZE follows the header
+)
+
+// rar4Encrypted reports whether a RAR 4.x archive has encrypted headers or
+// members. A header that is cut short or inconsistent, or a block extending
+// past the end of r, is reported with an error wrapping ErrCorrupt.
+func rar4Encrypted(r *io.SectionReader) (bool, error) {
+	offset := int64(len(rar4Magic))
+	hdr := make([]byte, 11)
+	for i := 0; i < maxRARHeaders; i++ {
+		if offset == r.Size() {
+			return false, nil // The end of archive header is optional
+		}
+		if _, err := r.ReadAt(hdr[:7], offset); err != nil {
+			return false, corrupt("RAR header at %d: %v", offset, err)
+		}
+		typ := hdr[2]
+		flags := binary.LittleEndian.Uint16(hdr[3:5])
+		size := int64(binary.LittleEndian.Uint16(hdr[5:7]))
+		if size < 7 {
+			return false, corrupt("RAR header at %d: size %d", offset, size)
+		}
+
+		switch {
+		case typ == rar4MainHeader && flags&rar4MainPassword != 0:
+			return true, nil
+		case typ == rar4FileHeader && flags&rar4FilePassword != 0:
+			return true, nil
+		case typ == rar4EndHeader:
+			return false, nil
+		}
+
+		var addSize int64
+		if flags&rar4LongBlock != 0 || typ == rar4FileHeader {
+			if size < 11 {
+				return false, corrupt("RAR header at %d: size %d without room for the data size", offset, size)
+			}
+			if _, err := r.ReadAt(hdr[7:11], offset+7); err != nil {
+				return false, corrupt("RAR header at %d: %v", offset, err)
+			}
+			addSize = int64(binary.LittleEndian.Uint32(hdr[7:11]))
+		}
+		if offset+size+addSize > r.Size() {
+			return false, corrupt("RAR block at %d extends past the end of the archive", offset)
+		}
+		offset += size + addSize
+	}
+	return false, corrupt("more than %d RAR headers", maxRARHeaders)
+}
+
+// RAR 5.0 header types, flags and extra record types.
+const (
+	rar5FileHeader       = 2
+	rar5EncryptionHeader = 4
+	rar5EndHeader        = 5
+
+	rar5HasExtra = 0x1
+	rar5HasData  = 0x2
+
+	rar5ExtraEncryption = 0x1
+)
+
+// rar5Encrypted reports whether a RAR 5.0 archive has encrypted headers (an
+// archive encryption header) or members (a file encryption extra record). A
+// header that is cut short or inconsistent, or a block extending past the end
+// of r, is reported with an error wrapping ErrCorrupt.
+func rar5Encrypted(r *io.SectionReader) (bool, error) {
+	offset := int64(len(rar5Magic))
+	for i := 0; i < maxRARHeaders; i++ {
+		if offset == r.Size() {
+			return false, nil // No end of archive header
+		}
+		br := bufio.NewReader(io.NewSectionReader(r, offset+4, 1<<21)) // Skips the header CRC32
+		headerSize, n1, err := readVint(br)
+		if err != nil || headerSize == 0 || headerSize > 1<<21 {
+			return false, corrupt("RAR header at %d: size %d (%v)", offset, headerSize, err)
+		}
+		header := make([]byte, headerSize)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return false, corrupt("RAR header at %d: %v", offset, err)
+		}
+
+		hr := &sliceReader{b: header}
+		typ, _, err := readVint(hr)
+		if err != nil {
+			return false, corrupt("RAR header at %d: %v", offset, err)
+		}
+		flags, _, err := readVint(hr)
+		var extraSize, dataSize uint64
+		if err == nil && flags&rar5HasExtra != 0 {
+			extraSize, _, err = readVint(hr)
+		}
+		if err == nil && flags&rar5HasData != 0 {
+			dataSize, _, err = readVint(hr)
+		}
+		if err != nil || extraSize > uint64(len(header)) {
+			return false, corrupt("RAR header at %d: inconsistent sizes (%v)", offset, err)
+		}
+
+		switch typ {
+		case rar5EncryptionHeader:
+			return true, nil
+		case rar5FileHeader:
+			if hasEncryptionRecord(header[uint64(len(header))-extraSize:]) {
+				return true, nil
+			}
+		case rar5EndHeader:
+			return false, nil
+		}
+		next := offset + 4 + int64(n1) + int64(headerSize)
+		if next > r.Size() || dataSize > uint64(r.Size()-next) {
+			return false, corrupt("RAR block at %d extends past the end of the archive", offset)
+		}
+		offset = next + int64(dataSize)
+	}
+	return false, corrupt("more than %d RAR headers", maxRARHeaders)
+}
+
+// hasEncryptionRecord reports whether the extra area of a RAR 5.0 file header
+// contains a file encryption record.
+func hasEncryptionRecord(extra []byte) bool {
+	er := &sliceReader{b: extra}
+	for er.len() > 0 {
+		size, _, err := readVint(er)
+		if err != nil || size == 0 || size > uint64(er.len()) {
+			return false
+		}
+		record := er.next(int(size))
+		typ, _, err := readVint(&sliceReader{b: record})
+		if err != nil {
+			return false
+		}
+		if typ == rar5ExtraEncryption {
+			return true
+		}
+	}
+	return false
+}
+
+// readVint reads a RAR 5.0 variable length integer: 7 bits per byte, least
+// significant first, with the high bit set on all bytes but the last. It
+// returns the value and the number of bytes it took.
+func readVint(r io.ByteReader) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < 10; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, i, err
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 10, io.ErrUnexpectedEOF
+}
+
+// sliceReader reads bytes off a slice.
+type sliceReader struct {
+	b []byte
+}
+
+func (s *sliceReader) ReadByte() (byte, error) {
+	if len(s.b) == 0 {
+		return 0, io.EOF
+	}
+	c := s.b[0]
+	s.b = s.b[1:]
+	return c, nil
+}
+
+func (s *sliceReader) len() int { return len(s.b) }
+
+func (s *sliceReader) next(n int) []byte {
+	b := s.b[:n]
+	s.b = s.b[n:]
+	return b
+}
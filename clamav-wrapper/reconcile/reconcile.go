@@ -0,0 +1,36 @@
+// Package reconcile finds files left behind in the staging bucket, whose
+// events were lost or dead-lettered, or which were copied but not deleted
+// before a crash, and processes them again.
+package reconcile
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"clamav-wrapper/storage"
+)
+
+// Submit queues an object for processing, like a file event would.
+type Submit func(ctx context.Context, bucket, key string) error
+
+// Run submits every object of bucket last modified more than minAge ago.
+// Younger objects are left to the events announcing them. It returns the
+// number of objects submitted, stopping at the first error of listing or
+// submit (e.g. once ctx is cancelled).
+func Run(ctx context.Context, store storage.Storage, bucket string, minAge time.Duration, submit Submit) (int, error) {
+	cutoff := time.Now().Add(-minAge)
+	n := 0
+	err := store.ListObjects(ctx, bucket, func(obj storage.ObjectInfo) error {
+		if obj.LastModified.After(cutoff) {
+			return nil
+		}
+		slog.DebugContext(ctx, "Resubmitting file found in staging bucket", "bucket", bucket, "key", obj.Key, "last_modified", obj.LastModified)
+		if err := submit(ctx, bucket, obj.Key); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,99 @@
+// Package rescan watches the signature database version of clamd and, when it
+// changes, scans again the objects recently moved to the clean buckets, so that
+// files the older signatures missed are still caught.
+package rescan
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"clamav-wrapper/clamav"
+	"clamav-wrapper/metrics"
+	"clamav-wrapper/storage"
+)
+
+// Rescan scans an object of a clean bucket again, as listed in bucket.
+type Rescan func(ctx context.Context, bucket string, obj storage.ObjectInfo) error
+
+// Watch checks the version returned by version every interval until ctx is
+// cancelled, and exports it as a metric. Whenever the signature database
+// differs from the one seen last, onChange is called with both versions; the
+// first version seen is only recorded, so changes made while the service was
+// not running go unnoticed. onChange runs in the calling goroutine: the next
+// check waits for it.
+func Watch(ctx context.Context, interval time.Duration, version func() *clamav.VersionInfo, onChange func(ctx context.Context, previous, current *clamav.VersionInfo)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last *clamav.VersionInfo
+	for {
+		if v := version(); v != nil {
+			if n, err := strconv.ParseFloat(v.Database, 64); err == nil {
+				metrics.DatabaseVersion.Set(n)
+			}
+			switch {
+			case last == nil:
+				slog.Info("Signature database version", "engine", v.Engine, "database", v.Database, "database_date", v.DatabaseDate)
+			case v.Database != last.Database:
+				slog.Info("Signature database changed", "engine", v.Engine, "database", v.Database, "database_date", v.DatabaseDate, "previous_database", last.Database)
+				onChange(ctx, last, v)
+			}
+			last = v
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run rescans every object of buckets last modified at or after since, with
+// up to concurrency rescans at a time. It returns the number of objects
+// rescanned and how many of them failed. Failures do not stop the others;
+// listing errors and the cancellation of ctx do, once the rescans in progress
+// are done.
+func Run(ctx context.Context, store storage.Storage, buckets []string, since time.Time, concurrency int, rescan Rescan) (rescanned, failed int, err error) {
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		sem = make(chan struct{}, max(concurrency, 1))
+	)
+
+	for _, bucket := range buckets {
+		err := store.ListObjects(ctx, bucket, func(obj storage.ObjectInfo) error {
+			if obj.LastModified.Before(since) {
+				return nil
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := rescan(ctx, bucket, obj)
+				<-sem
+				mu.Lock()
+				rescanned++
+				if err != nil {
+					failed++
+				}
+				mu.Unlock()
+			}()
+			return nil
+		})
+		if err != nil {
+			wg.Wait()
+			return rescanned, failed, fmt.Errorf("failed to list bucket %s: %w", bucket, err)
+		}
+	}
+	wg.Wait()
+	return rescanned, failed, nil
+}
@@ -0,0 +1,29 @@
+package results
+
+import (
+	"context"
+	"fmt"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/messaging"
+	"clamav-wrapper/models"
+)
+
+// KafkaPublisher writes scan results as JSON to a Kafka topic, keyed by
+// "<bucket>/<key>" so results for the same object stay in order.
+type KafkaPublisher struct {
+	*messaging.KafkaWriter
+}
+
+// NewKafkaPublisher creates a publisher for topic on the brokers of cfg.
+func NewKafkaPublisher(cfg config.KafkaConfig, topic string) (*KafkaPublisher, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("result Kafka topic cannot be empty")
+	}
+	return &KafkaPublisher{messaging.NewKafkaWriter(cfg.Brokers, topic)}, nil
+}
+
+// Publish writes event to the result topic and waits for the brokers to acknowledge it.
+func (p *KafkaPublisher) Publish(ctx context.Context, event models.ScanResultEvent) error {
+	return p.WriteJSON(ctx, event.Bucket+"/"+event.Key, event)
+}
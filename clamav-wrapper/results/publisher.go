@@ -0,0 +1,38 @@
+// Package results publishes the outcome of every processed object to a Kafka
+// topic, a Redis list or channel, or an HTTP webhook, so downstream services
+// do not have to poll the clean and quarantine buckets.
+package results
+
+import (
+	"context"
+	"fmt"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/models"
+)
+
+// Publisher delivers scan result events.
+type Publisher interface {
+	// Publish delivers a single scan result event.
+	Publish(ctx context.Context, event models.ScanResultEvent) error
+
+	// Close releases the connection to the target.
+	Close() error
+}
+
+// NewPublisher creates the publisher selected by cfg.Type.
+// It returns nil, nil when result publishing is disabled (empty type).
+func NewPublisher(cfg config.ResultPublisherConfig) (Publisher, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "kafka":
+		return NewKafkaPublisher(config.KafkaCfg, cfg.KafkaTopic)
+	case "redis":
+		return NewRedisPublisher(config.RedisCfg, cfg.RedisKey, cfg.RedisMode)
+	case "webhook":
+		return NewWebhookPublisher(cfg.WebhookURL, cfg.WebhookSecret, cfg.WebhookTimeout)
+	default:
+		return nil, fmt.Errorf("unsupported result publisher type: %s", cfg.Type)
+	}
+}
@@ -0,0 +1,64 @@
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/messaging"
+	"clamav-wrapper/models"
+)
+
+// Redis publishing modes, selected with config.ResultPublisherConfig.RedisMode.
+const (
+	// RedisModeList appends results to a list with RPUSH, where they wait for a reader.
+	RedisModeList = "list"
+	// RedisModePubSub sends results to a channel with PUBLISH. Results are lost
+	// when no subscriber is listening.
+	RedisModePubSub = "pubsub"
+)
+
+// RedisPublisher sends scan results as JSON to a Redis list or Pub/Sub channel.
+type RedisPublisher struct {
+	client *redis.Client
+	key    string // List key or channel name
+	mode   string
+}
+
+// NewRedisPublisher creates a publisher for the list or channel key on the server of cfg.
+func NewRedisPublisher(cfg config.RedisConfig, key string, mode string) (*RedisPublisher, error) {
+	if key == "" {
+		return nil, fmt.Errorf("result Redis key cannot be empty")
+	}
+	switch mode {
+	case RedisModeList, RedisModePubSub:
+	default:
+		return nil, fmt.Errorf("unsupported result Redis mode: %s", mode)
+	}
+
+	client, err := messaging.NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisPublisher{client: client, key: key, mode: mode}, nil
+}
+
+// Publish appends event to the result list or publishes it on the result channel.
+func (p *RedisPublisher) Publish(ctx context.Context, event models.ScanResultEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if p.mode == RedisModePubSub {
+		return p.client.Publish(ctx, p.key, value).Err()
+	}
+	return p.client.RPush(ctx, p.key, value).Err()
+}
+
+// Close closes the Redis client.
+func (p *RedisPublisher) Close() error {
+	return p.client.Close()
+}
@@ -0,0 +1,82 @@
+package results
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"clamav-wrapper/models"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body, computed
+// with the configured webhook secret, prefixed with "sha256=".
+const SignatureHeader = "X-Signature-256"
+
+// WebhookPublisher POSTs scan results as JSON to an HTTP endpoint.
+// Any response other than 2xx is reported as an error.
+type WebhookPublisher struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookPublisher creates a publisher for endpoint. When secret is not
+// empty, every request is signed in the SignatureHeader header.
+func NewWebhookPublisher(endpoint string, secret string, timeout time.Duration) (*WebhookPublisher, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("result webhook URL cannot be empty")
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid result webhook URL: %s", endpoint)
+	}
+	return &WebhookPublisher{
+		url:    endpoint,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Publish POSTs event to the webhook.
+func (p *WebhookPublisher) Publish(ctx context.Context, event models.ScanResultEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(p.secret) > 0 {
+		mac := hmac.New(sha256.New, p.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("result webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // Drain so the connection can be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("result webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Close releases idle connections to the webhook.
+func (p *WebhookPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,149 @@
+// Package retry re-runs failed file events with exponential backoff and hands
+// events that keep failing over to the dead-letter queue.
+package retry
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"time"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/deadletter"
+	"clamav-wrapper/models"
+	"clamav-wrapper/worker"
+)
+
+// backoff returns how long to wait before the given retry (1 for the first
+// retry): InitialBackoff * Multiplier^(retry-1), capped at MaxBackoff, with up
+// to 20% random jitter so that workers failing together do not retry in lockstep.
+func backoff(cfg config.RetryConfig, retry int) time.Duration {
+	d := float64(cfg.InitialBackoff) * math.Pow(cfg.Multiplier, float64(retry-1))
+	if max := float64(cfg.MaxBackoff); cfg.MaxBackoff > 0 && d > max {
+		d = max
+	}
+	d += d * 0.2 * rand.Float64()
+	return time.Duration(d)
+}
+
+// Schedule returns a handler for a worker.Pool that calls handler once per
+// attempt. A failed attempt is retried with exponential backoff, up to
+// cfg.MaxAttempts attempts, by returning a worker.RetryError: the pool runs the
+// event again once the wait is over, and the worker handles other events
+// meanwhile. After the last attempt, the event is given up as Wrap does.
+func Schedule(cfg config.RetryConfig, dlq deadletter.Publisher, handler worker.Handler) worker.Handler {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+
+	return func(ctx context.Context, bucketName string, objectKeyEncoded string, versionID string) error {
+		last := time.Now()
+		attempt, first := worker.Attempt(ctx)
+		pooled := attempt > 0
+		if !pooled {
+			attempt, first = 1, last // Not run by a pool, so there is no one to retry it
+		}
+
+		err := handler(ctx, bucketName, objectKeyEncoded, versionID)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("processing of %s/%s interrupted: %w", bucketName, objectKeyEncoded, err)
+		}
+		if attempt < cfg.MaxAttempts && pooled {
+			wait := backoff(cfg, attempt)
+			logRetry(ctx, cfg, bucketName, objectKeyEncoded, attempt, wait, err)
+			return worker.Retry(err, wait)
+		}
+		return giveUp(ctx, dlq, bucketName, objectKeyEncoded, versionID, attempt, first, last, err)
+	}
+}
+
+// Wrap returns a handler that calls handler up to cfg.MaxAttempts times, waiting
+// with exponential backoff between attempts. When every attempt failed and dlq is
+// not nil, the event is published to the dead-letter queue and reported as
+// handled, so the consumer can commit or acknowledge it. Without a dead-letter
+// queue the last error is returned. If ctx is cancelled while waiting, the
+// event is not dead-lettered and ctx.Err() is returned, so it is redelivered.
+// The handler waits between attempts itself: events run by a worker.Pool
+// should use Schedule instead, which does not hold up the worker.
+func Wrap(cfg config.RetryConfig, dlq deadletter.Publisher, handler worker.Handler) worker.Handler {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+
+	return func(ctx context.Context, bucketName string, objectKeyEncoded string, versionID string) error {
+		var first, last time.Time
+		var err error
+
+		for attempt := 1; ; attempt++ {
+			last = time.Now()
+			if attempt == 1 {
+				first = last
+			}
+			if err = handler(ctx, bucketName, objectKeyEncoded, versionID); err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return fmt.Errorf("processing of %s/%s interrupted: %w", bucketName, objectKeyEncoded, err)
+			}
+			if attempt == cfg.MaxAttempts {
+				break
+			}
+
+			wait := backoff(cfg, attempt)
+			logRetry(ctx, cfg, bucketName, objectKeyEncoded, attempt, wait, err)
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("retry of %s/%s interrupted: %w", bucketName, objectKeyEncoded, ctx.Err())
+			}
+		}
+
+		return giveUp(ctx, dlq, bucketName, objectKeyEncoded, versionID, cfg.MaxAttempts, first, last, err)
+	}
+}
+
+func logRetry(ctx context.Context, cfg config.RetryConfig, bucketName, objectKeyEncoded string, attempt int, wait time.Duration, err error) {
+	slog.WarnContext(ctx, "Attempt failed, retrying",
+		"bucket", bucketName,
+		"key", objectKeyEncoded,
+		"attempt", attempt,
+		"max_attempts", cfg.MaxAttempts,
+		"retry_in", wait.String(),
+		"error", err,
+	)
+}
+
+// giveUp publishes an event that failed every attempt to dlq and reports it as
+// handled, or returns err if there is no dead-letter queue or publishing failed.
+// first and last are when the first and the last attempt started.
+func giveUp(ctx context.Context, dlq deadletter.Publisher, bucketName, objectKeyEncoded, versionID string, attempts int, first, last time.Time, err error) error {
+	if dlq == nil {
+		return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+	}
+
+	event := models.DeadLetterEvent{
+		Bucket:         bucketName,
+		Key:            objectKeyEncoded,
+		VersionID:      versionID,
+		Error:          err.Error(),
+		Attempts:       attempts,
+		FirstAttemptAt: first,
+		LastAttemptAt:  last,
+		DeadLetteredAt: time.Now(),
+		Source:         config.MessageBrokerType,
+	}
+	if pubErr := dlq.Publish(ctx, event); pubErr != nil {
+		return fmt.Errorf("giving up after %d attempts: %w (dead-letter publish failed: %v)", attempts, err, pubErr)
+	}
+
+	slog.ErrorContext(ctx, "Giving up, event sent to the dead-letter queue", "bucket", bucketName, "key", objectKeyEncoded, "attempts", attempts, "error", err)
+	return nil
+}
@@ -0,0 +1,179 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clamav-wrapper/config"
+	"clamav-wrapper/models"
+	"clamav-wrapper/worker"
+)
+
+var errScan = errors.New("scan failed")
+
+// memoryDLQ records the events published to it.
+type memoryDLQ struct {
+	mu     sync.Mutex
+	events []models.DeadLetterEvent
+}
+
+func (d *memoryDLQ) Publish(ctx context.Context, event models.DeadLetterEvent) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, event)
+	return nil
+}
+
+func (d *memoryDLQ) Close() error { return nil }
+
+func (d *memoryDLQ) get() []models.DeadLetterEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]models.DeadLetterEvent(nil), d.events...)
+}
+
+// failingHandler fails the first failures calls for key "flaky", and every
+// call for key "broken".
+func failingHandler(failures int32) (worker.Handler, *atomic.Int32) {
+	var calls atomic.Int32
+	return func(ctx context.Context, bucket, key, version string) error {
+		if key == "ok" {
+			return nil
+		}
+		n := calls.Add(1)
+		if key == "broken" || n <= failures {
+			return errScan
+		}
+		return nil
+	}, &calls
+}
+
+func submit(t *testing.T, pool *worker.Pool, key string) chan error {
+	t.Helper()
+	result := make(chan error, 1)
+	if err := pool.Submit(context.Background(), "staging", key, "", func(err error) { result <- err }); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func wait(t *testing.T, result chan error, timeout time.Duration) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		t.Fatal("event not done in time")
+		return nil
+	}
+}
+
+var testCfg = config.RetryConfig{MaxAttempts: 3, InitialBackoff: 50 * time.Millisecond, Multiplier: 1}
+
+func TestScheduleRetries(t *testing.T) {
+	handler, calls := failingHandler(2)
+	pool, err := worker.NewPool(config.WorkerConfig{Concurrency: 1}, Schedule(testCfg, nil, handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	flaky := submit(t, pool, "flaky")
+	// The only worker is free for other events while the retry waits.
+	if err := wait(t, submit(t, pool, "ok"), 40*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(t, flaky, time.Second); err != nil {
+		t.Fatalf("flaky event failed: %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("handler called %d times, want 3", calls.Load())
+	}
+}
+
+func TestScheduleDeadLetter(t *testing.T) {
+	handler, calls := failingHandler(0)
+	var dlq memoryDLQ
+	pool, err := worker.NewPool(config.WorkerConfig{Concurrency: 1}, Schedule(testCfg, &dlq, handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	start := time.Now()
+	if err := wait(t, submit(t, pool, "broken"), time.Second); err != nil {
+		t.Fatalf("dead-lettered event reported as %v, want handled", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("handler called %d times, want 3", calls.Load())
+	}
+	events := dlq.get()
+	if len(events) != 1 {
+		t.Fatalf("%d events dead-lettered, want 1", len(events))
+	}
+	e := events[0]
+	if e.Key != "broken" || e.Attempts != 3 || e.Error != errScan.Error() {
+		t.Errorf("dead-lettered %+v", e)
+	}
+	if e.FirstAttemptAt.Before(start) || !e.LastAttemptAt.After(e.FirstAttemptAt.Add(90*time.Millisecond)) {
+		t.Errorf("attempts from %v to %v, want two backoffs apart", e.FirstAttemptAt, e.LastAttemptAt)
+	}
+}
+
+// Without a dead-letter queue the last error is reported once retries are exhausted.
+func TestScheduleGiveUp(t *testing.T) {
+	handler, _ := failingHandler(0)
+	pool, err := worker.NewPool(config.WorkerConfig{Concurrency: 1}, Schedule(testCfg, nil, handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	if err := wait(t, submit(t, pool, "broken"), time.Second); !errors.Is(err, errScan) {
+		t.Errorf("event reported as %v, want %v", err, errScan)
+	}
+}
+
+// A retry still waiting when the pool shuts down is reported as interrupted,
+// not dead-lettered, so the event is redelivered.
+func TestScheduleShutdown(t *testing.T) {
+	handler, calls := failingHandler(0)
+	var dlq memoryDLQ
+	cfg := testCfg
+	cfg.InitialBackoff = time.Hour
+	pool, err := worker.NewPool(config.WorkerConfig{Concurrency: 1}, Schedule(cfg, &dlq, handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := submit(t, pool, "broken")
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(t, result, time.Second); !errors.Is(err, worker.ErrClosed) {
+		t.Errorf("pending retry reported as %v, want %v", err, worker.ErrClosed)
+	}
+	if len(dlq.get()) != 0 {
+		t.Error("pending retry dead-lettered at shutdown")
+	}
+}
+
+// Called directly, Wrap waits between attempts itself.
+func TestWrap(t *testing.T) {
+	handler, calls := failingHandler(2)
+	if err := Wrap(testCfg, nil, handler)(context.Background(), "staging", "flaky", ""); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("handler called %d times, want 3", calls.Load())
+	}
+}
@@ -0,0 +1,277 @@
+// Package routing decides where a processed object goes. By default clean
+// files go to CLEAN_BUCKET and infected ones to QUARANTINE_BUCKET under their
+// original key. A rules file can send the objects of each source bucket and
+// key prefix or pattern to buckets and prefixes of their own, and rewrite
+// their keys with templates, e.g. to partition them by date.
+//
+// The rules file is YAML (or JSON, which YAML parsers accept):
+//
+//	rules:
+//	  - bucket: staging
+//	    prefix: product-a/
+//	    clean:
+//	      bucket: product-a-clean
+//	      key: '{{.Time.Format "2006/01/02"}}/{{.Rel}}'
+//	    quarantine:
+//	      bucket: product-a-quarantine
+//	  - bucket: staging
+//	    pattern: "**/*.pdf"
+//	    clean:
+//	      bucket: documents
+//	      prefix: pdf/
+//
+// Rules are tried in order and the first one matching the object applies.
+// Destinations a rule leaves out, and objects no rule matches, use the global
+// buckets and the original key.
+package routing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"clamav-wrapper/config"
+)
+
+// Target is the kind of destination of an object.
+type Target string
+
+const (
+	Clean      Target = "clean"
+	Quarantine Target = "quarantine"
+	Unscanned  Target = "unscanned"
+)
+
+// Object is what key templates can refer to.
+type Object struct {
+	Bucket  string    // Source bucket
+	Key     string    // Source key
+	Rel     string    // Source key without the prefix of the matching rule
+	Dir     string    // Directory part of Key, "." if none
+	Name    string    // Last element of Key
+	Ext     string    // Extension of Name, including the dot
+	Verdict string    // e.g. "clean", "infected"
+	SHA256  string    // Content hash, "" if unknown
+	Time    time.Time // When the object was scanned, UTC
+}
+
+// sampleObject is what key templates are tried on when loading the rules.
+var sampleObject = Object{
+	Bucket:  "staging",
+	Key:     "dir/file.txt",
+	Rel:     "file.txt",
+	Dir:     "dir",
+	Name:    "file.txt",
+	Ext:     ".txt",
+	Verdict: "clean",
+	SHA256:  strings.Repeat("0", 64),
+	Time:    time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+}
+
+// Destination is where objects of one target go.
+type Destination struct {
+	Bucket string `yaml:"bucket"`
+	Prefix string `yaml:"prefix"` // Prepended to the key
+	Key    string `yaml:"key"`    // text/template rendering the key from an Object, "{{.Key}}" if empty
+
+	tmpl *template.Template
+}
+
+// Rule routes the objects of a source bucket matching a prefix or pattern.
+type Rule struct {
+	Bucket     string       `yaml:"bucket"`  // Source bucket, "" or "*" for any
+	Prefix     string       `yaml:"prefix"`  // Key prefix
+	Pattern    string       `yaml:"pattern"` // Glob on the whole key: "*" stays within a path segment, "**" does not
+	Clean      *Destination `yaml:"clean"`
+	Quarantine *Destination `yaml:"quarantine"`
+	Unscanned  *Destination `yaml:"unscanned"`
+
+	pattern *regexp.Regexp
+}
+
+// Router resolves the destination of objects.
+type Router struct {
+	Rules    []*Rule `yaml:"rules"`
+	defaults map[Target]*Destination
+}
+
+// New creates the router configured by path, or a router sending everything
+// to the global buckets if path is "".
+func New(path string) (*Router, error) {
+	r := &Router{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read routing rules: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(r); err != nil {
+			return nil, fmt.Errorf("invalid routing rules %s: %w", path, err)
+		}
+	}
+
+	r.defaults = map[Target]*Destination{
+		Clean:      {Bucket: config.CleanBucket},
+		Quarantine: {Bucket: config.QuarantineBucket},
+		Unscanned:  {Bucket: config.UnscannedBucket},
+	}
+	for _, d := range r.defaults {
+		d.compile()
+	}
+	for i, rule := range r.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("routing rule %d: %w", i+1, err)
+		}
+	}
+	return r, nil
+}
+
+func (rule *Rule) compile() error {
+	if rule.Pattern != "" {
+		re, err := globRegexp(rule.Pattern)
+		if err != nil {
+			return err
+		}
+		rule.pattern = re
+	}
+	for _, d := range []*Destination{rule.Clean, rule.Quarantine, rule.Unscanned} {
+		if d == nil {
+			continue
+		}
+		if d.Bucket == "" {
+			return errors.New("destination without bucket")
+		}
+		if err := d.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Destination) compile() error {
+	key := d.Key
+	if key == "" {
+		key = "{{.Key}}"
+	}
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(key)
+	if err != nil {
+		return fmt.Errorf("invalid key template %q: %w", d.Key, err)
+	}
+	// Fields Object does not have only show up executing the template: try it
+	// on a sample object now rather than failing on every object later.
+	if err := tmpl.Execute(io.Discard, sampleObject); err != nil {
+		return fmt.Errorf("invalid key template %q: %w", d.Key, err)
+	}
+	d.tmpl = tmpl
+	return nil
+}
+
+func (rule *Rule) matches(bucket, key string) bool {
+	if rule.Bucket != "" && rule.Bucket != "*" && rule.Bucket != bucket {
+		return false
+	}
+	if !strings.HasPrefix(key, rule.Prefix) {
+		return false
+	}
+	return rule.pattern == nil || rule.pattern.MatchString(key)
+}
+
+func (rule *Rule) destination(target Target) *Destination {
+	switch target {
+	case Clean:
+		return rule.Clean
+	case Quarantine:
+		return rule.Quarantine
+	case Unscanned:
+		return rule.Unscanned
+	}
+	return nil
+}
+
+// Resolve returns the bucket and key obj goes to as target. obj.Rel, Dir, Name
+// and Ext are filled in from obj.Key.
+func (r *Router) Resolve(target Target, obj Object) (bucket, key string, err error) {
+	dest := r.defaults[target]
+	if dest == nil {
+		return "", "", fmt.Errorf("unknown routing target %q", target)
+	}
+	obj.Rel = obj.Key
+	for _, rule := range r.Rules {
+		if !rule.matches(obj.Bucket, obj.Key) {
+			continue
+		}
+		obj.Rel = strings.TrimPrefix(obj.Key, rule.Prefix)
+		if d := rule.destination(target); d != nil {
+			dest = d
+		}
+		break
+	}
+	obj.Dir, obj.Name = path.Split(obj.Key)
+	obj.Dir = path.Clean(obj.Dir)
+	obj.Ext = path.Ext(obj.Name)
+
+	var b strings.Builder
+	if err := dest.tmpl.Execute(&b, obj); err != nil {
+		return "", "", fmt.Errorf("failed to render key of %s: %w", obj.Key, err)
+	}
+	key = dest.Prefix + b.String()
+	if key == "" {
+		return "", "", fmt.Errorf("key template of %s renders an empty key", obj.Key)
+	}
+	return dest.Bucket, key, nil
+}
+
+// Buckets returns every destination bucket of target, default included.
+func (r *Router) Buckets(target Target) []string {
+	seen := map[string]bool{r.defaults[target].Bucket: true}
+	buckets := []string{r.defaults[target].Bucket}
+	for _, rule := range r.Rules {
+		if d := rule.destination(target); d != nil && !seen[d.Bucket] {
+			seen[d.Bucket] = true
+			buckets = append(buckets, d.Bucket)
+		}
+	}
+	return buckets
+}
+
+// globRegexp translates a glob into an anchored regular expression.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?") // "**/" also matches no directory at all
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", glob, err)
+	}
+	return re, nil
+}
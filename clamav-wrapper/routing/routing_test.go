@@ -0,0 +1,222 @@
+package routing
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"clamav-wrapper/config"
+)
+
+// newRouter returns the router configured by the rules given as YAML, with
+// the global buckets clean, quarantine and unscanned.
+func newRouter(t *testing.T, rules string) (*Router, error) {
+	t.Helper()
+	config.CleanBucket, config.QuarantineBucket, config.UnscannedBucket = "clean", "quarantine", "unscanned"
+	path := filepath.Join(t.TempDir(), "routing.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return New(path)
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		key  string
+		want bool
+	}{
+		{"*.pdf", "a.pdf", true},
+		{"*.pdf", "dir/a.pdf", false},
+		{"dir/*", "dir/a.pdf", true},
+		{"dir/*", "dir/sub/a.pdf", false},
+		{"dir/**", "dir/sub/a.pdf", true},
+		{"dir/**", "dir/", true},
+		{"**/*.pdf", "a.pdf", true},
+		{"**/*.pdf", "dir/sub/a.pdf", true},
+		{"**/*.pdf", "dir/a.pdf.txt", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/xb", false},
+		{"a**b", "a/x/b", true},
+		{"?.txt", "a.txt", true},
+		{"?.txt", "ab.txt", false},
+		{"?.txt", "/.txt", false},
+		// Regexp metacharacters match themselves.
+		{"*.pdf", "apdf", false},
+		{"report (1).txt", "report (1).txt", true},
+		{"report (1).txt", "report 1.txt", false},
+		{"a+b.txt", "a+b.txt", true},
+		{"a+b.txt", "aab.txt", false},
+		{"[abc].txt", "[abc].txt", true},
+		{"[abc].txt", "a.txt", false},
+		{"$HOME^|{1}", "$HOME^|{1}", true},
+		{`back\slash`, `back\slash`, true},
+		// Anchored at both ends.
+		{"a.txt", "dir/a.txt", false},
+		{"a.txt", "a.txt.bak", false},
+	}
+	for _, tt := range tests {
+		re, err := globRegexp(tt.glob)
+		if err != nil {
+			t.Errorf("globRegexp(%q): %v", tt.glob, err)
+			continue
+		}
+		if got := re.MatchString(tt.key); got != tt.want {
+			t.Errorf("%q matches %q: %v, want %v", tt.glob, tt.key, got, tt.want)
+		}
+	}
+}
+
+const testRules = `
+rules:
+  - bucket: staging
+    prefix: product-a/
+    clean:
+      bucket: product-a-clean
+      key: '{{.Time.Format "2006/01/02"}}/{{.Rel}}'
+    quarantine:
+      bucket: product-a-quarantine
+      prefix: q/
+  - bucket: staging
+    prefix: product-a/docs/
+    clean:
+      bucket: never-used
+  - bucket: "*"
+    pattern: "**/*.pdf"
+    clean:
+      bucket: documents
+      prefix: pdf/
+      key: "{{.Bucket}}/{{.Dir}}/{{.Name}}"
+  - bucket: uploads
+    pattern: "*"
+    clean:
+      bucket: uploads-clean
+      key: "{{.Verdict}}-{{.SHA256}}{{.Ext}}"
+`
+
+func TestResolve(t *testing.T) {
+	r, err := newRouter(t, testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		target     Target
+		bucket     string
+		key        string
+		wantBucket string
+		wantKey    string
+	}{
+		{"no rule matches", Clean, "other", "a.txt", "clean", "a.txt"},
+		{"default quarantine", Quarantine, "other", "dir/a.txt", "quarantine", "dir/a.txt"},
+		{"prefix rule", Clean, "staging", "product-a/x/report.txt", "product-a-clean", "2024/03/09/x/report.txt"},
+		{"prefix rule with destination prefix", Quarantine, "staging", "product-a/report.txt", "product-a-quarantine", "q/product-a/report.txt"},
+		// The first matching rule applies even when a later one is more specific,
+		// and a target it has no destination for goes to the global bucket.
+		{"first match wins", Clean, "staging", "product-a/docs/a.pdf", "product-a-clean", "2024/03/09/docs/a.pdf"},
+		{"first match without destination", Unscanned, "staging", "product-a/docs/a.pdf", "unscanned", "product-a/docs/a.pdf"},
+		{"prefix of another bucket", Clean, "other", "product-a/a.txt", "clean", "product-a/a.txt"},
+		{"template variables", Clean, "uploads", "report.txt", "uploads-clean", "clean-abc.txt"},
+		{"pattern on any bucket", Clean, "other", "x/y/a.pdf", "documents", "pdf/other/x/y/a.pdf"},
+		{"pattern at the top level", Clean, "other", "a.pdf", "documents", "pdf/other/./a.pdf"},
+		{"single star stays in its segment", Clean, "uploads", "dir/a.txt", "clean", "dir/a.txt"},
+		{"single star", Clean, "uploads", "a", "uploads-clean", "clean-abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, key, err := r.Resolve(tt.target, Object{Bucket: tt.bucket, Key: tt.key, Verdict: "clean", SHA256: "abc", Time: scanned})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bucket != tt.wantBucket || key != tt.wantKey {
+				t.Errorf("Resolve() = %s/%s, want %s/%s", bucket, key, tt.wantBucket, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	r, err := newRouter(t, `
+rules:
+  - prefix: empty/
+    clean:
+      bucket: clean
+      key: "{{if .SHA256}}{{.SHA256}}{{end}}"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Resolve("archive", Object{Key: "a.txt"}); err == nil {
+		t.Error("unknown target resolved")
+	}
+	if _, _, err := r.Resolve(Clean, Object{Key: "empty/a.txt"}); err == nil {
+		t.Error("empty key resolved")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  string
+	}{
+		{
+			name:  "unknown placeholder",
+			rules: "rules:\n  - clean:\n      bucket: b\n      key: '{{.Filename}}'\n",
+			want:  "can't evaluate field Filename",
+		},
+		{
+			name:  "unknown method",
+			rules: "rules:\n  - clean:\n      bucket: b\n      key: '{{.Time.Date}}/{{.Key}}'\n",
+			want:  "invalid key template",
+		},
+		{
+			name:  "unknown function",
+			rules: "rules:\n  - clean:\n      bucket: b\n      key: '{{lower .Key}}'\n",
+			want:  `function "lower" not defined`,
+		},
+		{
+			name:  "unclosed action",
+			rules: "rules:\n  - clean:\n      bucket: b\n      key: '{{.Key'\n",
+			want:  "invalid key template",
+		},
+		{
+			name:  "destination without bucket",
+			rules: "rules:\n  - quarantine:\n      prefix: q/\n",
+			want:  "destination without bucket",
+		},
+		{
+			name:  "unknown field",
+			rules: "rules:\n  - clean:\n      bucket: b\n      path: x\n",
+			want:  "field path not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRouter(t, tt.rules)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("New() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	r, err := newRouter(t, testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(r.Buckets(Clean), ",")
+	if want := "clean,product-a-clean,never-used,documents,uploads-clean"; got != want {
+		t.Errorf("Buckets(Clean) = %s, want %s", got, want)
+	}
+	got = strings.Join(r.Buckets(Unscanned), ",")
+	if want := "unscanned"; got != want {
+		t.Errorf("Buckets(Unscanned) = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FSStorage stores objects as files below a root directory: each bucket is a
+// directory of the root and each key a path inside it, "/" separating
+// directories. Tags and metadata are kept in "user.*" extended attributes,
+// which the underlying file system must support to copy with scan info or to
+// tag in place.
+type FSStorage struct {
+	root string
+}
+
+// NewFSStorage uses root, which must be an existing directory.
+func NewFSStorage(root string) (*FSStorage, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, fmt.Errorf("storage root: %w", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("storage root %s is not a directory", abs)
+	}
+	return &FSStorage{root: abs}, nil
+}
+
+// Root returns the absolute path of the directory holding the buckets.
+func (s *FSStorage) Root() string {
+	return s.root
+}
+
+// path maps bucket and key to a file below root, rejecting names that would
+// escape the bucket directory.
+func (s *FSStorage) path(bucket, key string) (string, error) {
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || !filepath.IsLocal(bucket) {
+		return "", fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	rel := filepath.FromSlash(key)
+	if key == "" || strings.HasSuffix(key, "/") || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, bucket, rel), nil
+}
+
+func (s *FSStorage) GetFileStreamWithSize(ctx context.Context, bucket, key, versionID string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := s.path(bucket, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, fsNotFound(err, bucket, key)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("%s/%s is not a regular file", bucket, key)
+	}
+	return f, ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}, nil
+}
+
+// StatObject reports the size, modification time and the metadata stored in
+// extended attributes: files have no ETag.
+func (s *FSStorage) StatObject(ctx context.Context, bucket, key, versionID string) (ObjectInfo, error) {
+	p, err := s.path(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, fsNotFound(err, bucket, key)
+	}
+	if !fi.Mode().IsRegular() {
+		return ObjectInfo{}, fmt.Errorf("%s/%s is not a regular file", bucket, key)
+	}
+	attrs, err := getAttrs(p)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime(), Metadata: attrs}, nil
+}
+
+// CopyObject writes the copy to a temporary file next to the destination and
+// renames it into place, so readers of the destination never see a partial file.
+func (s *FSStorage) CopyObject(ctx context.Context, srcBucket, srcKey, srcVersionID, destBucket, destKey string, info *ScanInfo) error {
+	srcPath, err := s.path(srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	destPath, err := s.path(destBucket, destKey)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return fsNotFound(err, srcBucket, srcKey)
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), "."+filepath.Base(destPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := io.Copy(tmp, readerWithContext{ctx, src}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	attrs, err := getAttrs(srcPath)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	if info != nil {
+		attrs = mergeMap(attrs, info.Metadata())
+	}
+	if len(attrs) > 0 {
+		if err := setAttrs(tmp.Name(), attrs); err != nil {
+			return fmt.Errorf("failed to set attributes on %s/%s: %w", destBucket, destKey, err)
+		}
+	}
+
+	return os.Rename(tmp.Name(), destPath)
+}
+
+func (s *FSStorage) DeleteObject(ctx context.Context, bucket, key, versionID string) error {
+	p, err := s.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FSStorage) TagObject(ctx context.Context, bucket, key, versionID string, info ScanInfo) error {
+	p, err := s.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(p); err != nil {
+		return fsNotFound(err, bucket, key)
+	}
+	if err := setAttrs(p, info.Tags()); err != nil {
+		return fmt.Errorf("failed to tag %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// ListObjects walks the bucket directory. Hidden files, which include the
+// temporary files of CopyObject, are skipped.
+func (s *FSStorage) ListObjects(ctx context.Context, bucket string, fn func(ObjectInfo) error) error {
+	if err := s.CheckBucket(ctx, bucket); err != nil {
+		return err
+	}
+	root := filepath.Join(s.root, bucket)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil // Removed since it was listed
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Key: filepath.ToSlash(rel), Size: fi.Size(), LastModified: fi.ModTime()})
+	})
+}
+
+// CheckAttributes checks that the file system files of bucket are written to
+// supports the "user.*" extended attributes tags and metadata are kept in, by
+// setting one on a temporary file. It returns an error wrapping
+// errors.ErrUnsupported if it does not, as is the case of tmpfs before Linux
+// 6.6. Buckets not created yet are checked in the root directory, where they
+// will be created.
+func (s *FSStorage) CheckAttributes(bucket string) error {
+	dir := filepath.Join(s.root, bucket)
+	if err := s.CheckBucket(context.Background(), bucket); errors.Is(err, os.ErrNotExist) {
+		dir = s.root
+	} else if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".attributes.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	if err := setAttrs(f.Name(), map[string]string{"scan-check": "1"}); err != nil {
+		return fmt.Errorf("extended attributes of %s: %w", dir, err)
+	}
+	return nil
+}
+
+// CheckBucket checks that the bucket directory exists; it is not created on demand.
+func (s *FSStorage) CheckBucket(ctx context.Context, bucket string) error {
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || !filepath.IsLocal(bucket) {
+		return fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	fi, err := os.Stat(filepath.Join(s.root, bucket))
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("bucket %s is not a directory", bucket)
+	}
+	return nil
+}
+
+// fsNotFound wraps err with ErrNotFound when the file does not exist.
+func fsNotFound(err error, bucket, key string) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+	return err
+}
+
+// readerWithContext stops a copy once ctx is cancelled.
+type readerWithContext struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r readerWithContext) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
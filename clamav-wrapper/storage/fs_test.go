@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFSCheckAttributes(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "clean"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFSStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "quarantine" does not exist yet and is checked in the root directory.
+	for _, bucket := range []string{"clean", "quarantine"} {
+		err := s.CheckAttributes(bucket)
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skipf("file system of %s has no extended attributes: %v", root, err)
+		}
+		if err != nil {
+			t.Errorf("CheckAttributes(%q) = %v", bucket, err)
+		}
+	}
+	if err := s.CheckAttributes("../x"); err == nil {
+		t.Error("CheckAttributes accepted an invalid bucket name")
+	}
+
+	// The temporary files are gone.
+	for _, dir := range []string{root, filepath.Join(root, "clean")} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				t.Errorf("%s left in %s", e.Name(), dir)
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package storage
+
+import "errors"
+
+func getAttrs(path string) (map[string]string, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func setAttrs(path string, attrs map[string]string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,65 @@
+//go:build unix
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// attrPrefix is the extended attribute namespace holding tags and metadata.
+const attrPrefix = "user."
+
+// getAttrs returns the "user.*" extended attributes of path, without the prefix.
+func getAttrs(path string) (map[string]string, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil {
+		return nil, xattrErr(err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, xattrErr(err)
+	}
+
+	attrs := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if !bytes.HasPrefix(name, []byte(attrPrefix)) {
+			continue
+		}
+		n, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, xattrErr(err)
+		}
+		val := make([]byte, n)
+		n, err = unix.Getxattr(path, string(name), val)
+		if err != nil {
+			return nil, xattrErr(err)
+		}
+		attrs[strings.TrimPrefix(string(name), attrPrefix)] = string(val[:n])
+	}
+	return attrs, nil
+}
+
+// setAttrs sets each entry of attrs as a "user.*" extended attribute of path.
+func setAttrs(path string, attrs map[string]string) error {
+	for k, v := range attrs {
+		if err := unix.Setxattr(path, attrPrefix+k, []byte(v), 0); err != nil {
+			return xattrErr(err)
+		}
+	}
+	return nil
+}
+
+func xattrErr(err error) error {
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+		return errors.ErrUnsupported
+	}
+	return err
+}
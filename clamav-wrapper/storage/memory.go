@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps objects in memory. It is meant for tests and local runs;
+// buckets are created on first write and everything is lost on exit.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	tags     map[string]string
+	metadata map[string]string
+	modTime  time.Time
+}
+
+// NewMemoryStorage returns an empty in-memory store.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{buckets: make(map[string]map[string]*memoryObject)}
+}
+
+// Put stores data as key in bucket, replacing any existing object.
+func (s *MemoryStorage) Put(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]*memoryObject)
+	}
+	s.buckets[bucket][key] = &memoryObject{data: bytes.Clone(data), modTime: time.Now()}
+}
+
+// Get returns the content of an object and whether it exists.
+func (s *MemoryStorage) Get(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj := s.buckets[bucket][key]
+	if obj == nil {
+		return nil, false
+	}
+	return bytes.Clone(obj.data), true
+}
+
+// Tags returns a copy of the tags of an object, nil if it does not exist.
+func (s *MemoryStorage) Tags(bucket, key string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if obj := s.buckets[bucket][key]; obj != nil {
+		return copyMap(obj.tags)
+	}
+	return nil
+}
+
+// Metadata returns a copy of the user metadata of an object, nil if it does not exist.
+func (s *MemoryStorage) Metadata(bucket, key string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if obj := s.buckets[bucket][key]; obj != nil {
+		return copyMap(obj.metadata)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) GetFileStreamWithSize(ctx context.Context, bucket, key, versionID string) (io.ReadCloser, ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj := s.buckets[bucket][key]
+	if obj == nil {
+		return nil, ObjectInfo{}, fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+	// bytes.Reader is an io.Seeker, so a scan can fail over to another clamd.
+	return readSeekNopCloser{bytes.NewReader(obj.data)}, obj.info(key), nil
+}
+
+// StatObject computes the ETag (MD5, like S3 for single-part uploads) and SHA-256 of the object.
+func (s *MemoryStorage) StatObject(ctx context.Context, bucket, key, versionID string) (ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj := s.buckets[bucket][key]
+	if obj == nil {
+		return ObjectInfo{}, fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+	return obj.info(key), nil
+}
+
+func (obj *memoryObject) info(key string) ObjectInfo {
+	md5sum := md5.Sum(obj.data)
+	shasum := sha256.Sum256(obj.data)
+	return ObjectInfo{
+		Key:          key,
+		Size:         int64(len(obj.data)),
+		ETag:         hex.EncodeToString(md5sum[:]),
+		SHA256:       hex.EncodeToString(shasum[:]),
+		LastModified: obj.modTime,
+		Metadata:     copyMap(obj.metadata),
+	}
+}
+
+func (s *MemoryStorage) CopyObject(ctx context.Context, srcBucket, srcKey, srcVersionID, destBucket, destKey string, info *ScanInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src := s.buckets[srcBucket][srcKey]
+	if src == nil {
+		return fmt.Errorf("%w: %s/%s", ErrNotFound, srcBucket, srcKey)
+	}
+
+	dest := &memoryObject{data: src.data, tags: copyMap(src.tags), metadata: copyMap(src.metadata), modTime: time.Now()}
+	if info != nil {
+		dest.tags = mergeMap(dest.tags, info.Tags())
+		dest.metadata = mergeMap(dest.metadata, info.Metadata())
+	}
+	if s.buckets[destBucket] == nil {
+		s.buckets[destBucket] = make(map[string]*memoryObject)
+	}
+	s.buckets[destBucket][destKey] = dest
+	return nil
+}
+
+func (s *MemoryStorage) DeleteObject(ctx context.Context, bucket, key, versionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *MemoryStorage) TagObject(ctx context.Context, bucket, key, versionID string, info ScanInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj := s.buckets[bucket][key]
+	if obj == nil {
+		return fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+	obj.tags = mergeMap(obj.tags, info.Tags())
+	return nil
+}
+
+// ListObjects lists the objects of bucket in key order.
+func (s *MemoryStorage) ListObjects(ctx context.Context, bucket string, fn func(ObjectInfo) error) error {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		info, err := s.StatObject(ctx, bucket, key, "")
+		if errors.Is(err, ErrNotFound) {
+			continue // Removed since it was listed
+		}
+		if err != nil {
+			return err
+		}
+		info.SHA256, info.Metadata = "", nil
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckBucket always succeeds: buckets are created on first write.
+func (s *MemoryStorage) CheckBucket(ctx context.Context, bucket string) error {
+	return nil
+}
+
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// mergeMap returns a copy of m with the entries of add set on top.
+func mergeMap(m, add map[string]string) map[string]string {
+	out := make(map[string]string, len(m)+len(add))
+	for k, v := range m {
+		out[k] = v
+	}
+	for k, v := range add {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// MinioStorage stores objects on MinIO or any other S3-compatible server.
+type MinioStorage struct {
+	Client *minio.Client
+}
+
+// NewMinioStorage connects to the S3 endpoint with static credentials.
+func NewMinioStorage(endpoint, accessKey, secretKey string, useSSL bool) (*MinioStorage, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("MinIO init failed: %w", err)
+	}
+	return &MinioStorage{Client: client}, nil
+}
+
+// GetFileStreamWithSize reports the ETag and version ID of the response, so
+// they describe the content read even if the object is overwritten meanwhile.
+func (s *MinioStorage) GetFileStreamWithSize(ctx context.Context, bucket, object, versionID string) (io.ReadCloser, ObjectInfo, error) {
+	obj, err := s.Client.GetObject(ctx, bucket, object, minio.GetObjectOptions{VersionID: versionID})
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, notFound(err, bucket, object)
+	}
+
+	info := ObjectInfo{Key: object, Size: stat.Size, ETag: stat.ETag, VersionID: stat.VersionID, LastModified: stat.LastModified}
+	return obj, info, nil
+}
+
+// StatObject reports the object's ETag and, when it was uploaded with a
+// full-object SHA-256 checksum, that checksum.
+func (s *MinioStorage) StatObject(ctx context.Context, bucket, key, versionID string) (ObjectInfo, error) {
+	stat, err := s.Client.StatObject(ctx, bucket, key, minio.StatObjectOptions{VersionID: versionID, Checksum: true})
+	if err != nil {
+		return ObjectInfo{}, notFound(err, bucket, key)
+	}
+	info := ObjectInfo{Key: key, Size: stat.Size, ETag: stat.ETag, VersionID: stat.VersionID, LastModified: stat.LastModified}
+	for k, v := range stat.UserMetadata {
+		if info.Metadata == nil {
+			info.Metadata = make(map[string]string, len(stat.UserMetadata))
+		}
+		info.Metadata[strings.ToLower(k)] = v
+	}
+	// Multipart uploads report a checksum of the part checksums ("COMPOSITE"), which does not identify the content.
+	if stat.ChecksumSHA256 != "" && stat.ChecksumMode != "COMPOSITE" {
+		if sum, err := base64.StdEncoding.DecodeString(stat.ChecksumSHA256); err == nil && len(sum) == sha256.Size {
+			info.SHA256 = hex.EncodeToString(sum)
+		}
+	}
+	return info, nil
+}
+
+// CopyObject copies the object server-side. With info, the scan details are
+// attached to the copy both as object tags and as user metadata, and the
+// source object's own tags, user metadata and content headers are preserved.
+// Objects above 5 GiB, the limit of a single S3 copy, are copied part by part
+// with a multipart upload; their content headers are not carried over.
+func (s *MinioStorage) CopyObject(ctx context.Context, srcBucket, srcKey, srcVersionID, destBucket, destKey string, info *ScanInfo) error {
+	src := minio.CopySrcOptions{Bucket: srcBucket, Object: srcKey, VersionID: srcVersionID}
+	dest := minio.CopyDestOptions{Bucket: destBucket, Object: destKey}
+
+	if info != nil {
+		stat, err := s.Client.StatObject(ctx, srcBucket, srcKey, minio.StatObjectOptions{VersionID: srcVersionID})
+		if err != nil {
+			return notFound(err, srcBucket, srcKey)
+		}
+		existing, err := s.Client.GetObjectTagging(ctx, srcBucket, srcKey, minio.GetObjectTaggingOptions{VersionID: srcVersionID})
+		if err != nil {
+			return err
+		}
+		userTags, err := mergeTags(existing.ToMap(), *info)
+		if err != nil {
+			return err
+		}
+
+		// Replacing the metadata drops everything not listed, so the source's is carried over.
+		metadata := make(map[string]string, len(stat.UserMetadata)+6)
+		for k, v := range stat.UserMetadata {
+			metadata[strings.ToLower(k)] = v
+		}
+		for k, v := range info.Metadata() {
+			metadata[k] = v
+		}
+
+		dest.UserMetadata = metadata
+		dest.ReplaceMetadata = true
+		dest.UserTags = userTags.ToMap()
+		dest.ReplaceTags = true
+		dest.ContentType = stat.ContentType
+		dest.ContentEncoding = stat.Metadata.Get("Content-Encoding")
+		dest.ContentDisposition = stat.Metadata.Get("Content-Disposition")
+		dest.ContentLanguage = stat.Metadata.Get("Content-Language")
+		dest.CacheControl = stat.Metadata.Get("Cache-Control")
+	}
+
+	// ComposeObject makes a plain copy of objects up to 5 GiB.
+	uploaded, err := s.Client.ComposeObject(ctx, dest, src)
+	if err != nil {
+		return notFound(err, srcBucket, srcKey)
+	}
+	slog.DebugContext(ctx, "Copied object", "bucket", srcBucket, "key", srcKey, "version_id", srcVersionID, "target_bucket", destBucket, "target_key", destKey, "etag", uploaded.ETag, "annotated", info != nil)
+	return nil
+}
+
+func (s *MinioStorage) DeleteObject(ctx context.Context, bucket, key, versionID string) error {
+	if err := s.Client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{VersionID: versionID}); err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "Deleted object", "bucket", bucket, "key", key, "version_id", versionID)
+	return nil
+}
+
+// TagObject only sets tags: S3 cannot change user metadata without rewriting the object.
+func (s *MinioStorage) TagObject(ctx context.Context, bucket, key, versionID string, info ScanInfo) error {
+	existing, err := s.Client.GetObjectTagging(ctx, bucket, key, minio.GetObjectTaggingOptions{VersionID: versionID})
+	if err != nil {
+		return notFound(err, bucket, key)
+	}
+	merged, err := mergeTags(existing.ToMap(), info)
+	if err != nil {
+		return err
+	}
+	if err := s.Client.PutObjectTagging(ctx, bucket, key, merged, minio.PutObjectTaggingOptions{VersionID: versionID}); err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "Tagged object", "bucket", bucket, "key", key, "tags", merged.Count())
+	return nil
+}
+
+func (s *MinioStorage) ListObjects(ctx context.Context, bucket string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // Stops the listing if fn fails
+	for obj := range s.Client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := fn(ObjectInfo{Key: obj.Key, Size: obj.Size, ETag: obj.ETag, LastModified: obj.LastModified}); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (s *MinioStorage) CheckBucket(ctx context.Context, bucket string) error {
+	ok, err := s.Client.BucketExists(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	return nil
+}
+
+// mergeTags adds the scan tags to the object's existing tags and checks the
+// result against S3's limits (at most 10 tags per object).
+func mergeTags(existing map[string]string, info ScanInfo) (*tags.Tags, error) {
+	merged := make(map[string]string, len(existing)+6)
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range info.Tags() {
+		merged[k] = v
+	}
+	t, err := tags.NewTags(merged, true)
+	if err != nil {
+		return nil, fmt.Errorf("cannot tag object with scan result: %w", err)
+	}
+	return t, nil
+}
+
+// notFound wraps err with ErrNotFound when S3 reports a missing object or version.
+func notFound(err error, bucket, key string) error {
+	if code := minio.ToErrorResponse(err).Code; code == "NoSuchKey" || code == "NoSuchVersion" {
+		return fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+	return err
+}
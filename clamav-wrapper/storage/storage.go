@@ -0,0 +1,157 @@
+// Package storage abstracts the object store files are scanned from and moved
+// to. Objects are addressed by bucket and (decoded) key on every backend.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"time"
+
+	"clamav-wrapper/config"
+)
+
+// ErrNotFound is returned when the requested object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Storage is an object store holding the staging, clean and quarantine buckets.
+//
+// On versioned buckets, a non-empty versionID makes an operation apply to that
+// version of the object rather than to the latest one. Backends without
+// versioning ignore it.
+type Storage interface {
+	// GetFileStreamWithSize opens an object for reading and returns its size
+	// and, where the backend knows them, its ETag and version ID.
+	GetFileStreamWithSize(ctx context.Context, bucket, key, versionID string) (io.ReadCloser, ObjectInfo, error)
+
+	// StatObject returns the size and, where the backend knows them, the ETag,
+	// version ID and SHA-256 checksum of an object without reading it.
+	StatObject(ctx context.Context, bucket, key, versionID string) (ObjectInfo, error)
+
+	// CopyObject copies srcKey (version srcVersionID) from srcBucket to destKey
+	// in destBucket. If info is not nil it is attached to the copy as tags (and
+	// metadata, where the backend supports it), keeping the source object's own
+	// tags and metadata.
+	CopyObject(ctx context.Context, srcBucket, srcKey, srcVersionID, destBucket, destKey string, info *ScanInfo) error
+
+	// DeleteObject removes an object. Removing an object that does not exist is
+	// not an error. With a versionID, that version is removed for good instead
+	// of a delete marker hiding the latest version.
+	DeleteObject(ctx context.Context, bucket, key, versionID string) error
+
+	// TagObject adds info as tags to the object in place, keeping its other tags.
+	TagObject(ctx context.Context, bucket, key, versionID string, info ScanInfo) error
+
+	// CheckBucket returns an error unless the bucket exists and the store is reachable.
+	CheckBucket(ctx context.Context, bucket string) error
+
+	// ListObjects calls fn for every object of bucket, stopping at the first
+	// error fn returns. Only Key, Size, ETag and LastModified are set.
+	ListObjects(ctx context.Context, bucket string, fn func(ObjectInfo) error) error
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string // Empty if the backend has none
+	VersionID    string // Empty if the backend or bucket is not versioned
+	SHA256       string // Hex-encoded SHA-256 of the content, if the backend stores one
+	LastModified time.Time
+	Metadata     map[string]string // User metadata, with lower-case keys such as "scan-verdict"
+}
+
+// New creates the backend selected by config.StorageType.
+func New() (Storage, error) {
+	switch config.StorageType {
+	case "minio", "s3":
+		return NewMinioStorage(config.MinioEndpoint, config.MinioAccessKey, config.MinioSecretKey, config.UseSSL)
+	case "fs":
+		return NewFSStorage(config.StorageFSRoot)
+	case "memory":
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unsupported storage type: %s", config.StorageType)
+	}
+}
+
+// Keys of the tags (and user metadata) describing a scan. As S3 user metadata
+// they are sent as "X-Amz-Meta-Scan-Verdict" etc.
+const (
+	TagVerdict   = "scan-verdict"
+	TagSignature = "scan-signature"
+	TagEngine    = "scan-engine"
+	TagDatabase  = "scan-database"
+	TagTime      = "scan-time"
+	TagInstance  = "scan-instance"
+	TagReason    = "scan-reason"
+)
+
+// Keys of the metadata identifying the object a copy was made from. They are
+// not tags, which are limited to 10 per object.
+const (
+	MetaSource        = "scan-source"         // <bucket>/<URL-encoded key>
+	MetaSourceETag    = "scan-source-etag"    // ETag of the source, if the backend has ETags
+	MetaSourceVersion = "scan-source-version" // Version ID of the source, if versioned
+)
+
+// invalidTagChars matches characters S3 does not accept in tag values.
+var invalidTagChars = regexp.MustCompile(`[^a-zA-Z0-9+\-._:/@ =]`)
+
+// ScanInfo describes how and when an object was scanned.
+type ScanInfo struct {
+	Verdict   string
+	Signature string // Only set for infected objects
+	Engine    string // e.g. "ClamAV 1.0.1"
+	Database  string // Signature database version, e.g. "26800"
+	ScannedAt time.Time
+	Instance  string // Scanner instance that processed the object
+	Reason    string // Why the object was not scanned, e.g. "file-too-large"
+
+	SourceBucket, SourceKey, SourceETag, SourceVersion string // Object the copy is made from, metadata only
+}
+
+// Tags returns the non-empty fields of info keyed by the Tag* constants, with
+// characters S3 rejects in tag values replaced by "_".
+func (info ScanInfo) Tags() map[string]string {
+	m := map[string]string{
+		TagVerdict:   info.Verdict,
+		TagSignature: info.Signature,
+		TagEngine:    info.Engine,
+		TagDatabase:  info.Database,
+		TagInstance:  info.Instance,
+		TagReason:    info.Reason,
+	}
+	if !info.ScannedAt.IsZero() {
+		m[TagTime] = info.ScannedAt.UTC().Format(time.RFC3339)
+	}
+	for k, v := range m {
+		if v == "" {
+			delete(m, k)
+			continue
+		}
+		if len(v) > 256 {
+			v = v[:256]
+		}
+		m[k] = invalidTagChars.ReplaceAllString(v, "_")
+	}
+	return m
+}
+
+// Metadata returns the tags of info and, when known, the source of the copy.
+func (info ScanInfo) Metadata() map[string]string {
+	m := info.Tags()
+	if info.SourceBucket != "" {
+		m[MetaSource] = info.SourceBucket + "/" + url.QueryEscape(info.SourceKey)
+	}
+	if info.SourceETag != "" {
+		m[MetaSourceETag] = info.SourceETag
+	}
+	if info.SourceVersion != "" {
+		m[MetaSourceVersion] = info.SourceVersion
+	}
+	return m
+}
@@ -0,0 +1,316 @@
+// Package worker runs file event handlers concurrently on a bounded pool of
+// goroutines, sitting between the message consumers and the scan pipeline.
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"clamav-wrapper/config"
+)
+
+// ErrClosed is returned by Submit once the pool is shutting down.
+var ErrClosed = errors.New("worker pool is closed")
+
+// Ordering controls which events must be handled in the order they were submitted.
+type Ordering string
+
+const (
+	// OrderingNone lets any idle worker pick up the next event.
+	OrderingNone Ordering = "none"
+	// OrderingBucket handles events of the same bucket one after another, on the same worker.
+	OrderingBucket Ordering = "bucket"
+	// OrderingObject handles events of the same object one after another, on the same worker.
+	OrderingObject Ordering = "object"
+)
+
+// Handler processes a single file event. ctx is cancelled when the pool is
+// shut down and the drain deadline has passed. It carries the values (such as
+// the correlation ID and trace span) of the context the event was submitted with.
+// versionID is the object version the event is about, "" if not known.
+type Handler func(ctx context.Context, bucketName string, objectKeyEncoded string, versionID string) error
+
+// RetryError is returned by a handler to have the event handled again after
+// Delay, rather than reported as failed.
+type RetryError struct {
+	Err   error
+	Delay time.Duration
+}
+
+// Retry returns a RetryError for err, asking the pool to run the event again
+// after delay.
+func Retry(err error, delay time.Duration) error {
+	return &RetryError{Err: err, Delay: delay}
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v (retrying in %s)", e.Err, e.Delay)
+}
+
+func (e *RetryError) Unwrap() error { return e.Err }
+
+type job struct {
+	values  context.Context // Context passed to Submit, only used for its values
+	bucket  string
+	key     string
+	version string
+	done    func(error)
+	attempt int       // 1 for the first run of the event
+	first   time.Time // When the first attempt started
+	err     error     // Error of the last attempt, while a retry is pending
+}
+
+type attemptKey struct{}
+
+// jobContext is cancelled with the pool, but looks values up in the context
+// the job was submitted with: the consumer's context is cancelled as soon as
+// shutdown begins, while handlers keep running until the drain deadline.
+type jobContext struct {
+	context.Context
+	values context.Context
+	job    *job
+}
+
+func (c jobContext) Value(key any) any {
+	if key == (attemptKey{}) {
+		return c.job
+	}
+	return c.values.Value(key)
+}
+
+// Attempt returns which attempt at the event the handler is running (1 for the
+// first one) and when the first attempt started. It returns 0 when ctx is not
+// the context of a handler run by a Pool.
+func Attempt(ctx context.Context) (n int, first time.Time) {
+	j, ok := ctx.Value(attemptKey{}).(*job)
+	if !ok {
+		return 0, time.Time{}
+	}
+	return j.attempt, j.first
+}
+
+// Pool is a fixed set of workers fed through bounded queues. Submit blocks
+// while the queue a job belongs to is full, which pushes back on the consumer
+// so that it stops fetching new messages while all workers are busy.
+type Pool struct {
+	handler  Handler
+	ordering Ordering
+	queues   []chan job // a single shared queue, or one per worker when ordering is enabled
+	inFlight atomic.Int64
+
+	ctx    context.Context // passed to handlers, cancelled when draining times out
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex // guards closed against concurrent Submit
+	closed bool
+	wg     sync.WaitGroup
+
+	retryMu sync.Mutex // guards retries and stopped
+	retries map[*job]*time.Timer
+	stopped bool // set once Shutdown released the pending retries
+}
+
+// NewPool starts cfg.Concurrency workers that call handler for every submitted event.
+func NewPool(cfg config.WorkerConfig, handler Handler) (*Pool, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("handler function cannot be nil for worker pool")
+	}
+	if cfg.Concurrency <= 0 {
+		return nil, fmt.Errorf("worker concurrency must be positive, got %d", cfg.Concurrency)
+	}
+	if cfg.QueueSize < 0 {
+		return nil, fmt.Errorf("worker queue size cannot be negative, got %d", cfg.QueueSize)
+	}
+
+	p := &Pool{handler: handler, ordering: Ordering(cfg.Ordering), retries: make(map[*job]*time.Timer)}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	switch p.ordering {
+	case "", OrderingNone:
+		p.ordering = OrderingNone
+		q := make(chan job, cfg.QueueSize)
+		p.queues = []chan job{q}
+		for i := 0; i < cfg.Concurrency; i++ {
+			p.start(q)
+		}
+	case OrderingBucket, OrderingObject:
+		// Each worker owns a queue so events sharing an ordering key never run concurrently.
+		perWorker := cfg.QueueSize / cfg.Concurrency
+		for i := 0; i < cfg.Concurrency; i++ {
+			q := make(chan job, perWorker)
+			p.queues = append(p.queues, q)
+			p.start(q)
+		}
+	default:
+		p.cancel()
+		return nil, fmt.Errorf("unsupported worker ordering: %s", cfg.Ordering)
+	}
+
+	return p, nil
+}
+
+func (p *Pool) start(q chan job) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for j := range q {
+			// Once draining timed out, jobs still queued are failed without running.
+			err := p.ctx.Err()
+			if err == nil {
+				if j.attempt == 0 {
+					j.attempt, j.first = 1, time.Now()
+				}
+				p.inFlight.Add(1)
+				err = p.handler(jobContext{p.ctx, j.values, &j}, j.bucket, j.key, j.version)
+				p.inFlight.Add(-1)
+			}
+			var retry *RetryError
+			if errors.As(err, &retry) {
+				p.retryLater(j, retry)
+				continue
+			}
+			if j.done != nil {
+				j.done(err)
+			}
+		}
+	}()
+}
+
+// retryLater queues j again once the delay asked for has passed, without
+// holding up the worker meanwhile. A retry still pending when the pool shuts
+// down is not run: its done is called with an error wrapping ErrClosed, so the
+// event is redelivered rather than committed.
+func (p *Pool) retryLater(j job, retry *RetryError) {
+	j.attempt++
+	j.err = retry.Err
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	if p.stopped {
+		p.interrupt(j)
+		return
+	}
+	jp := &j
+	p.retries[jp] = time.AfterFunc(retry.Delay, func() {
+		p.retryMu.Lock()
+		_, pending := p.retries[jp]
+		delete(p.retries, jp)
+		p.retryMu.Unlock()
+		if !pending {
+			return // Released by Shutdown
+		}
+
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		if p.closed {
+			p.interrupt(j)
+			return
+		}
+		p.queueFor(j.bucket, j.key) <- j
+	})
+}
+
+// interrupt reports a retry that will not run because the pool is shutting down.
+func (p *Pool) interrupt(j job) {
+	if j.done != nil {
+		j.done(fmt.Errorf("retry of %s/%s interrupted: %w (last error: %v)", j.bucket, j.key, ErrClosed, j.err))
+	}
+}
+
+// queueFor returns the queue an event must go to under the pool's ordering.
+func (p *Pool) queueFor(bucket, key string) chan job {
+	if len(p.queues) == 1 {
+		return p.queues[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(bucket))
+	if p.ordering == OrderingObject {
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+	}
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// Submit queues an event for processing, blocking while its queue is full.
+// It returns ctx.Err() if ctx is cancelled while waiting, and ErrClosed once
+// the pool is shutting down; in both cases done is never called.
+// Otherwise done, if not nil, is called from the worker with the handler's
+// result. When the handler returns a RetryError, the event goes back to the end
+// of its queue once the delay has passed, and done is only called with the
+// result of the last attempt; events submitted meanwhile may run before it.
+// The handler's context carries the values of ctx, but not its cancellation.
+func (p *Pool) Submit(ctx context.Context, bucketName string, objectKeyEncoded string, versionID string, done func(error)) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	select {
+	case p.queueFor(bucketName, objectKeyEncoded) <- job{values: ctx, bucket: bucketName, key: objectKeyEncoded, version: versionID, done: done}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// InFlight returns the number of events currently being handled.
+func (p *Pool) InFlight() int {
+	return int(p.inFlight.Load())
+}
+
+// Shutdown stops accepting events and waits for queued and running ones to
+// finish. Retries waiting for their delay are not run, but reported as
+// interrupted with ErrClosed, and so are those asked for by the events still
+// running. If ctx expires first, the handlers' context is cancelled, jobs
+// still queued fail with context.Canceled, and Shutdown waits for the workers
+// to return before reporting ctx.Err().
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, q := range p.queues {
+			close(q)
+		}
+	}
+	p.mu.Unlock()
+
+	p.retryMu.Lock()
+	p.stopped = true
+	// A timer that fired meanwhile finds its retry gone and leaves it to us.
+	var released []*job
+	for j, timer := range p.retries {
+		timer.Stop()
+		released = append(released, j)
+		delete(p.retries, j)
+	}
+	p.retryMu.Unlock()
+	for _, j := range released {
+		p.interrupt(*j)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting events and waits for queued and running ones to finish.
+func (p *Pool) Close() {
+	p.Shutdown(context.Background())
+}